@@ -1,9 +1,13 @@
 package main
 
 import (
+	"flag"
+
 	_ "github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"secretprovider"
 )
 
 func init() {
@@ -18,11 +22,52 @@ func init() {
 	if errConfig != nil {
 		log.Fatalln(errConfig)
 	}
+
+	flag.String("mode", "", "encrypt-config, decrypt-config, edit-config or migrate-secrets")
+	flag.String("kms-key", "", "KMS key wrapping the config data key")
+	flag.String("region", "", "region of the KMS key and of Secrets Manager")
+	flag.String("key-file", "", "file holding a 32 byte key wrapping the config data key")
+	flag.String("migrate-provider", "secretsmanager", "provider migrate-secrets stores the secrets in: secretsmanager, vault or file")
+	flag.String("db-credential", "", "secret id migrate-secrets stores the DB-* settings under")
+	flag.String("weather-credential", "", "secret id migrate-secrets stores WEATHER-API under")
+	flag.Bool("dry-run", false, "print what migrate-secrets would change without changing it")
+
+	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
+	pflag.Parse()
+	viper.BindPFlags(pflag.CommandLine)
+	secretprovider.InstallRedactor(viper.GetViper())
+
+	if !secretprovider.IsConfigMode(viper.GetString("mode")) {
+		err := secretprovider.LoadSecureConfig(viper.GetViper())
+		if err != nil {
+			log.Fatalln(err)
+		}
+		getSecret()
+	}
 	log.WithField("status", "success").Debug("initialize")
 }
 
 func main() {
+	if mode := viper.GetString("mode"); secretprovider.IsConfigMode(mode) {
+		err := secretprovider.RunConfigMode(viper.GetViper(), mode)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	log.WithField("user", viper.GetString("DB-USER")).Info("db-credentials")
 	log.WithField("host", viper.GetString("DB-HOST")).Info("db-credentials")
 	log.WithField("api-key", viper.GetString("WEATHER-API")).Info("weather-api")
 }
+
+// getSecret resolves the secret references of the config, such as
+// DB-PASSWORD: secretsmanager://dev/db-test#password.
+func getSecret() {
+	err := secretprovider.NewResolver(viper.GetViper(), "env", "file").Resolve()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// plain values of the config are secrets too
+	secretprovider.DefaultRedactor.Add(viper.GetString("DB-PASSWORD"), viper.GetString("WEATHER-API"))
+}
@@ -5,5 +5,12 @@ go 1.16
 require (
 	github.com/go-sql-driver/mysql v1.6.0
 	github.com/sirupsen/logrus v1.8.1
+	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.9.0
+	secretprovider v0.0.0
+	sqlcrypt v0.0.0
 )
+
+replace secretprovider => ../secretprovider
+
+replace sqlcrypt => ../../data-encryption/sqlcrypt
@@ -3,14 +3,19 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"secretprovider"
+	"sqlcrypt"
 )
 
 func init() {
@@ -25,10 +30,40 @@ func init() {
 	if errConfig != nil {
 		log.Fatalln(errConfig)
 	}
+
+	flag.String("mode", "", "encrypt-config, decrypt-config, edit-config or migrate-secrets")
+	flag.String("kms-key", "", "KMS key wrapping the config data key")
+	flag.String("region", "", "region of the KMS key and of Secrets Manager")
+	flag.String("key-file", "", "file holding a 32 byte key wrapping the config data key")
+	flag.String("migrate-provider", "secretsmanager", "provider migrate-secrets stores the secrets in: secretsmanager, vault or file")
+	flag.String("db-credential", "", "secret id migrate-secrets stores the DB-* settings under")
+	flag.String("weather-credential", "", "secret id migrate-secrets stores WEATHER-API under")
+	flag.Bool("dry-run", false, "print what migrate-secrets would change without changing it")
+
+	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
+	pflag.Parse()
+	viper.BindPFlags(pflag.CommandLine)
+	secretprovider.InstallRedactor(viper.GetViper())
+
+	if !secretprovider.IsConfigMode(viper.GetString("mode")) {
+		err := secretprovider.LoadSecureConfig(viper.GetViper())
+		if err != nil {
+			log.Fatalln(err)
+		}
+		getSecret()
+	}
 	log.WithField("status", "success").Debug("initialize")
 }
 
 func main() {
+	if mode := viper.GetString("mode"); secretprovider.IsConfigMode(mode) {
+		err := secretprovider.RunConfigMode(viper.GetViper(), mode)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	data := fetchWeather(viper.GetString("WEATHER-API"))
 	db := connectRDS()
 	createData(db, data)
@@ -70,17 +105,22 @@ func fetchWeather(token string) (output openWeatherResp) {
 func connectRDS() (db *sql.DB) {
 	log.WithField("status", "starting").Info("connectRDS")
 
+	host := viper.GetString("DB-HOST")
+	if port := viper.GetString("DB-PORT"); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
 	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s",
 		viper.GetString("DB-USER"),
 		viper.GetString("DB-PASSWORD"),
-		viper.GetString("DB-HOST"),
+		host,
 		viper.GetString("DB-DEFAULT"),
 	)
 
-	db, err := sql.Open("mysql", dsn)
+	connector, err := mysql.MySQLDriver{}.OpenConnector(dsn)
 	if err != nil {
 		panic(err)
 	}
+	db = sql.OpenDB(sqlcrypt.ConnectorFromViper(viper.GetViper(), viper.GetString("REGION"), connector))
 	err = db.Ping()
 	if err != nil {
 		panic(err)
@@ -90,13 +130,12 @@ func connectRDS() (db *sql.DB) {
 	return
 }
 
+// createData binds the values as parameters, the ones the driver encrypts.
 func createData(db *sql.DB, data openWeatherResp) {
-	insertStmt := fmt.Sprintf(`INSERT INTO weather(time, temp, humidity) VALUES ('%s', %v, %d)`,
+	_, err := db.Exec(`INSERT INTO weather(time, temp, humidity) VALUES (?, ?, ?)`,
 		time.Now().Format("2006-01-02 15:04:05"),
 		data.Main.Temperature,
 		data.Main.Humidity)
-
-	_, err := db.Exec(insertStmt)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -112,7 +151,7 @@ func readData(db *sql.DB) {
 		Humidity int64
 	}
 
-	rows, err := db.Query("select * from weather")
+	rows, err := db.Query("select id, time, temp, humidity from weather")
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -131,3 +170,14 @@ func readData(db *sql.DB) {
 		}).Info("weather data")
 	}
 }
+
+// getSecret resolves the secret references of the config, such as
+// DB-PASSWORD: secretsmanager://dev/db-test#password.
+func getSecret() {
+	err := secretprovider.NewResolver(viper.GetViper(), "env", "file").Resolve()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// plain values of the config are secrets too
+	secretprovider.DefaultRedactor.Add(viper.GetString("DB-PASSWORD"), viper.GetString("WEATHER-API"))
+}
@@ -3,8 +3,10 @@ module credential-storage
 go 1.16
 
 require (
-	github.com/aws/aws-sdk-go v1.40.49
 	github.com/go-sql-driver/mysql v1.6.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/viper v1.9.0
+	secretprovider v0.0.0
 )
+
+replace secretprovider => ../secretprovider
@@ -1,14 +1,10 @@
 package main
 
 import (
-	"encoding/json"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	_ "github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"secretprovider"
 )
 
 func init() {
@@ -23,6 +19,7 @@ func init() {
 	if errConfig != nil {
 		log.Fatalln(errConfig)
 	}
+	secretprovider.InstallRedactor(viper.GetViper())
 
 	log.WithField("status", "success").Debug("initialize")
 }
@@ -34,61 +31,13 @@ func main() {
 	log.WithField("api-key", viper.GetString("WEATHER-API")).Info("weather-api")
 }
 
+// getSecret resolves the secret references of the config, DB-CREDENTIAL
+// and WEATHER-CREDENTIAL standing for references to every field of their
+// secrets.
 func getSecret() {
-	type dbCredential struct {
-		Username  string `json:"username"`
-		Password  string `json:"password"`
-		Host      string `json:"host"`
-		DBDefault string `json:"db-default"`
-	}
-	type weather struct {
-		Api string `json:"api"`
-	}
-
-	secretDBPath := viper.GetString("DB-CREDENTIAL")
-	secretWeatherPath := viper.GetString("WEATHER-CREDENTIAL")
-
-	region := viper.GetString("REGION")
-
-	svc := secretsmanager.New(session.New(),
-		aws.NewConfig().WithRegion(region))
-
-	//get db
-	inputDb := &secretsmanager.GetSecretValueInput{
-		SecretId: aws.String(secretDBPath),
-	}
-
-	resultDb, err := svc.GetSecretValue(inputDb)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	db := dbCredential{}
-	err = json.Unmarshal([]byte(*resultDb.SecretString), &db)
+	secretprovider.CredentialReferences(viper.GetViper())
+	err := secretprovider.NewResolver(viper.GetViper(), "env", "secretsmanager").Resolve()
 	if err != nil {
 		log.Fatalln(err)
 	}
-	//
-
-	// get weather
-	inputWeather := &secretsmanager.GetSecretValueInput{
-		SecretId: aws.String(secretWeatherPath),
-	}
-
-	resultWeather, err := svc.GetSecretValue(inputWeather)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	w := weather{}
-	err = json.Unmarshal([]byte(*resultWeather.SecretString), &w)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	//
-
-	viper.Set("WEATHER-API", w.Api)
-	viper.Set("DB-USER", db.Username)
-	viper.Set("DB-PASSWORD", db.Password)
-	viper.Set("DB-HOST", db.Host)
-	viper.Set("DB-DEFAULT", db.DBDefault)
-
 }
@@ -2,35 +2,74 @@ package main
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/secretsmanager"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"secretprovider"
+	"sqlcrypt"
 )
 
 func init() {
 	log.SetLevel(log.DebugLevel)
 	log.WithField("status", "starting").Debug("initialize")
 
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(".")
+
+	errConfig := viper.ReadInConfig()
+	if _, ok := errConfig.(viper.ConfigFileNotFoundError); errConfig != nil && !ok {
+		log.Fatalln(errConfig)
+	}
+
+	flag.String("profile", "", "config profile to run with, e.g. dev, staging or prod")
+	flag.String("db-credential", "", "secret id of the database credential")
+	flag.String("weather-credential", "", "secret id of the weather api key")
+	flag.String("region", "", "region of Secrets Manager")
+	flag.String("version-stage", "", "version stage of the secrets, AWSCURRENT when empty")
+	flag.String("secretsmanager-endpoint", "", "Secrets Manager endpoint override")
+	flag.Duration("secret-ttl", 5*time.Minute, "how long secrets are cached before they are read again")
+	flag.Duration("interval", 0, "fetch the weather every interval instead of once")
+
+	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
+	pflag.Parse()
+	viper.BindPFlags(pflag.CommandLine)
+
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
+	viper.AutomaticEnv()
+	secretprovider.InstallRedactor(viper.GetViper())
+
+	loadProfile(viper.GetString("PROFILE"))
 	getSecret()
 
 	log.WithField("status", "success").Debug("initialize")
 }
 
 func main() {
-
-	data := fetchWeather(viper.GetString("WEATHER-API"))
 	db := connectRDS()
-	createData(db, data)
-	readData(db)
+	for {
+		data := fetchWeather(viper.GetString("WEATHER-API"))
+		createData(db, data)
+		readData(db)
+
+		interval := viper.GetDuration("interval")
+		if interval <= 0 {
+			return
+		}
+		time.Sleep(interval)
+		getSecret()
+	}
 }
 
 type openWeatherResp struct {
@@ -68,17 +107,30 @@ func fetchWeather(token string) (output openWeatherResp) {
 func connectRDS() (db *sql.DB) {
 	log.WithField("status", "starting").Info("connectRDS")
 
+	host := viper.GetString("DB-HOST")
+	if port := viper.GetString("DB-PORT"); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
 	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s",
 		viper.GetString("DB-USER"),
 		viper.GetString("DB-PASSWORD"),
-		viper.GetString("DB-HOST"),
+		host,
 		viper.GetString("DB-DEFAULT"),
 	)
 
-	db, err := sql.Open("mysql", dsn)
+	// with DB-CREDENTIAL the connector reads the secret again when the
+	// password was rotated
+	var connector driver.Connector
+	var err error
+	if id := viper.GetString("DB-CREDENTIAL"); id != "" {
+		connector, err = openRotating(dsn, id)
+	} else {
+		connector, err = mysql.MySQLDriver{}.OpenConnector(dsn)
+	}
 	if err != nil {
 		panic(err)
 	}
+	db = sql.OpenDB(sqlcrypt.ConnectorFromViper(viper.GetViper(), viper.GetString("REGION"), connector))
 	err = db.Ping()
 	if err != nil {
 		panic(err)
@@ -88,13 +140,20 @@ func connectRDS() (db *sql.DB) {
 	return
 }
 
+func openRotating(dsn, id string) (connector driver.Connector, err error) {
+	provider, err := secrets.Provider("secret")
+	if err != nil {
+		return
+	}
+	return secretprovider.NewDBConnector(dsn, provider, id)
+}
+
+// createData binds the values as parameters, the ones the driver encrypts.
 func createData(db *sql.DB, data openWeatherResp) {
-	insertStmt := fmt.Sprintf(`INSERT INTO weather(time, temp, humidity) VALUES ('%s', %v, %d)`,
+	_, err := db.Exec(`INSERT INTO weather(time, temp, humidity) VALUES (?, ?, ?)`,
 		time.Now().Format("2006-01-02 15:04:05"),
 		data.Main.Temperature,
 		data.Main.Humidity)
-
-	_, err := db.Exec(insertStmt)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -110,7 +169,7 @@ func readData(db *sql.DB) {
 		Humidity int64
 	}
 
-	rows, err := db.Query("select * from weather")
+	rows, err := db.Query("select id, time, temp, humidity from weather")
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -130,62 +189,58 @@ func readData(db *sql.DB) {
 	}
 }
 
-func getSecret() {
-	type dbCredential struct {
-		Username  string `json:"username"`
-		Password  string `json:"password"`
-		Host      string `json:"host"`
-		Port      int    `json:"port"`
-		DBDefault string `json:"db-default"`
-	}
-	type weather struct {
-		Api string `json:"api"`
-	}
-
-	secretDBName := "test/AppDemo/mysql"
-	secretWeatherName := "test/AppDemo/weather"
-
-	region := "ap-southeast-1"
-
-	svc := secretsmanager.New(session.New(),
-		aws.NewConfig().WithRegion(region))
-
-	//get db
-	inputDb := &secretsmanager.GetSecretValueInput{
-		SecretId: aws.String(secretDBName),
+// loadProfile lays the settings of PROFILES.<profile> over the rest of
+// config.yaml, flags and environment variables still take precedence:
+//
+//	PROFILES:
+//	  prod:
+//	    DB-CREDENTIAL: prod/db
+//	    REGION: ap-southeast-3
+func loadProfile(profile string) {
+	if profile == "" {
+		return
 	}
-
-	resultDb, err := svc.GetSecretValue(inputDb)
-	if err != nil {
-		log.Fatalln(err)
+	settings := viper.Sub("PROFILES." + profile)
+	if settings == nil {
+		log.Fatalf("profile %s is not in PROFILES", profile)
 	}
-	db := dbCredential{}
-	err = json.Unmarshal([]byte(*resultDb.SecretString), &db)
+	err := viper.MergeConfigMap(settings.AllSettings())
 	if err != nil {
 		log.Fatalln(err)
 	}
-	//
+	log.WithField("profile", profile).Debug("loadProfile")
+}
 
-	// get weather
-	inputWeather := &secretsmanager.GetSecretValueInput{
-		SecretId: aws.String(secretWeatherName),
-	}
+var secrets *secretprovider.Resolver
 
-	resultWeather, err := svc.GetSecretValue(inputWeather)
+// getSecret resolves the secret references of the config, DB-CREDENTIAL
+// and WEATHER-CREDENTIAL standing for references to every field of their
+// secrets.
+//
+// The secrets stay cached for SECRET-TTL and are refreshed in the
+// background, calling getSecret again picks up rotated ones.
+func getSecret() {
+	if secrets == nil {
+		secretprovider.CredentialReferences(viper.GetViper())
+		secrets = secretprovider.NewResolver(viper.GetViper(), "env", "secretsmanager")
+		secrets.Skip = []string{"PROFILES."}
+		secrets.TTL = viper.GetDuration("SECRET-TTL")
+		secrets.OnChange(func(previous, current secretprovider.Secret) {
+			log.WithFields(log.Fields{
+				"secret":  current.ID,
+				"version": current.Version,
+			}).Info("secret rotated")
+		})
+	}
+	err := secrets.Resolve()
 	if err != nil {
 		log.Fatalln(err)
 	}
-	w := weather{}
-	err = json.Unmarshal([]byte(*resultWeather.SecretString), &w)
-	if err != nil {
-		log.Fatalln(err)
+	for _, key := range []string{"DB-USER", "DB-HOST", "WEATHER-API"} {
+		if viper.GetString(key) == "" {
+			log.Fatalf("%s is required", key)
+		}
 	}
-	//
-
-	viper.Set("WEATHER-API", w.Api)
-	viper.Set("DB-USER", db.Username)
-	viper.Set("DB-PASSWORD", db.Password)
-	viper.Set("DB-HOST", fmt.Sprintf("%s:%d", db.Host, db.Port))
-	viper.Set("DB-DEFAULT", db.DBDefault)
-
+	// values set in the config rather than referenced are secrets too
+	secretprovider.DefaultRedactor.Add(viper.GetString("DB-PASSWORD"), viper.GetString("WEATHER-API"))
 }
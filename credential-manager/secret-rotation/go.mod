@@ -0,0 +1,18 @@
+module secret-rotation
+
+go 1.16
+
+require (
+	github.com/aws/aws-lambda-go v1.19.1
+	github.com/aws/aws-sdk-go v1.40.49
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/sirupsen/logrus v1.8.1
+	github.com/spf13/pflag v1.0.5
+	github.com/spf13/viper v1.9.0
+	secretprovider v0.0.0
+	secretsmanager-local v0.0.0
+)
+
+replace secretprovider => ../secretprovider
+
+replace secretsmanager-local => ../secretsmanager-local
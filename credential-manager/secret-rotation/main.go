@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"secretprovider"
+)
+
+func init() {
+	log.SetLevel(log.DebugLevel)
+	log.WithField("status", "starting").Debug("initialize")
+
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(".")
+
+	errConfig := viper.ReadInConfig()
+	if _, ok := errConfig.(viper.ConfigFileNotFoundError); errConfig != nil && !ok {
+		log.Fatalln(errConfig)
+	}
+
+	flag.String("secret-id", "", "secret holding the database credential")
+	flag.String("step", "all", "createSecret, setSecret, testSecret, finishSecret or all")
+	flag.String("token", "", "client request token of the version being rotated, generated for all")
+	flag.String("strategy", "", "single or alternating")
+	flag.String("master-secret", "", "secret of the user creating the clone user, for alternating")
+	flag.String("region", "", "region of Secrets Manager")
+	flag.String("secretsmanager-endpoint", "", "Secrets Manager endpoint override")
+
+	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
+	pflag.Parse()
+	viper.BindPFlags(pflag.CommandLine)
+
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+	secretprovider.InstallRedactor(viper.GetViper())
+
+	log.WithField("status", "success").Debug("initialize")
+}
+
+// rotationEvent is what Secrets Manager invokes a rotation function with.
+type rotationEvent struct {
+	SecretID           string `json:"SecretId"`
+	ClientRequestToken string `json:"ClientRequestToken"`
+	Step               string `json:"Step"`
+}
+
+func main() {
+	r := newRotator()
+	if os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
+		lambda.Start(func(event rotationEvent) error {
+			return r.run(event.SecretID, event.ClientRequestToken, event.Step)
+		})
+		return
+	}
+
+	secretID := viper.GetString("secret-id")
+	if secretID == "" {
+		log.Fatalln("secret-id is required")
+	}
+	step := viper.GetString("step")
+	token := viper.GetString("token")
+	steps := []string{step}
+	if step == "all" {
+		steps = rotationSteps
+		if token == "" {
+			token = newToken()
+		}
+	}
+	if token == "" {
+		log.Fatalln("token is required")
+	}
+
+	for _, step := range steps {
+		err := r.run(secretID, token, step)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// newToken makes a version 4 UUID, the format of client request tokens.
+func newToken() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
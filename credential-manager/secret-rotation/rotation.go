@@ -0,0 +1,471 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"secretprovider"
+)
+
+// The four steps Secrets Manager calls a rotation function with, for one
+// client request token:
+//
+//	createSecret  puts a new credential in the secret as AWSPENDING
+//	setSecret     changes the password in the database
+//	testSecret    logs in with the AWSPENDING credential
+//	finishSecret  moves AWSCURRENT to the new version
+//
+// With the single strategy the password of the user in the secret is
+// changed in place, connections opening between setSecret and
+// finishSecret fail until they read AWSPENDING. The alternating strategy
+// switches between the user and a <user>_clone copy of it created with
+// MASTER-SECRET, so the credential in AWSCURRENT keeps working throughout.
+var rotationSteps = []string{"createSecret", "setSecret", "testSecret", "finishSecret"}
+
+const (
+	stageCurrent  = "AWSCURRENT"
+	stagePending  = "AWSPENDING"
+	stagePrevious = "AWSPREVIOUS"
+
+	cloneSuffix = "_clone"
+
+	// passwordCharacters leaves out the quotes, slash, backslash and @ that
+	// break DSNs and shell scripts.
+	passwordCharacters = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789!#$%&()*+,-.:;<=>?[]^_{|}~"
+)
+
+type rotator struct {
+	svc            secretsmanageriface.SecretsManagerAPI
+	strategy       string
+	masterSecret   string
+	passwordLength int
+}
+
+func newRotator() *rotator {
+	config := aws.NewConfig().WithRegion(viper.GetString("REGION"))
+	if endpoint := viper.GetString("SECRETSMANAGER-ENDPOINT"); endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	strategy := viper.GetString("STRATEGY")
+	if strategy == "" {
+		strategy = "single"
+	}
+	length := viper.GetInt("PASSWORD-LENGTH")
+	if length == 0 {
+		length = 32
+	}
+	return &rotator{
+		svc:            secretsmanager.New(session.New(), config),
+		strategy:       strategy,
+		masterSecret:   viper.GetString("MASTER-SECRET"),
+		passwordLength: length,
+	}
+}
+
+func (r *rotator) run(secretID, token, step string) (err error) {
+	logger := log.WithFields(log.Fields{"secret": secretID, "token": token})
+	logger.WithField("status", "starting").Info(step)
+
+	done, err := r.checkVersion(secretID, token, step)
+	if err != nil || done {
+		return
+	}
+	switch step {
+	case "createSecret":
+		err = r.createSecret(secretID, token)
+	case "setSecret":
+		err = r.setSecret(secretID, token)
+	case "testSecret":
+		err = r.testSecret(secretID, token)
+	case "finishSecret":
+		err = r.finishSecret(secretID, token)
+	default:
+		err = fmt.Errorf("unknown step %s", step)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", step, err)
+	}
+	logger.WithField("status", "success").Info(step)
+	return
+}
+
+// checkVersion makes sure the token is the version being rotated. Secrets
+// Manager adds it as AWSPENDING before calling createSecret, a local run
+// has createSecret add it.
+func (r *rotator) checkVersion(secretID, token, step string) (done bool, err error) {
+	describe, err := r.svc.DescribeSecret(&secretsmanager.DescribeSecretInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return
+	}
+	stages, ok := describe.VersionIdsToStages[token]
+	if !ok {
+		if step == "createSecret" {
+			return false, nil
+		}
+		return false, fmt.Errorf("secret %s has no version %s", secretID, token)
+	}
+	if hasStage(stages, stageCurrent) {
+		log.WithField("token", token).Info("version is already AWSCURRENT")
+		return true, nil
+	}
+	if !hasStage(stages, stagePending) {
+		return false, fmt.Errorf("version %s of %s is not AWSPENDING", token, secretID)
+	}
+	return
+}
+
+func (r *rotator) createSecret(secretID, token string) (err error) {
+	current, raw, err := r.credential(secretID, stageCurrent, "")
+	if err != nil {
+		return
+	}
+	_, _, err = r.credential(secretID, stagePending, token)
+	if err == nil {
+		log.WithField("token", token).Info("AWSPENDING already created")
+		return
+	}
+	if !isNotFound(err) {
+		return
+	}
+
+	username := current.Username
+	if r.strategy == "alternating" {
+		if strings.HasSuffix(username, cloneSuffix) {
+			username = strings.TrimSuffix(username, cloneSuffix)
+		} else {
+			username += cloneSuffix
+		}
+		if len(username) > 32 {
+			return fmt.Errorf("user name %s is longer than 32 characters", username)
+		}
+	} else if r.strategy != "single" {
+		return fmt.Errorf("unknown strategy %s", r.strategy)
+	}
+	password, err := newPassword(r.passwordLength)
+	if err != nil {
+		return
+	}
+	secretprovider.DefaultRedactor.Add(password)
+
+	// keep every other field of the secret, such as engine or dbname
+	raw["username"] = username
+	raw["password"] = password
+	secretString, err := json.Marshal(raw)
+	if err != nil {
+		return
+	}
+	_, err = r.svc.PutSecretValue(&secretsmanager.PutSecretValueInput{
+		SecretId:           aws.String(secretID),
+		ClientRequestToken: aws.String(token),
+		SecretString:       aws.String(string(secretString)),
+		VersionStages:      aws.StringSlice([]string{stagePending}),
+	})
+	return
+}
+
+func (r *rotator) setSecret(secretID, token string) (err error) {
+	pending, _, err := r.credential(secretID, stagePending, token)
+	if err != nil {
+		return
+	}
+	if db, errOpen := openDB(pending); errOpen == nil {
+		db.Close()
+		log.WithField("token", token).Info("AWSPENDING is already set in the database")
+		return
+	}
+	current, _, err := r.credential(secretID, stageCurrent, "")
+	if err != nil {
+		return
+	}
+	if pending.Address() != current.Address() || pending.DBDefault != current.DBDefault {
+		return fmt.Errorf("AWSPENDING points to %s/%s, AWSCURRENT to %s/%s",
+			pending.Address(), pending.DBDefault, current.Address(), current.DBDefault)
+	}
+
+	if r.strategy == "alternating" {
+		return r.setCloneUser(current, pending)
+	}
+
+	// the password may have been changed by an earlier try of this step
+	db, err := openDB(current)
+	if secretprovider.IsAccessDenied(err) {
+		previous, _, errPrevious := r.credential(secretID, stagePrevious, "")
+		if errPrevious != nil {
+			return err
+		}
+		db, err = openDB(previous)
+	}
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	// ALTER USER without a host means user@'%', change the account the
+	// user logged in as
+	var account string
+	err = db.QueryRow("SELECT CURRENT_USER()").Scan(&account)
+	if err != nil {
+		return
+	}
+	at := strings.LastIndex(account, "@")
+	if at < 0 || account[:at] != pending.Username {
+		return fmt.Errorf("logged in as %s, not as %s", account, pending.Username)
+	}
+	_, err = db.Exec("ALTER USER ?@? IDENTIFIED BY ?", pending.Username, account[at+1:], pending.Password)
+	return
+}
+
+// setCloneUser logs in with the master credential to create the other user
+// of the alternating pair with the grants of the current one, and sets its
+// password.
+func (r *rotator) setCloneUser(current, pending secretprovider.DBCredential) (err error) {
+	if r.masterSecret == "" {
+		return errors.New("master-secret is required for the alternating strategy")
+	}
+	master, _, err := r.credential(r.masterSecret, stageCurrent, "")
+	if err != nil {
+		return
+	}
+	master.Host, master.Port, master.DBDefault = current.Host, current.Port, current.DBDefault
+	db, err := openDB(master)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	// the clone connects from wherever the current user may, a user can
+	// have a row in mysql.user for each host
+	rows, err := db.Query("SELECT Host FROM mysql.user WHERE User = ?", current.Username)
+	if err != nil {
+		return
+	}
+	var hosts []string
+	for rows.Next() {
+		var host string
+		err = rows.Scan(&host)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		hosts = append(hosts, host)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if len(hosts) == 0 {
+		return fmt.Errorf("user %s doesn't exist", current.Username)
+	}
+	for _, host := range hosts {
+		err = cloneUserHost(db, current.Username, pending, host)
+		if err != nil {
+			return fmt.Errorf("%s@%s: %w", pending.Username, host, err)
+		}
+	}
+	return
+}
+
+// cloneUserHost creates pending.Username@host with the grants of
+// username@host and sets its password.
+func cloneUserHost(db *sql.DB, username string, pending secretprovider.DBCredential, host string) (err error) {
+	_, err = db.Exec("CREATE USER IF NOT EXISTS ?@? IDENTIFIED BY ?", pending.Username, host, pending.Password)
+	if err != nil {
+		return
+	}
+	rows, err := db.Query("SHOW GRANTS FOR ?@?", username, host)
+	if err != nil {
+		return
+	}
+	var grants []string
+	for rows.Next() {
+		var grant string
+		err = rows.Scan(&grant)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		grants = append(grants, grant)
+	}
+	rows.Close()
+	statements, err := cloneGrants(grants, username, host)
+	if err != nil {
+		return
+	}
+	for _, statement := range statements {
+		_, err = db.Exec(statement, pending.Username, host)
+		if err != nil {
+			return
+		}
+	}
+	_, err = db.Exec("ALTER USER ?@? IDENTIFIED BY ?", pending.Username, host, pending.Password)
+	return
+}
+
+// passwordClause is the hash MySQL 5.7 and MariaDB print in the grants of
+// a user, which must not be replayed on the clone.
+var passwordClause = regexp.MustCompile(` IDENTIFIED (BY PASSWORD|WITH \S+ AS) '[^']*'`)
+
+// cloneGrants turns the SHOW GRANTS output of username@host into
+// statements granting the same to a ?@? grantee, keeping what follows the
+// grantee such as WITH GRANT OPTION. The USAGE grant is left out, CREATE
+// USER already gave it.
+func cloneGrants(grants []string, username, host string) (statements []string, err error) {
+	quoted := func(name string) string {
+		return "[`']" + regexp.QuoteMeta(name) + "[`']"
+	}
+	grantee := regexp.MustCompile(` TO ` + quoted(username) + `@` + quoted(host))
+	for _, grant := range grants {
+		if strings.HasPrefix(grant, "GRANT USAGE ON *.* TO ") {
+			continue
+		}
+		found := grantee.FindAllStringIndex(grant, -1)
+		if found == nil {
+			return nil, fmt.Errorf("can't copy grant %q", grant)
+		}
+		last := found[len(found)-1]
+		suffix := passwordClause.ReplaceAllString(grant[last[1]:], "")
+		statements = append(statements, grant[:last[0]]+" TO ?@?"+suffix)
+	}
+	return
+}
+
+func (r *rotator) testSecret(secretID, token string) (err error) {
+	pending, _, err := r.credential(secretID, stagePending, token)
+	if err != nil {
+		return
+	}
+	db, err := openDB(pending)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	var now string
+	return db.QueryRow("SELECT NOW()").Scan(&now)
+}
+
+func (r *rotator) finishSecret(secretID, token string) (err error) {
+	describe, err := r.svc.DescribeSecret(&secretsmanager.DescribeSecretInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return
+	}
+	currentVersion := ""
+	for version, stages := range describe.VersionIdsToStages {
+		if hasStage(stages, stageCurrent) {
+			currentVersion = version
+		}
+	}
+	if currentVersion != token {
+		input := &secretsmanager.UpdateSecretVersionStageInput{
+			SecretId:        aws.String(secretID),
+			VersionStage:    aws.String(stageCurrent),
+			MoveToVersionId: aws.String(token),
+		}
+		// a secret created without a value has no AWSCURRENT to remove
+		if currentVersion != "" {
+			input.RemoveFromVersionId = aws.String(currentVersion)
+		}
+		_, err = r.svc.UpdateSecretVersionStage(input)
+		if err != nil {
+			return
+		}
+	}
+	_, err = r.svc.UpdateSecretVersionStage(&secretsmanager.UpdateSecretVersionStageInput{
+		SecretId:            aws.String(secretID),
+		VersionStage:        aws.String(stagePending),
+		RemoveFromVersionId: aws.String(token),
+	})
+	return
+}
+
+// credential reads a version of a dbCredential secret, raw holding all of
+// its fields.
+func (r *rotator) credential(secretID, stage, version string) (credential secretprovider.DBCredential, raw map[string]interface{}, err error) {
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(secretID),
+		VersionStage: aws.String(stage),
+	}
+	if version != "" {
+		input.VersionId = aws.String(version)
+	}
+	result, err := r.svc.GetSecretValue(input)
+	if err != nil {
+		return
+	}
+	secretprovider.DefaultRedactor.AddSecret(aws.StringValue(result.SecretString))
+	err = json.Unmarshal([]byte(aws.StringValue(result.SecretString)), &credential)
+	if err != nil {
+		return
+	}
+	dec := json.NewDecoder(strings.NewReader(aws.StringValue(result.SecretString)))
+	dec.UseNumber()
+	err = dec.Decode(&raw)
+	return
+}
+
+func openDB(credential secretprovider.DBCredential) (db *sql.DB, err error) {
+	config := mysql.NewConfig()
+	config.User = credential.Username
+	config.Passwd = credential.Password
+	config.Net = "tcp"
+	config.Addr = credential.Address()
+	config.DBName = credential.DBDefault
+	config.InterpolateParams = true
+	config.Timeout = 5 * time.Second
+
+	connector, err := mysql.NewConnector(config)
+	if err != nil {
+		return
+	}
+	db = sql.OpenDB(connector)
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return
+}
+
+func newPassword(length int) (string, error) {
+	password := make([]byte, length)
+	count := big.NewInt(int64(len(passwordCharacters)))
+	for i := range password {
+		n, err := rand.Int(rand.Reader, count)
+		if err != nil {
+			return "", err
+		}
+		password[i] = passwordCharacters[n.Int64()]
+	}
+	return string(password), nil
+}
+
+func hasStage(stages []*string, stage string) bool {
+	for _, s := range stages {
+		if aws.StringValue(s) == stage {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/go-sql-driver/mysql"
+	"secretprovider"
+	"secretsmanager-local/smlocal"
+)
+
+// newTestRotator runs a rotator against the Secrets Manager stand-in.
+func newTestRotator(t *testing.T, strategy string) *rotator {
+	t.Helper()
+	store, err := smlocal.OpenStore(filepath.Join(t.TempDir(), "secrets.json"), "ap-southeast-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+	config := aws.NewConfig().
+		WithRegion("ap-southeast-1").
+		WithEndpoint(server.URL).
+		WithCredentials(credentials.NewStaticCredentials("test", "test", ""))
+	return &rotator{
+		svc:            secretsmanager.New(session.New(), config),
+		strategy:       strategy,
+		passwordLength: 16,
+	}
+}
+
+func createTestSecret(t *testing.T, r *rotator, id string, credential secretprovider.DBCredential) {
+	t.Helper()
+	value, err := json.Marshal(credential)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.svc.CreateSecret(&secretsmanager.CreateSecretInput{
+		Name:         aws.String(id),
+		SecretString: aws.String(string(value)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// versionStages lists the labels of every version holding one.
+func versionStages(t *testing.T, r *rotator, id string) map[string][]string {
+	t.Helper()
+	describe, err := r.svc.DescribeSecret(&secretsmanager.DescribeSecretInput{SecretId: aws.String(id)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stages := map[string][]string{}
+	for version, labels := range describe.VersionIdsToStages {
+		stages[version] = aws.StringValueSlice(labels)
+		sort.Strings(stages[version])
+	}
+	return stages
+}
+
+func currentVersion(t *testing.T, r *rotator, id string) string {
+	t.Helper()
+	for version, stages := range versionStages(t, r, id) {
+		for _, stage := range stages {
+			if stage == stageCurrent {
+				return version
+			}
+		}
+	}
+	t.Fatalf("secret %s has no AWSCURRENT version", id)
+	return ""
+}
+
+// TestCreateAndFinishSecret runs the steps that only talk to Secrets
+// Manager, twice each as Secrets Manager retries them.
+func TestCreateAndFinishSecret(t *testing.T) {
+	for _, test := range []struct{ strategy, username string }{
+		{"single", "app"},
+		{"alternating", "app_clone"},
+	} {
+		t.Run(test.strategy, func(t *testing.T) {
+			r := newTestRotator(t, test.strategy)
+			createTestSecret(t, r, "db", secretprovider.DBCredential{
+				Username: "app", Password: "old-password", Host: "127.0.0.1", Port: 3306, DBDefault: "weather",
+			})
+			previous := currentVersion(t, r, "db")
+			token := newToken()
+
+			for i := 0; i < 2; i++ {
+				err := r.run("db", token, "createSecret")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			pending, _, err := r.credential("db", stagePending, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pending.Username != test.username || pending.Password == "old-password" || len(pending.Password) != 16 {
+				t.Errorf("AWSPENDING is %s with a password of %d characters", pending.Username, len(pending.Password))
+			}
+			if pending.Host != "127.0.0.1" || pending.DBDefault != "weather" {
+				t.Errorf("AWSPENDING lost the fields of AWSCURRENT: %+v", pending)
+			}
+			if err = r.run("db", token, "setSecret"); err == nil {
+				t.Error("setSecret ran with a version of another token")
+			}
+
+			for i := 0; i < 2; i++ {
+				err = r.run("db", token, "finishSecret")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := map[string][]string{previous: {stagePrevious}, token: {stageCurrent}}
+			if got := versionStages(t, r, "db"); !reflect.DeepEqual(got, want) {
+				t.Errorf("stages %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRunRejectsUnknownVersion(t *testing.T) {
+	r := newTestRotator(t, "single")
+	createTestSecret(t, r, "db", secretprovider.DBCredential{Username: "app", Password: "old-password"})
+	for _, step := range []string{"setSecret", "testSecret", "finishSecret"} {
+		if err := r.run("db", newToken(), step); err == nil {
+			t.Errorf("%s ran for a token that was never created", step)
+		}
+	}
+}
+
+// TestFinishSecretWithoutCurrent finishes the first version of a secret
+// created without a value.
+func TestFinishSecretWithoutCurrent(t *testing.T) {
+	r := newTestRotator(t, "single")
+	_, err := r.svc.CreateSecret(&secretsmanager.CreateSecretInput{Name: aws.String("db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := newToken()
+	_, err = r.svc.PutSecretValue(&secretsmanager.PutSecretValueInput{
+		SecretId:           aws.String("db"),
+		ClientRequestToken: aws.String(token),
+		SecretString:       aws.String(`{"username":"app","password":"first"}`),
+		VersionStages:      aws.StringSlice([]string{stagePending}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.run("db", token, "finishSecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{token: {stageCurrent}}
+	if got := versionStages(t, r, "db"); !reflect.DeepEqual(got, want) {
+		t.Errorf("stages %v, want %v", got, want)
+	}
+}
+
+func TestCloneGrants(t *testing.T) {
+	tests := []struct {
+		name   string
+		host   string
+		grants []string
+		want   []string
+	}{
+		{
+			name: "mysql 8",
+			host: "10.0.%",
+			grants: []string{
+				"GRANT USAGE ON *.* TO `app`@`10.0.%`",
+				"GRANT SELECT, INSERT ON `weather`.* TO `app`@`10.0.%`",
+				"GRANT UPDATE ON `weather`.`station` TO `app`@`10.0.%` WITH GRANT OPTION",
+				"GRANT `reporting`@`%` TO `app`@`10.0.%`",
+			},
+			want: []string{
+				"GRANT SELECT, INSERT ON `weather`.* TO ?@?",
+				"GRANT UPDATE ON `weather`.`station` TO ?@? WITH GRANT OPTION",
+				"GRANT `reporting`@`%` TO ?@?",
+			},
+		},
+		{
+			name: "mysql 5.7 and mariadb",
+			host: "%",
+			grants: []string{
+				"GRANT USAGE ON *.* TO 'app'@'%' IDENTIFIED BY PASSWORD '*2470C0C06DEE42FD1618BB99005ADCA2EC9D1E19'",
+				"GRANT ALL PRIVILEGES ON `weather`.* TO 'app'@'%' IDENTIFIED BY PASSWORD '*2470C0C06DEE42FD1618BB99005ADCA2EC9D1E19' WITH GRANT OPTION",
+			},
+			want: []string{
+				"GRANT ALL PRIVILEGES ON `weather`.* TO ?@? WITH GRANT OPTION",
+			},
+		},
+		{
+			name:   "grantee in a column name",
+			host:   "10.0.%",
+			grants: []string{"GRANT SELECT (` TO `app`@`10.0.%`) ON `weather`.`station` TO `app`@`10.0.%`"},
+			want:   []string{"GRANT SELECT (` TO `app`@`10.0.%`) ON `weather`.`station` TO ?@?"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := cloneGrants(test.grants, "app", test.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+	if _, err := cloneGrants([]string{"GRANT SELECT ON *.* TO `other`@`%`"}, "app", "%"); err == nil {
+		t.Error("copied a grant of another user")
+	}
+}
+
+// TestRotation runs all four steps against a MySQL server, reached with
+// the DSN of a user allowed to create users and grant in ROTATION_TEST_DSN:
+//
+//	ROTATION_TEST_DSN='root:rootpw@tcp(127.0.0.1:3306)/' go test ./...
+func TestRotation(t *testing.T) {
+	master := testMaster(t)
+	for _, strategy := range []string{"single", "alternating"} {
+		t.Run(strategy, func(t *testing.T) {
+			r := newTestRotator(t, strategy)
+			createTestSecret(t, r, "master", master)
+			r.masterSecret = "master"
+			user := createTestUser(t, master, "rotation_"+strategy)
+			createTestSecret(t, r, "db", user)
+
+			token := newToken()
+			for _, step := range rotationSteps {
+				err := r.run("db", token, step)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			current, _, err := r.credential("db", stageCurrent, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, err := openDB(current)
+			if err != nil {
+				t.Fatalf("can't log in with the rotated credential: %v", err)
+			}
+			db.Close()
+			if strategy == "single" {
+				if db, err = openDB(user); err == nil {
+					db.Close()
+					t.Error("the password before the rotation still works")
+				}
+			} else if current.Username != user.Username+cloneSuffix {
+				t.Errorf("rotated to %s, want the clone user", current.Username)
+			}
+		})
+	}
+}
+
+// TestRotationUserHosts rotates users without a '%' host: the single
+// strategy must change the account it logs in as, the alternating one must
+// clone every host of the user.
+func TestRotationUserHosts(t *testing.T) {
+	master := testMaster(t)
+	hosts := []string{"10.0.0.%", "127.0.0.1"}
+	for _, strategy := range []string{"single", "alternating"} {
+		t.Run(strategy, func(t *testing.T) {
+			r := newTestRotator(t, strategy)
+			createTestSecret(t, r, "master", master)
+			r.masterSecret = "master"
+			user := createTestUser(t, master, "rotation_hosts_"+strategy, hosts...)
+			createTestSecret(t, r, "db", user)
+
+			token := newToken()
+			for _, step := range rotationSteps {
+				err := r.run("db", token, step)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if strategy == "single" {
+				return
+			}
+			db, err := openDB(master)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			rows, err := db.Query("SELECT Host FROM mysql.user WHERE User = ?", user.Username+cloneSuffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var cloned []string
+			for rows.Next() {
+				var host string
+				err = rows.Scan(&host)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cloned = append(cloned, host)
+			}
+			sort.Strings(cloned)
+			if !reflect.DeepEqual(cloned, hosts) {
+				t.Errorf("clone has hosts %v, want %v", cloned, hosts)
+			}
+		})
+	}
+}
+
+// testMaster reads the master credential of ROTATION_TEST_DSN.
+func testMaster(t *testing.T) secretprovider.DBCredential {
+	t.Helper()
+	dsn := os.Getenv("ROTATION_TEST_DSN")
+	if dsn == "" {
+		t.Skip("ROTATION_TEST_DSN is not set")
+	}
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential := secretprovider.DBCredential{Username: config.User, Password: config.Passwd, Host: config.Addr}
+	if host, port, errSplit := net.SplitHostPort(config.Addr); errSplit == nil {
+		credential.Host = host
+		credential.Port, _ = strconv.Atoi(port)
+	}
+	return credential
+}
+
+// createTestUser creates a user allowed to read a test database from each
+// of hosts, '%' by default, dropping it and its clone when the test ends.
+func createTestUser(t *testing.T, master secretprovider.DBCredential, name string, hosts ...string) secretprovider.DBCredential {
+	t.Helper()
+	if len(hosts) == 0 {
+		hosts = []string{"%"}
+	}
+	var accounts []string
+	for _, host := range hosts {
+		accounts = append(accounts, "'"+name+"'@'"+host+"'", "'"+name+cloneSuffix+"'@'"+host+"'")
+	}
+	drop := "DROP USER IF EXISTS " + strings.Join(accounts, ", ")
+	statements := []string{"CREATE DATABASE IF NOT EXISTS rotation_test", drop}
+	for _, host := range hosts {
+		statements = append(statements,
+			"CREATE USER '"+name+"'@'"+host+"' IDENTIFIED BY 'before-rotation'",
+			"GRANT SELECT ON rotation_test.* TO '"+name+"'@'"+host+"'")
+	}
+
+	db, err := openDB(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range statements {
+		_, err = db.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		db, err := openDB(master)
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		db.Exec(drop)
+	})
+	user := master
+	user.Username, user.Password, user.DBDefault = name, "before-rotation", "rotation_test"
+	return user
+}
@@ -0,0 +1,130 @@
+package secretprovider
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// SecretsManager reads secrets by name or ARN from AWS Secrets Manager, at
+// VersionStage or AWSCURRENT when it is empty.
+type SecretsManager struct {
+	svc          secretsmanageriface.SecretsManagerAPI
+	VersionStage string
+}
+
+// NewSecretsManager connects to the Secrets Manager of a region, or to
+// endpoint when it isn't empty.
+func NewSecretsManager(region, endpoint string) *SecretsManager {
+	return &SecretsManager{
+		svc: secretsmanager.New(session.New(), awsConfig(region, endpoint)),
+	}
+}
+
+func (s *SecretsManager) Name() string { return "secretsmanager" }
+
+func (s *SecretsManager) GetSecret(id string) (secret Secret, err error) {
+	return s.GetSecretStage(id, s.VersionStage)
+}
+
+func (s *SecretsManager) GetSecretStage(id, versionStage string) (secret Secret, err error) {
+	result, err := s.svc.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(id),
+		VersionStage: stage(versionStage),
+	})
+	if isAWSError(err, secretsmanager.ErrCodeResourceNotFoundException) {
+		return secret, ErrNotFound
+	}
+	if err != nil {
+		return
+	}
+	value := aws.StringValue(result.SecretString)
+	if result.SecretString == nil {
+		value = string(result.SecretBinary)
+	}
+	return Secret{Value: value, Version: aws.StringValue(result.VersionId)}, nil
+}
+
+// PutSecret creates the secret, or adds the value to it as the AWSCURRENT
+// version when it exists.
+func (s *SecretsManager) PutSecret(id, value string) (secret Secret, err error) {
+	created, err := s.svc.CreateSecret(&secretsmanager.CreateSecretInput{
+		Name:         aws.String(id),
+		SecretString: aws.String(value),
+	})
+	if err == nil {
+		return Secret{Value: value, Version: aws.StringValue(created.VersionId)}, nil
+	}
+	if !isAWSError(err, secretsmanager.ErrCodeResourceExistsException) {
+		return
+	}
+	put, err := s.svc.PutSecretValue(&secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(id),
+		SecretString: aws.String(value),
+	})
+	if err != nil {
+		return
+	}
+	return Secret{Value: value, Version: aws.StringValue(put.VersionId)}, nil
+}
+
+// SSM reads SecureString and String parameters from SSM Parameter Store,
+// ids without a leading slash are read from the root of the hierarchy.
+type SSM struct {
+	svc ssmiface.SSMAPI
+}
+
+func NewSSM(region, endpoint string) *SSM {
+	return &SSM{
+		svc: ssm.New(session.New(), awsConfig(region, endpoint)),
+	}
+}
+
+func (s *SSM) Name() string { return "ssm" }
+
+func (s *SSM) GetSecret(id string) (secret Secret, err error) {
+	if !strings.HasPrefix(id, "/") {
+		id = "/" + id
+	}
+	result, err := s.svc.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(id),
+		WithDecryption: aws.Bool(true),
+	})
+	if isAWSError(err, ssm.ErrCodeParameterNotFound) {
+		return secret, ErrNotFound
+	}
+	if err != nil {
+		return
+	}
+	return Secret{
+		Value:   aws.StringValue(result.Parameter.Value),
+		Version: strconv.FormatInt(aws.Int64Value(result.Parameter.Version), 10),
+	}, nil
+}
+
+func awsConfig(region, endpoint string) *aws.Config {
+	config := aws.NewConfig().WithRegion(region)
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	return config
+}
+
+func stage(versionStage string) *string {
+	if versionStage == "" {
+		return nil
+	}
+	return aws.String(versionStage)
+}
+
+func isAWSError(err error, code string) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == code
+}
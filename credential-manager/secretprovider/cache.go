@@ -0,0 +1,186 @@
+package secretprovider
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Cache keeps the secrets read from a provider for TTL. Once started it
+// refreshes them in the background a little before they expire, each
+// instance at a random point of the last Jitter fraction of TTL so a fleet
+// doesn't ask Secrets Manager all at once. When a refresh fails the last
+// value is served for up to MaxStale longer, forever when it is zero, and
+// the provider is asked again at most once per TTL.
+type Cache struct {
+	TTL      time.Duration
+	Jitter   float64
+	MaxStale time.Duration
+
+	provider SecretProvider
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	onChange []func(previous, current Secret)
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type cacheEntry struct {
+	mu      sync.Mutex
+	secret  Secret
+	fetched time.Time
+	failed  time.Time
+	valid   bool
+}
+
+func NewCache(p SecretProvider, ttl time.Duration) *Cache {
+	return &Cache{
+		TTL:      ttl,
+		Jitter:   0.2,
+		provider: p,
+		entries:  map[string]*cacheEntry{},
+		stop:     make(chan struct{}),
+	}
+}
+
+func (c *Cache) Name() string { return c.provider.Name() }
+
+func (c *Cache) GetSecret(id string) (secret Secret, err error) {
+	e := c.entry(id)
+	e.mu.Lock()
+	if e.valid && (time.Since(e.fetched) < c.TTL || time.Since(e.failed) < c.TTL && c.servable(e)) {
+		secret = e.secret
+		e.mu.Unlock()
+		return
+	}
+	secret, previous, changed, err := c.refresh(id, e)
+	e.mu.Unlock()
+	if changed {
+		c.changed(previous, secret)
+	}
+	return
+}
+
+// GetSecretStage reads the current version again, skipping the cache, and
+// other stages without caching them.
+func (c *Cache) GetSecretStage(id, stage string) (secret Secret, err error) {
+	if stage != "" && stage != "AWSCURRENT" {
+		return GetSecretStage(c.provider, id, stage)
+	}
+	e := c.entry(id)
+	e.mu.Lock()
+	secret, previous, changed, err := c.refresh(id, e)
+	e.mu.Unlock()
+	if changed {
+		c.changed(previous, secret)
+	}
+	return
+}
+
+// OnChange calls fn whenever a refresh reads a new version of a secret.
+func (c *Cache) OnChange(fn func(previous, current Secret)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onChange = append(c.onChange, fn)
+}
+
+// Start refreshes the cached secrets in the background until Stop.
+func (c *Cache) Start() {
+	if c.TTL <= 0 {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(c.refreshInterval()):
+			}
+			c.refreshAll()
+		}
+	}()
+}
+
+func (c *Cache) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+func (c *Cache) refreshInterval() time.Duration {
+	return time.Duration(float64(c.TTL) * (1 - c.Jitter*rand.Float64()))
+}
+
+func (c *Cache) refreshAll() {
+	c.mu.Lock()
+	ids := make([]string, 0, len(c.entries))
+	for id := range c.entries {
+		ids = append(ids, id)
+	}
+	c.mu.Unlock()
+
+	for _, id := range ids {
+		e := c.entry(id)
+		e.mu.Lock()
+		secret, previous, changed, err := c.refresh(id, e)
+		e.mu.Unlock()
+		if err != nil {
+			log.WithField("secret", id).Warnf("refresh failed: %v", err)
+		}
+		if changed {
+			c.changed(previous, secret)
+		}
+	}
+}
+
+func (c *Cache) entry(id string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	if !ok {
+		e = &cacheEntry{}
+		c.entries[id] = e
+	}
+	return e
+}
+
+// refresh reads a secret again, the entry being locked by the caller.
+func (c *Cache) refresh(id string, e *cacheEntry) (secret, previous Secret, changed bool, err error) {
+	secret, err = c.provider.GetSecret(id)
+	if err != nil {
+		e.failed = time.Now()
+		if e.valid && c.servable(e) {
+			log.WithFields(log.Fields{
+				"secret": id,
+				"age":    time.Since(e.fetched).Round(time.Second),
+			}).Warnf("serving stale secret: %v", err)
+			return e.secret, previous, false, nil
+		}
+		return
+	}
+	DefaultRedactor.AddSecret(secret.Value)
+	if secret.ID == "" {
+		secret.ID = id
+	}
+	if secret.Provider == "" {
+		secret.Provider = c.provider.Name()
+	}
+	previous = e.secret
+	changed = e.valid && (previous.Version != secret.Version || previous.Value != secret.Value)
+	e.secret, e.fetched, e.valid = secret, time.Now(), true
+	return
+}
+
+// servable tells whether a secret that failed to refresh may still be used.
+func (c *Cache) servable(e *cacheEntry) bool {
+	return c.MaxStale == 0 || time.Since(e.fetched) < c.TTL+c.MaxStale
+}
+
+func (c *Cache) changed(previous, current Secret) {
+	c.mu.Lock()
+	callbacks := append([]func(previous, current Secret){}, c.onChange...)
+	c.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(previous, current)
+	}
+}
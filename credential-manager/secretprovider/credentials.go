@@ -0,0 +1,46 @@
+package secretprovider
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// DBCredential is the JSON secret of a MySQL user, as created by RDS for
+// Secrets Manager rotation.
+type DBCredential struct {
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Host      string `json:"host"`
+	Port      int    `json:"port,omitempty"`
+	DBDefault string `json:"db-default"`
+}
+
+// Address is host:port, or the host alone when it carries its port.
+func (c DBCredential) Address() string {
+	if c.Port == 0 {
+		return c.Host
+	}
+	return fmt.Sprintf("%s:%d", c.Host, c.Port)
+}
+
+// Weather is the JSON secret of the OpenWeather API key.
+type Weather struct {
+	Api string `json:"api"`
+}
+
+// CredentialReferences defaults the DB-* settings to references to the
+// fields of the DB-CREDENTIAL secret and WEATHER-API to the api key of the
+// WEATHER-CREDENTIAL secret, settings in the config still win.
+func CredentialReferences(v *viper.Viper) {
+	if id := v.GetString("DB-CREDENTIAL"); id != "" {
+		v.SetDefault("DB-USER", "secret://"+id+"#username")
+		v.SetDefault("DB-PASSWORD", "secret://"+id+"#password")
+		v.SetDefault("DB-HOST", "secret://"+id+"#host")
+		v.SetDefault("DB-PORT", "secret://"+id+"#port?")
+		v.SetDefault("DB-DEFAULT", "secret://"+id+"#db-default")
+	}
+	if id := v.GetString("WEATHER-CREDENTIAL"); id != "" {
+		v.SetDefault("WEATHER-API", "secret://"+id+"#api")
+	}
+}
@@ -0,0 +1,138 @@
+package secretprovider
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// errAccessDenied is ER_ACCESS_DENIED_ERROR, returned for a wrong password.
+const errAccessDenied = 1045
+
+// rotationStages are tried in order when the server denies access. During
+// a rotation the new password is set on the database before it becomes
+// AWSCURRENT, so AWSPENDING may already be the one that works.
+var rotationStages = []string{"AWSCURRENT", "AWSPENDING"}
+
+// DBConnector opens MySQL connections with the credential of a
+// DBCredential secret and follows its rotation: when the server denies
+// access it reads the secret again and retries with the new credential,
+// so connections opened after a password change keep working.
+//
+//	connector, err := secretprovider.NewDBConnector(dsn, providers, "dev/db-test")
+//	db := sql.OpenDB(connector)
+type DBConnector struct {
+	provider SecretProvider
+	id       string
+
+	mu     sync.Mutex
+	config *mysql.Config
+}
+
+func NewDBConnector(dsn string, p SecretProvider, id string) (c *DBConnector, err error) {
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return
+	}
+	return &DBConnector{provider: p, id: id, config: config}, nil
+}
+
+func (c *DBConnector) Driver() driver.Driver {
+	return mysql.MySQLDriver{}
+}
+
+func (c *DBConnector) Connect(ctx context.Context) (conn driver.Conn, err error) {
+	config := c.current()
+	conn, err = connect(ctx, config)
+	if !IsAccessDenied(err) {
+		return
+	}
+
+	// one reconnect at a time, the others use the credential it finds
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config != config {
+		conn, err = connect(ctx, c.config)
+		if !IsAccessDenied(err) {
+			return
+		}
+	}
+
+	log.WithField("secret", c.id).Warn("access denied, reading database credential again")
+	tried := map[string]bool{c.config.User + "\x00" + c.config.Passwd: true}
+	for _, stage := range rotationStages {
+		next, errSecret := c.credential(stage)
+		if errors.Is(errSecret, ErrNotFound) {
+			continue
+		}
+		if errSecret != nil {
+			log.WithFields(log.Fields{"secret": c.id, "stage": stage}).Warn(errSecret)
+			continue
+		}
+		if tried[next.User+"\x00"+next.Passwd] {
+			continue
+		}
+		tried[next.User+"\x00"+next.Passwd] = true
+
+		conn, err = connect(ctx, next)
+		if err == nil {
+			c.config = next
+			log.WithFields(log.Fields{"secret": c.id, "stage": stage}).Info("connected with rotated credential")
+			return
+		}
+		if !IsAccessDenied(err) {
+			return
+		}
+	}
+	return
+}
+
+func (c *DBConnector) current() *mysql.Config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.config
+}
+
+// credential builds the config of a version of the secret, keeping the
+// settings of the DSN it doesn't hold.
+func (c *DBConnector) credential(stage string) (config *mysql.Config, err error) {
+	secret, err := GetSecretStage(c.provider, c.id, stage)
+	if err != nil {
+		return
+	}
+	DefaultRedactor.AddSecret(secret.Value)
+	credential := DBCredential{}
+	err = json.Unmarshal([]byte(secret.Value), &credential)
+	if err != nil {
+		return
+	}
+	config = c.config.Clone()
+	config.User = credential.Username
+	config.Passwd = credential.Password
+	if credential.Host != "" {
+		config.Addr = credential.Address()
+	}
+	if credential.DBDefault != "" {
+		config.DBName = credential.DBDefault
+	}
+	return
+}
+
+func connect(ctx context.Context, config *mysql.Config) (driver.Conn, error) {
+	connector, err := mysql.NewConnector(config)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+// IsAccessDenied tells whether MySQL refused the credential.
+func IsAccessDenied(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == errAccessDenied
+}
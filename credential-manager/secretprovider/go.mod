@@ -0,0 +1,12 @@
+module secretprovider
+
+go 1.16
+
+require (
+	github.com/aws/aws-sdk-go v1.40.49
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/mitchellh/mapstructure v1.4.2
+	github.com/sirupsen/logrus v1.8.1
+	github.com/spf13/viper v1.9.0
+	gopkg.in/yaml.v3 v3.0.1
+)
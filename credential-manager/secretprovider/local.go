@@ -0,0 +1,94 @@
+package secretprovider
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Env reads a secret from the environment variable named after its id in
+// upper case, every other character than a letter or digit becoming an
+// underscore: dev/db-test is DEV_DB_TEST, or APP_DEV_DB_TEST with prefix
+// APP_.
+type Env struct {
+	Prefix string
+}
+
+func (e Env) Name() string { return "env" }
+
+func (e Env) GetSecret(id string) (secret Secret, err error) {
+	value, ok := os.LookupEnv(e.variable(id))
+	if !ok {
+		return secret, ErrNotFound
+	}
+	return Secret{Value: value, Version: contentVersion(value)}, nil
+}
+
+func (e Env) variable(id string) string {
+	name := []rune(strings.ToUpper(id))
+	for i, r := range name {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			name[i] = '_'
+		}
+	}
+	return e.Prefix + string(name)
+}
+
+// File reads a secret from the file at its id, relative to Dir, the way
+// Docker and Kubernetes mount secrets. A trailing newline is dropped.
+type File struct {
+	Dir string
+}
+
+func (f File) Name() string { return "file" }
+
+func (f File) GetSecret(id string) (secret Secret, err error) {
+	path, err := f.path(id)
+	if err != nil {
+		return
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return secret, ErrNotFound
+	}
+	if err != nil {
+		return
+	}
+	value := strings.TrimSuffix(string(content), "\n")
+	return Secret{Value: value, Version: contentVersion(value)}, nil
+}
+
+// PutSecret writes the file readable by its owner only.
+func (f File) PutSecret(id, value string) (secret Secret, err error) {
+	path, err := f.path(id)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(path, []byte(value+"\n"), 0600)
+	if err != nil {
+		return
+	}
+	return Secret{Value: value, Version: contentVersion(value)}, nil
+}
+
+// path keeps relative ids inside Dir.
+func (f File) path(id string) (path string, err error) {
+	if filepath.IsAbs(id) {
+		return filepath.Clean(id), nil
+	}
+	dir := f.Dir
+	if dir == "" {
+		dir = "."
+	}
+	path = filepath.Join(dir, filepath.FromSlash(id))
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path is outside %s", dir)
+	}
+	return
+}
@@ -0,0 +1,255 @@
+package secretprovider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// dbCredentialKeys are the settings moved into the db-credential secret,
+// by the field of DBCredential holding them.
+var dbCredentialKeys = []struct{ key, field string }{
+	{"DB-USER", "username"},
+	{"DB-PASSWORD", "password"},
+	{"DB-HOST", "host"},
+	{"DB-PORT", "port"},
+	{"DB-DEFAULT", "db-default"},
+}
+
+type migratedSecret struct {
+	id    string
+	value interface{}
+}
+
+// MigrateSecretsFile moves the database credential and the weather API key
+// of a config file into secrets shaped like DBCredential and Weather,
+// stored under the db-credential and weather-credential settings of v by
+// its migrate-provider, and replaces the values with references to them.
+// An encrypted config stays encrypted. With dry-run the secrets aren't
+// stored and the change to the config is written to out, secret values
+// masked.
+func MigrateSecretsFile(v *viper.Viper, path string, out io.Writer) (err error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	doc, meta, err := parseConfig(source)
+	if err != nil {
+		return
+	}
+	var dataKey []byte
+	if meta != nil {
+		dataKey, err = unwrapDataKey(meta, path)
+		if err != nil {
+			return
+		}
+		err = walkConfig(doc, "", func(node *yaml.Node, path string) error {
+			return decryptValue(node, path, dataKey)
+		})
+		if err != nil {
+			return
+		}
+	}
+	before, err := encodeConfig(doc)
+	if err != nil {
+		return
+	}
+
+	provider := v.GetString("migrate-provider")
+	root := doc.Content[0]
+	var secrets []migratedSecret
+	if password := configValue(root, "DB-PASSWORD"); password != nil && !IsReference(password.Value) {
+		id := v.GetString("db-credential")
+		if id == "" {
+			return errors.New("db-credential is required to migrate DB-PASSWORD")
+		}
+		credential, errMigrate := migrateDBCredential(root, provider+"://"+id)
+		if errMigrate != nil {
+			return errMigrate
+		}
+		DefaultRedactor.Add(credential.Password)
+		secrets = append(secrets, migratedSecret{id, credential})
+	}
+	if api := configValue(root, "WEATHER-API"); api != nil && !IsReference(api.Value) {
+		id := v.GetString("weather-credential")
+		if id == "" {
+			return errors.New("weather-credential is required to migrate WEATHER-API")
+		}
+		DefaultRedactor.Add(api.Value)
+		secrets = append(secrets, migratedSecret{id, Weather{Api: api.Value}})
+		setReference(api, provider+"://"+id+"#api")
+	}
+	if len(secrets) == 0 {
+		log.Info("no plaintext secrets to migrate")
+		return
+	}
+
+	after, err := encodeConfig(doc)
+	if err != nil {
+		return
+	}
+	if v.GetBool("dry-run") {
+		for _, secret := range secrets {
+			log.WithFields(log.Fields{"secret": secret.id, "provider": provider}).Info("would store secret")
+		}
+		_, err = io.WriteString(out, diffConfig(path, before, after))
+		return
+	}
+
+	writer, err := NewWriter(v, provider)
+	if err != nil {
+		return
+	}
+	for _, secret := range secrets {
+		value, errMarshal := json.Marshal(secret.value)
+		if errMarshal != nil {
+			return errMarshal
+		}
+		stored, errPut := writer.PutSecret(secret.id, string(value))
+		if errPut != nil {
+			return errPut
+		}
+		log.WithFields(log.Fields{
+			"secret":   secret.id,
+			"provider": provider,
+			"version":  stored.Version,
+		}).Info("secret stored")
+	}
+
+	if meta != nil {
+		return writeEncryptedConfig(path, doc, meta, dataKey)
+	}
+	return writeFileKeepMode(path, after)
+}
+
+// migrateDBCredential builds the DBCredential of the DB-* settings and
+// points them at its fields, DB-PORT being split off DB-HOST when it
+// carries the port.
+func migrateDBCredential(root *yaml.Node, reference string) (credential DBCredential, err error) {
+	values := map[string]string{}
+	for _, k := range dbCredentialKeys {
+		node := configValue(root, k.key)
+		if node == nil {
+			continue
+		}
+		if IsReference(node.Value) {
+			return credential, fmt.Errorf("%s is already a secret reference, migrate the DB-* settings together", k.key)
+		}
+		values[k.field] = node.Value
+	}
+
+	credential = DBCredential{
+		Username:  values["username"],
+		Password:  values["password"],
+		Host:      values["host"],
+		DBDefault: values["db-default"],
+	}
+	port := values["port"]
+	if port == "" {
+		if host, hostPort, errSplit := net.SplitHostPort(credential.Host); errSplit == nil {
+			credential.Host, port = host, hostPort
+		}
+	}
+	if port != "" {
+		credential.Port, err = strconv.Atoi(port)
+		if err != nil {
+			return credential, fmt.Errorf("DB-PORT %q is not a number", port)
+		}
+	}
+
+	for _, k := range dbCredentialKeys {
+		node := configValue(root, k.key)
+		if node == nil && k.key == "DB-PORT" && credential.Port != 0 {
+			node = insertAfter(root, "DB-HOST", k.key)
+		}
+		if node != nil {
+			setReference(node, reference+"#"+k.field)
+		}
+	}
+	return
+}
+
+// configValue returns the value of a top level key, matched regardless of
+// case like viper does.
+func configValue(root *yaml.Node, key string) *yaml.Node {
+	for i := 0; i < len(root.Content); i += 2 {
+		if strings.EqualFold(root.Content[i].Value, key) {
+			return root.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// insertAfter adds a top level key after another one, or at the end.
+func insertAfter(root *yaml.Node, after, key string) *yaml.Node {
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Value: key}
+	valueNode := &yaml.Node{Kind: yaml.ScalarNode}
+	i := len(root.Content)
+	for j := 0; j < len(root.Content); j += 2 {
+		if strings.EqualFold(root.Content[j].Value, after) {
+			i = j + 2
+		}
+	}
+	content := append([]*yaml.Node{}, root.Content[:i]...)
+	content = append(content, keyNode, valueNode)
+	root.Content = append(content, root.Content[i:]...)
+	return valueNode
+}
+
+func setReference(node *yaml.Node, reference string) {
+	node.Value = reference
+	node.Tag = "!!str"
+	node.Style = 0
+}
+
+// diffConfig prints the lines removed from and added to the config, the
+// secrets in them masked.
+func diffConfig(path string, before, after []byte) string {
+	a := strings.Split(strings.TrimSuffix(string(before), "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(string(after), "\n"), "\n")
+
+	// longest common subsequence of the lines, from the end
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", path, path)
+	redact := DefaultRedactor.Redact
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			out.WriteString(" " + redact(a[i]) + "\n")
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || common[i+1][j] >= common[i][j+1]):
+			out.WriteString("-" + redact(a[i]) + "\n")
+			i++
+		default:
+			out.WriteString("+" + redact(b[j]) + "\n")
+			j++
+		}
+	}
+	return out.String()
+}
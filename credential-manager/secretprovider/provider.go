@@ -0,0 +1,195 @@
+// Package secretprovider reads secrets by id from the environment, files,
+// Secrets Manager, SSM Parameter Store or Vault KV behind one interface.
+// Providers are chained by priority, the first one holding a secret wins:
+//
+//	providers, err := secretprovider.FromViper(viper.GetViper(), "env", "secretsmanager")
+//	db := secretprovider.DBCredential{}
+//	_, err = secretprovider.Decode(providers, "dev/db-test", &db)
+//
+// Structured secrets such as dbCredential are JSON objects in every
+// provider, the way Secrets Manager stores them. The secrets read are kept
+// out of the logs once InstallRedactor hooks DefaultRedactor into logrus.
+package secretprovider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ErrNotFound is returned when a provider doesn't hold a secret, the chain
+// then asks the next provider.
+var ErrNotFound = errors.New("secret not found")
+
+// Secret is the value of a secret and the version it was read at.
+type Secret struct {
+	ID       string
+	Value    string
+	Version  string
+	Provider string
+}
+
+// SecretProvider reads a secret by id, the id being a secret name, a
+// parameter name, a file path or a KV path depending on the provider.
+type SecretProvider interface {
+	Name() string
+	GetSecret(id string) (Secret, error)
+}
+
+// StageProvider reads other versions of a secret than the current one, by
+// the version stage labels of Secrets Manager such as AWSPENDING.
+type StageProvider interface {
+	GetSecretStage(id, stage string) (Secret, error)
+}
+
+// SecretWriter stores a secret under its id, creating it or making the
+// value its new current version.
+type SecretWriter interface {
+	PutSecret(id, value string) (Secret, error)
+}
+
+// GetSecretStage reads a secret at a version stage. Providers without
+// stages only have AWSCURRENT.
+func GetSecretStage(p SecretProvider, id, stage string) (Secret, error) {
+	if sp, ok := p.(StageProvider); ok {
+		return sp.GetSecretStage(id, stage)
+	}
+	if stage != "" && stage != "AWSCURRENT" {
+		return Secret{}, ErrNotFound
+	}
+	return p.GetSecret(id)
+}
+
+// Chain asks its providers in order. Only ErrNotFound moves on to the next
+// provider, any other error stops the lookup so a failing Secrets Manager
+// doesn't silently fall back to an older copy elsewhere.
+type Chain []SecretProvider
+
+func (c Chain) Name() string {
+	names := make([]string, len(c))
+	for i, p := range c {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (c Chain) GetSecret(id string) (secret Secret, err error) {
+	return c.GetSecretStage(id, "")
+}
+
+func (c Chain) GetSecretStage(id, stage string) (secret Secret, err error) {
+	if id == "" {
+		return secret, errors.New("secret id is required")
+	}
+	for _, p := range c {
+		secret, err = GetSecretStage(p, id, stage)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return secret, fmt.Errorf("%s %s: %w", p.Name(), id, err)
+		}
+		secret.ID = id
+		secret.Provider = p.Name()
+		return
+	}
+	return Secret{}, fmt.Errorf("%w: %s in %s", ErrNotFound, id, c.Name())
+}
+
+// Decode reads a JSON secret into v.
+func Decode(p SecretProvider, id string, v interface{}) (secret Secret, err error) {
+	secret, err = p.GetSecret(id)
+	if err != nil {
+		return
+	}
+	DefaultRedactor.AddSecret(secret.Value)
+	err = json.Unmarshal([]byte(secret.Value), v)
+	if err != nil {
+		err = fmt.Errorf("secret %s: %w", id, err)
+	}
+	return
+}
+
+// FromViper builds the chain named by SECRET-PROVIDERS, or by defaults when
+// it isn't set:
+//
+//	SECRET-PROVIDERS: env,file,secretsmanager
+//	SECRET-ENV-PREFIX: APP_
+//	SECRETS-DIR: /run/secrets
+//	REGION: ap-southeast-1
+//	SECRETSMANAGER-ENDPOINT: http://127.0.0.1:4566
+//	VERSION-STAGE: AWSCURRENT
+//	VAULT:
+//	  ADDRESS: http://127.0.0.1:8200
+//	  KV-MOUNT: secret
+func FromViper(v *viper.Viper, defaults ...string) (chain Chain, err error) {
+	names := v.GetStringSlice("SECRET-PROVIDERS")
+	if len(names) == 1 {
+		names = strings.Split(names[0], ",")
+	}
+	if len(names) == 0 {
+		names = defaults
+	}
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		p, errProvider := newProvider(v, name)
+		if errProvider != nil {
+			return nil, errProvider
+		}
+		chain = append(chain, p)
+	}
+	if len(chain) == 0 {
+		err = errors.New("no secret providers configured")
+	}
+	return
+}
+
+func newProvider(v *viper.Viper, name string) (p SecretProvider, err error) {
+	switch name {
+	case "env":
+		p = Env{Prefix: v.GetString("SECRET-ENV-PREFIX")}
+	case "file":
+		p = File{Dir: v.GetString("SECRETS-DIR")}
+	case "secretsmanager":
+		sm := NewSecretsManager(v.GetString("REGION"), v.GetString("SECRETSMANAGER-ENDPOINT"))
+		sm.VersionStage = v.GetString("VERSION-STAGE")
+		p = sm
+	case "ssm":
+		p = NewSSM(v.GetString("REGION"), v.GetString("SSM-ENDPOINT"))
+	case "vault":
+		p = NewVaultKV(v.GetString("VAULT.ADDRESS"), v.GetString("VAULT.KV-MOUNT"),
+			v.GetString("VAULT.TOKEN"), v.GetString("VAULT.NAMESPACE"))
+	default:
+		err = fmt.Errorf("unknown secret provider %q", name)
+	}
+	return
+}
+
+// NewWriter builds the provider name the way SECRET-PROVIDERS does, for
+// storing secrets. Secrets Manager, Vault and files can store them.
+func NewWriter(v *viper.Viper, name string) (w SecretWriter, err error) {
+	p, err := newProvider(v, name)
+	if err != nil {
+		return
+	}
+	w, ok := p.(SecretWriter)
+	if !ok {
+		return nil, fmt.Errorf("secret provider %s can't store secrets", name)
+	}
+	return
+}
+
+// contentVersion versions secrets whose provider has no version of its
+// own, so a changed value still shows as a new version. It is the keyed
+// fingerprint of the logs, versions are logged and a plain hash of the
+// value could be matched against guessed secrets.
+func contentVersion(value string) string {
+	return DefaultRedactor.fingerprint(value)
+}
@@ -0,0 +1,193 @@
+package secretprovider
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// publicFields of JSON secrets are not masked, the user and host of a
+// dbCredential are what the tools log to show where they connect.
+var publicFields = map[string]bool{
+	"username": true, "host": true, "port": true, "db-default": true, "dbname": true, "engine": true,
+}
+
+var (
+	// sensitiveField names log fields masked whatever their value.
+	sensitiveField = regexp.MustCompile(`(?i)(password|passwd|api-?key)`)
+
+	// dsnPassword is the password of user:password@tcp(host)/db DSNs and
+	// of URLs, queryPassword those of query strings, appid being the key
+	// of the OpenWeather API.
+	dsnPassword   = regexp.MustCompile(`([\w.%+-]+):([^\s@/:"']+)@`)
+	queryPassword = regexp.MustCompile(`(?i)\b(password|passwd|pwd|api[-_]?key|appid)=([^&\s"']+)`)
+)
+
+// Redactor is a logrus hook masking the values of secrets, and passwords
+// in DSNs and URLs, in the messages and fields of log entries. Every
+// secret read through this package is added to DefaultRedactor.
+type Redactor struct {
+	// Fingerprints logs an HMAC of each secret in place of [redacted], to
+	// tell which version of a secret was in use without showing it. The
+	// key is random for every process, so fingerprints only compare
+	// within one run and can't be matched against guessed passwords.
+	Fingerprints bool
+
+	mu             sync.RWMutex
+	values         map[string]bool
+	ordered        []string
+	install        sync.Once
+	fingerprintKey []byte
+}
+
+var DefaultRedactor = NewRedactor()
+
+// NewRedactor returns a Redactor with a fingerprint key of its own.
+func NewRedactor() *Redactor {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+	return &Redactor{values: map[string]bool{}, fingerprintKey: key}
+}
+
+// InstallRedactor hooks DefaultRedactor into the standard logger, with
+// fingerprints when LOG-SECRET-FINGERPRINTS is set.
+func InstallRedactor(v *viper.Viper) *Redactor {
+	r := DefaultRedactor
+	r.install.Do(func() {
+		r.Fingerprints = v.GetBool("LOG-SECRET-FINGERPRINTS")
+		log.AddHook(r)
+		if r.Fingerprints {
+			log.Warn("logging fingerprints of secrets instead of masking them")
+		}
+	})
+	return r
+}
+
+// Add masks values from now on, whatever their length: a short secret
+// also masks the same letters in other words, rather than showing up.
+func (r *Redactor) Add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, value := range values {
+		if value == "" || r.values[value] {
+			continue
+		}
+		r.values[value] = true
+		r.ordered = append(r.ordered, value)
+	}
+	// longest first, so a secret containing another is masked whole
+	sort.SliceStable(r.ordered, func(i, j int) bool {
+		return len(r.ordered[i]) > len(r.ordered[j])
+	})
+}
+
+// AddSecret masks the value of a secret and, when it is a JSON object, the
+// values of its fields other than publicFields.
+func (r *Redactor) AddSecret(value string) {
+	r.Add(value)
+	fields := map[string]interface{}{}
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+	if dec.Decode(&fields) != nil {
+		return
+	}
+	for field, v := range fields {
+		if publicFields[field] {
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			r.Add(v)
+		case json.Number:
+			r.Add(v.String())
+		}
+	}
+}
+
+// Redact masks the secrets in text.
+func (r *Redactor) Redact(text string) string {
+	r.mu.RLock()
+	for _, value := range r.ordered {
+		if strings.Contains(text, value) {
+			text = strings.ReplaceAll(text, value, r.mask(value))
+		}
+	}
+	r.mu.RUnlock()
+	text = r.maskGroup(dsnPassword, text)
+	return r.maskGroup(queryPassword, text)
+}
+
+func (r *Redactor) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (r *Redactor) Fire(entry *log.Entry) error {
+	entry.Message = r.Redact(entry.Message)
+	for key, value := range entry.Data {
+		var text string
+		switch value := value.(type) {
+		case string:
+			text = value
+		case []byte:
+			text = string(value)
+		case error:
+			text = value.Error()
+		case fmt.Stringer:
+			text = value.String()
+		default:
+			continue
+		}
+		if sensitiveField.MatchString(key) {
+			entry.Data[key] = r.mask(text)
+		} else if redacted := r.Redact(text); redacted != text {
+			entry.Data[key] = redacted
+		}
+	}
+	return nil
+}
+
+func (r *Redactor) mask(value string) string {
+	if r.Fingerprints {
+		return "[redacted hmac:" + r.fingerprint(value) + "]"
+	}
+	return "[redacted]"
+}
+
+// fingerprint is the keyed HMAC of a value, comparable within one process
+// only.
+func (r *Redactor) fingerprint(value string) string {
+	mac := hmac.New(sha256.New, r.fingerprintKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// maskGroup masks the second group of every match of re, leaving what
+// is already masked.
+func (r *Redactor) maskGroup(re *regexp.Regexp, text string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(text, -1) {
+		start, end := m[4], m[5]
+		if strings.HasPrefix(text[start:], "[redacted") || strings.HasSuffix(text[:m[2]], "[redacted ") {
+			continue
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(r.mask(text[start:end]))
+		last = end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
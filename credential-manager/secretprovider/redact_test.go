@@ -0,0 +1,54 @@
+package secretprovider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestRedactShortSecrets(t *testing.T) {
+	r := NewRedactor()
+	r.Add("", "pw", "longer-password")
+	for text, want := range map[string]string{
+		"connecting with pw":               "connecting with [redacted]",
+		"connecting with longer-password":  "connecting with [redacted]",
+		"root:pw@tcp(127.0.0.1:3306)/test": "root:[redacted]@tcp(127.0.0.1:3306)/test",
+		"nothing secret":                   "nothing secret",
+	} {
+		if got := r.Redact(text); got != want {
+			t.Errorf("Redact(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestFingerprintsAreKeyed(t *testing.T) {
+	r := NewRedactor()
+	r.Fingerprints = true
+	r.Add("pw")
+	first := r.Redact("pw")
+	if first != r.Redact("pw") {
+		t.Error("fingerprint changed within one redactor")
+	}
+	sum := sha256.Sum256([]byte("pw"))
+	if strings.Contains(first, hex.EncodeToString(sum[:8])) {
+		t.Errorf("fingerprint %s is the plain sha256 of the secret", first)
+	}
+	other := NewRedactor()
+	other.Fingerprints = true
+	other.Add("pw")
+	if other.Redact("pw") == first {
+		t.Error("two redactors share a fingerprint key")
+	}
+}
+
+func TestContentVersionIsKeyed(t *testing.T) {
+	version := contentVersion("pw")
+	if version != contentVersion("pw") || version == contentVersion("pw2") {
+		t.Error("content version doesn't follow the value")
+	}
+	sum := sha256.Sum256([]byte("pw"))
+	if version == hex.EncodeToString(sum[:8]) {
+		t.Errorf("content version %s is the plain sha256 of the secret", version)
+	}
+}
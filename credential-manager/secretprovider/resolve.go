@@ -0,0 +1,258 @@
+package secretprovider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+// A secret reference is a config value naming a secret, and optionally a
+// field of its JSON object, resolved when the config is loaded:
+//
+//	DB-PASSWORD: secretsmanager://dev/db-test#password
+//	WEATHER-API: ssm:///app/weather/api
+//	DB-PASSWORD: file:///run/secrets/db
+//	DB-PORT: secret://dev/db-test#port?
+//
+// secret:// reads through the SECRET-PROVIDERS chain, the other schemes
+// name a single provider. A field ending in ? is optional and resolves to
+// an empty value when the secret doesn't have it.
+var schemes = []string{"secret", "env", "file", "secretsmanager", "ssm", "vault"}
+
+// providerSettings are resolved before any other key, a reference to the
+// Vault token has to be resolved before Vault is asked for secrets.
+var providerSettings = map[string]bool{
+	"secret-providers": true, "secret-env-prefix": true, "secrets-dir": true,
+	"region": true, "secretsmanager-endpoint": true, "version-stage": true, "ssm-endpoint": true,
+	"vault.address": true, "vault.kv-mount": true, "vault.token": true, "vault.namespace": true,
+}
+
+// IsReference reports whether a value is a secret reference.
+func IsReference(value string) bool {
+	for _, scheme := range schemes {
+		if strings.HasPrefix(value, scheme+"://") {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver resolves the secret references of a viper config, reading every
+// secret once however many fields of it are referenced.
+type Resolver struct {
+	// Skip holds key prefixes left as they are, such as the profiles that
+	// aren't in use.
+	Skip []string
+
+	// TTL caches the secrets and refreshes them in the background when it
+	// isn't zero. Resolve can then be called again whenever credentials
+	// are needed and picks up rotated secrets from the cache.
+	TTL time.Duration
+
+	v          *viper.Viper
+	defaults   []string
+	providers  map[string]SecretProvider
+	secrets    map[string]Secret
+	errors     []string
+	references map[string]interface{}
+	caches     []*Cache
+	onChange   []func(previous, current Secret)
+}
+
+// NewResolver reads secret:// references through SECRET-PROVIDERS, or
+// through the defaults when it isn't set.
+func NewResolver(v *viper.Viper, defaults ...string) *Resolver {
+	return &Resolver{
+		v:          v,
+		defaults:   defaults,
+		providers:  map[string]SecretProvider{},
+		references: map[string]interface{}{},
+	}
+}
+
+// OnChange calls fn when a cached secret is refreshed to a new version.
+func (r *Resolver) OnChange(fn func(previous, current Secret)) {
+	r.onChange = append(r.onChange, fn)
+	for _, c := range r.caches {
+		c.OnChange(fn)
+	}
+}
+
+// Close stops refreshing the cached secrets.
+func (r *Resolver) Close() {
+	for _, c := range r.caches {
+		c.Stop()
+	}
+}
+
+// DecodeHook resolves secret references in the string values viper
+// decodes. A reference that can't be resolved is left as it is and
+// reported by Resolve.
+func (r *Resolver) DecodeHook() mapstructure.DecodeHookFuncType {
+	return func(from, to reflect.Type, data interface{}) (interface{}, error) {
+		reference, ok := data.(string)
+		if !ok || !IsReference(reference) {
+			return data, nil
+		}
+		value, err := r.resolve(reference)
+		if err != nil {
+			r.errors = append(r.errors, fmt.Sprintf("%s: %v", reference, err))
+			return data, nil
+		}
+		return value, nil
+	}
+}
+
+// Resolve replaces every secret reference in the settings with its value.
+// All of them are tried before failing, so the error lists every key that
+// couldn't be resolved. The references are remembered, resolving again
+// updates the settings to the current secrets.
+func (r *Resolver) Resolve() error {
+	r.secrets = map[string]Secret{}
+	var missing []string
+	keys := r.v.AllKeys()
+	sort.SliceStable(keys, func(i, j int) bool {
+		return providerSettings[keys[i]] && !providerSettings[keys[j]]
+	})
+	for _, key := range keys {
+		if r.skipped(key) {
+			continue
+		}
+		raw, ok := r.references[key]
+		if !ok {
+			raw = r.v.Get(key)
+		}
+		var value interface{}
+		r.errors = nil
+		err := r.decode(raw, &value)
+		if err != nil {
+			return err
+		}
+		for _, failure := range r.errors {
+			missing = append(missing, strings.ToUpper(key)+": "+failure)
+		}
+		if len(r.errors) > 0 || reflect.DeepEqual(raw, value) {
+			continue
+		}
+		r.references[key] = raw
+		if !reflect.DeepEqual(r.v.Get(key), value) {
+			r.v.Set(key, value)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("unresolved secret references: %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+// decode runs a setting through DecodeHook the way viper.Unmarshal does.
+func (r *Resolver) decode(raw interface{}, value *interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: r.DecodeHook(),
+		Result:     value,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(raw)
+}
+
+func (r *Resolver) skipped(key string) bool {
+	for _, prefix := range r.Skip {
+		if strings.HasPrefix(key, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Resolver) resolve(reference string) (value string, err error) {
+	i := strings.Index(reference, "://")
+	scheme, id := reference[:i], reference[i+3:]
+	field := ""
+	if j := strings.LastIndex(id, "#"); j >= 0 {
+		id, field = id[:j], id[j+1:]
+	}
+
+	secret, ok := r.secrets[scheme+"://"+id]
+	if !ok {
+		p, errProvider := r.Provider(scheme)
+		if errProvider != nil {
+			return "", errProvider
+		}
+		secret, err = p.GetSecret(id)
+		if err != nil {
+			return
+		}
+		DefaultRedactor.AddSecret(secret.Value)
+		r.secrets[scheme+"://"+id] = secret
+	}
+	if field == "" {
+		return secret.Value, nil
+	}
+	return jsonField(secret.Value, field)
+}
+
+// Provider returns the provider of a reference scheme, the SECRET-PROVIDERS
+// chain for secret, cached like the references when TTL is set.
+func (r *Resolver) Provider(scheme string) (p SecretProvider, err error) {
+	if p, ok := r.providers[scheme]; ok {
+		return p, nil
+	}
+	if scheme == "secret" {
+		p, err = FromViper(r.v, r.defaults...)
+	} else {
+		p, err = newProvider(r.v, scheme)
+	}
+	if err != nil {
+		return
+	}
+	if r.TTL > 0 {
+		cache := NewCache(p, r.TTL)
+		for _, fn := range r.onChange {
+			cache.OnChange(fn)
+		}
+		cache.Start()
+		r.caches = append(r.caches, cache)
+		p = cache
+	}
+	r.providers[scheme] = p
+	return
+}
+
+// jsonField returns a field of a JSON object as text, numbers as written.
+func jsonField(object, field string) (value string, err error) {
+	optional := strings.HasSuffix(field, "?")
+	field = strings.TrimSuffix(field, "?")
+
+	fields := map[string]interface{}{}
+	dec := json.NewDecoder(strings.NewReader(object))
+	dec.UseNumber()
+	err = dec.Decode(&fields)
+	if err != nil {
+		return "", errors.New("secret is not a JSON object")
+	}
+	v, ok := fields[field]
+	if !ok || v == nil {
+		if optional {
+			return "", nil
+		}
+		return "", fmt.Errorf("secret has no field %s", field)
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	}
+	encoded, err := json.Marshal(v)
+	return string(encoded), err
+}
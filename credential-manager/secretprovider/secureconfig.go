@@ -0,0 +1,538 @@
+package secretprovider
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// metadataKey is the top level key holding the wrapped data key of an
+// encrypted config file. Every other scalar value in the file is encrypted.
+const metadataKey = "ENCRYPTION"
+
+const encryptedPrefix = "ENC[AES256_GCM,"
+
+type configMetadata struct {
+	DataKey string `yaml:"DATAKEY"`
+	KMSKey  string `yaml:"KMS-KEY,omitempty"`
+	Region  string `yaml:"REGION,omitempty"`
+	KeyFile string `yaml:"KEY-FILE,omitempty"`
+}
+
+// IsConfigMode tells whether mode is one of the modes RunConfigMode runs
+// on the config file rather than with it.
+func IsConfigMode(mode string) bool {
+	return mode == "encrypt-config" || mode == "decrypt-config" || mode == "edit-config" || mode == "migrate-secrets"
+}
+
+// RunConfigMode runs a config mode on the config file of v, with the
+// settings of its flags: kms-key, region and key-file for encrypt-config,
+// those of MigrateSecretsFile for migrate-secrets.
+func RunConfigMode(v *viper.Viper, mode string) (err error) {
+	path := v.ConfigFileUsed()
+	log.WithField("status", "starting").Info(mode)
+	switch mode {
+	case "encrypt-config":
+		err = EncryptConfigFile(path, v.GetString("kms-key"), v.GetString("region"), v.GetString("key-file"))
+	case "decrypt-config":
+		err = DecryptConfigFile(path)
+	case "edit-config":
+		changed := false
+		changed, err = EditConfigFile(path)
+		if err == nil && !changed {
+			log.Info("config unchanged")
+			return
+		}
+	case "migrate-secrets":
+		err = MigrateSecretsFile(v, path, os.Stdout)
+	default:
+		err = fmt.Errorf("unknown config mode %s", mode)
+	}
+	if err != nil {
+		return
+	}
+	log.WithField("status", "success").Info(mode)
+	return
+}
+
+// LoadSecureConfig replaces the values v has read with their plaintext
+// when the config file was encrypted with EncryptConfigFile.
+func LoadSecureConfig(v *viper.Viper) (err error) {
+	path := v.ConfigFileUsed()
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	doc, meta, err := parseConfig(source)
+	if err != nil || meta == nil {
+		return
+	}
+
+	dataKey, err := unwrapDataKey(meta, path)
+	if err != nil {
+		return
+	}
+	err = walkConfig(doc, "", func(node *yaml.Node, path string) error {
+		return decryptValue(node, path, dataKey)
+	})
+	if err != nil {
+		return
+	}
+
+	plain, err := encodeConfig(doc)
+	if err != nil {
+		return
+	}
+	err = v.ReadConfig(bytes.NewReader(plain))
+	if err != nil {
+		return
+	}
+	log.WithField("status", "success").Debug("LoadSecureConfig")
+	return
+}
+
+// EncryptConfigFile encrypts every value of a config file with a new data
+// key, wrapped by the KMS key kmsKey or else by the 32 byte key in keyFile,
+// relative to the config file.
+func EncryptConfigFile(path, kmsKey, region, keyFile string) (err error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	doc, meta, err := parseConfig(source)
+	if err != nil {
+		return
+	}
+	if meta != nil {
+		return errors.New("config is already encrypted")
+	}
+
+	meta = &configMetadata{
+		KMSKey:  kmsKey,
+		Region:  region,
+		KeyFile: keyFile,
+	}
+	dataKey, err := generateDataKey(meta, path)
+	if err != nil {
+		return
+	}
+	return writeEncryptedConfig(path, doc, meta, dataKey)
+}
+
+func DecryptConfigFile(path string) (err error) {
+	doc, _, err := readDecryptedConfig(path)
+	if err != nil {
+		return
+	}
+
+	plain, err := encodeConfig(doc)
+	if err != nil {
+		return
+	}
+	return writeFileKeepMode(path, plain)
+}
+
+// EditConfigFile opens the decrypted config in $EDITOR and encrypts the
+// result again with the same data key, so the plaintext only lives in a
+// private temporary file for the duration of the edit. It returns its
+// errors rather than exiting, so that file is removed on every path.
+func EditConfigFile(path string) (changed bool, err error) {
+	doc, meta, err := readDecryptedConfig(path)
+	if err != nil {
+		return
+	}
+	dataKey, err := unwrapDataKey(meta, path)
+	if err != nil {
+		return
+	}
+
+	plain, err := encodeConfig(doc)
+	if err != nil {
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(plain)
+	errClose := tmp.Close()
+	if err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command(editor, tmp.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return
+	}
+
+	edited, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return
+	}
+	if bytes.Equal(edited, plain) {
+		return false, nil
+	}
+	doc, editedMeta, err := parseConfig(edited)
+	if err != nil {
+		return
+	}
+	if editedMeta != nil {
+		return false, fmt.Errorf("%s section must not be edited", metadataKey)
+	}
+
+	err = writeEncryptedConfig(path, doc, meta, dataKey)
+	return err == nil, err
+}
+
+func readDecryptedConfig(path string) (doc *yaml.Node, meta *configMetadata, err error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	doc, meta, err = parseConfig(source)
+	if err != nil {
+		return
+	}
+	if meta == nil {
+		err = errors.New("config is not encrypted")
+		return
+	}
+
+	dataKey, err := unwrapDataKey(meta, path)
+	if err != nil {
+		return
+	}
+	err = walkConfig(doc, "", func(node *yaml.Node, path string) error {
+		return decryptValue(node, path, dataKey)
+	})
+	return
+}
+
+func writeEncryptedConfig(path string, doc *yaml.Node, meta *configMetadata, dataKey []byte) (err error) {
+	err = walkConfig(doc, "", func(node *yaml.Node, path string) error {
+		return encryptValue(node, path, dataKey)
+	})
+	if err != nil {
+		return
+	}
+
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Value: metadataKey}
+	metaNode := &yaml.Node{}
+	err = metaNode.Encode(meta)
+	if err != nil {
+		return
+	}
+	root := doc.Content[0]
+	root.Content = append(root.Content, keyNode, metaNode)
+
+	output, err := encodeConfig(doc)
+	if err != nil {
+		return
+	}
+	return writeFileKeepMode(path, output)
+}
+
+// parseConfig returns the document and, when present, the encryption
+// metadata removed from it.
+func parseConfig(source []byte) (doc *yaml.Node, meta *configMetadata, err error) {
+	doc = &yaml.Node{}
+	err = yaml.Unmarshal(source, doc)
+	if err != nil {
+		return
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		err = errors.New("config must be a yaml mapping")
+		return
+	}
+
+	root := doc.Content[0]
+	for i := 0; i < len(root.Content); i += 2 {
+		if root.Content[i].Value != metadataKey {
+			continue
+		}
+		meta = &configMetadata{}
+		err = root.Content[i+1].Decode(meta)
+		if err != nil {
+			return
+		}
+		root.Content = append(root.Content[:i], root.Content[i+2:]...)
+		break
+	}
+	return
+}
+
+func encodeConfig(doc *yaml.Node) (output []byte, err error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	err = enc.Encode(doc)
+	if err != nil {
+		return
+	}
+	err = enc.Close()
+	output = buf.Bytes()
+	return
+}
+
+// walkConfig calls fn for every scalar value with its dotted key path.
+func walkConfig(node *yaml.Node, path string, fn func(node *yaml.Node, path string) error) (err error) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			err = walkConfig(child, path, fn)
+			if err != nil {
+				return
+			}
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			err = walkConfig(child, fmt.Sprintf("%s[%d]", path, i), fn)
+			if err != nil {
+				return
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i < len(node.Content); i += 2 {
+			childPath := node.Content[i].Value
+			if path != "" {
+				childPath = path + "." + childPath
+			}
+			err = walkConfig(node.Content[i+1], childPath, fn)
+			if err != nil {
+				return
+			}
+		}
+	case yaml.ScalarNode:
+		err = fn(node, path)
+	}
+	return
+}
+
+// encryptValue seals a scalar with its key path as additional data, so an
+// encrypted value cannot be moved to another key.
+func encryptValue(node *yaml.Node, path string, dataKey []byte) (err error) {
+	if strings.HasPrefix(node.Value, encryptedPrefix) {
+		return
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return
+	}
+	sealed := gcm.Seal(nil, nonce, []byte(node.Value), []byte(path))
+	data, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	node.Value = fmt.Sprintf("%sdata:%s,iv:%s,tag:%s,type:%s]",
+		encryptedPrefix,
+		base64.StdEncoding.EncodeToString(data),
+		base64.StdEncoding.EncodeToString(nonce),
+		base64.StdEncoding.EncodeToString(tag),
+		strings.TrimPrefix(node.ShortTag(), "!!"))
+	node.Tag = "!!str"
+	node.Style = 0
+	return
+}
+
+func decryptValue(node *yaml.Node, path string, dataKey []byte) (err error) {
+	if !strings.HasPrefix(node.Value, encryptedPrefix) || !strings.HasSuffix(node.Value, "]") {
+		return fmt.Errorf("%s: value is not encrypted", path)
+	}
+	parts := map[string]string{}
+	for _, part := range strings.Split(node.Value[len(encryptedPrefix):len(node.Value)-1], ",") {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) == 2 {
+			parts[kv[0]] = kv[1]
+		}
+	}
+	data, errData := base64.StdEncoding.DecodeString(parts["data"])
+	nonce, errNonce := base64.StdEncoding.DecodeString(parts["iv"])
+	tag, errTag := base64.StdEncoding.DecodeString(parts["tag"])
+	if errData != nil || errNonce != nil || errTag != nil {
+		return fmt.Errorf("%s: malformed encrypted value", path)
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return fmt.Errorf("%s: malformed encrypted value", path)
+	}
+	plaintext, err := gcm.Open(nil, nonce, append(data, tag...), []byte(path))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	node.Value = string(plaintext)
+	node.Tag = "!!" + parts["type"]
+	return
+}
+
+// generateDataKey creates the data key of a config file, wrapped either by
+// a KMS key or by a local key file.
+func generateDataKey(meta *configMetadata, configPath string) (dataKey []byte, err error) {
+	if meta.KMSKey != "" {
+		svc := kms.New(session.New(),
+			aws.NewConfig().WithRegion(meta.Region))
+		result, errKMS := svc.GenerateDataKey(&kms.GenerateDataKeyInput{
+			KeyId:   aws.String(meta.KMSKey),
+			KeySpec: aws.String("AES_256"),
+		})
+		if errKMS != nil {
+			return nil, errKMS
+		}
+		meta.KeyFile = ""
+		meta.DataKey = base64.StdEncoding.EncodeToString(result.CiphertextBlob)
+		return result.Plaintext, nil
+	}
+
+	if meta.KeyFile == "" {
+		return nil, errors.New("either kms-key or key-file is required")
+	}
+	meta.Region = ""
+	wrappingKey, err := readKeyFile(configPath, meta.KeyFile)
+	if err != nil {
+		return
+	}
+	dataKey = make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return
+	}
+	gcm, err := newGCM(wrappingKey)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return
+	}
+	meta.DataKey = base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, dataKey, nil))
+	return
+}
+
+func unwrapDataKey(meta *configMetadata, configPath string) (dataKey []byte, err error) {
+	wrapped, err := base64.StdEncoding.DecodeString(meta.DataKey)
+	if err != nil {
+		return
+	}
+
+	if meta.KMSKey != "" {
+		svc := kms.New(session.New(),
+			aws.NewConfig().WithRegion(meta.Region))
+		result, errKMS := svc.Decrypt(&kms.DecryptInput{
+			CiphertextBlob: wrapped,
+			KeyId:          aws.String(meta.KMSKey),
+		})
+		if errKMS != nil {
+			return nil, errKMS
+		}
+		return result.Plaintext, nil
+	}
+
+	wrappingKey, err := readKeyFile(configPath, meta.KeyFile)
+	if err != nil {
+		return
+	}
+	gcm, err := newGCM(wrappingKey)
+	if err != nil {
+		return
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, errors.New("malformed data key")
+	}
+	return gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], nil)
+}
+
+// readKeyFile reads a 32 byte AES key, resolving relative paths against the
+// directory of the config file.
+func readKeyFile(configPath, path string) (key []byte, err error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(configPath), path)
+	}
+	key, err = os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if len(key) != 32 {
+		err = fmt.Errorf("key file %s must contain exactly 32 bytes", path)
+	}
+	return
+}
+
+func newGCM(key []byte) (gcm cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeFileKeepMode replaces a config through a temp file renamed over it,
+// a crash or a full disk leaves the old config whole. The config holds the
+// wrapped data key of every encrypted value, a truncated one loses them all.
+func writeFileKeepMode(path string, data []byte) (err error) {
+	// a symlinked config is replaced where it points to
+	if resolved, errLink := filepath.EvalSymlinks(path); errLink == nil {
+		path = resolved
+	}
+	perm := os.FileMode(0600)
+	info, err := os.Stat(path)
+	if err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	err = tmp.Chmod(perm)
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), path)
+}
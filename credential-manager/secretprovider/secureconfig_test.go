@@ -0,0 +1,172 @@
+package secretprovider
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const testConfig = `DB-USER: app
+DB-PASSWORD: a1
+DB-HOST: db.example.com:3306
+WEATHER-API: weather-key
+RETRIES: 3
+`
+
+// writeTestConfig writes config.yaml and the key file config.key next to
+// it, returning the path of the config.
+func writeTestConfig(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "config.key"), bytes.Repeat([]byte{1}, 32), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	err = os.WriteFile(path, []byte(testConfig), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEncryptConfigFileRoundTrip(t *testing.T) {
+	path := writeTestConfig(t)
+	err := EncryptConfigFile(path, "", "", "config.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(encrypted), "weather-key") || !strings.Contains(string(encrypted), metadataKey) {
+		t.Fatalf("config not encrypted:\n%s", encrypted)
+	}
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	err = v.ReadInConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = LoadSecureConfig(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.GetString("DB-PASSWORD") != "a1" || v.GetInt("RETRIES") != 3 {
+		t.Errorf("loaded DB-PASSWORD %q RETRIES %v", v.GetString("DB-PASSWORD"), v.Get("RETRIES"))
+	}
+
+	err = DecryptConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != testConfig {
+		t.Errorf("decrypted config\n%s\nwant\n%s", decrypted, testConfig)
+	}
+}
+
+func TestEditConfigFileRemovesPlaintext(t *testing.T) {
+	path := writeTestConfig(t)
+	err := EncryptConfigFile(path, "", "", "config.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := t.TempDir()
+	for key, value := range map[string]string{"TMPDIR": tmp, "EDITOR": "false"} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Setenv(key, value)
+	}
+
+	if _, err = EditConfigFile(path); err == nil {
+		t.Error("a failing editor didn't fail the edit")
+	}
+	left, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) > 0 {
+		t.Errorf("plaintext left in %s", left[0].Name())
+	}
+}
+
+func TestMigrateSecretsFileDryRun(t *testing.T) {
+	path := writeTestConfig(t)
+	v := viper.New()
+	v.Set("migrate-provider", "file")
+	v.Set("db-credential", "dev/db")
+	v.Set("weather-credential", "dev/weather")
+	v.Set("dry-run", true)
+
+	var out bytes.Buffer
+	err := MigrateSecretsFile(v, path, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := out.String()
+	for _, line := range []string{
+		"-DB-PASSWORD: [redacted]",
+		"+DB-PASSWORD: file://dev/db#password",
+		"+DB-HOST: file://dev/db#host",
+		"+DB-PORT: file://dev/db#port",
+		"+WEATHER-API: file://dev/weather#api",
+		" RETRIES: 3",
+	} {
+		if !strings.Contains(diff, line+"\n") {
+			t.Errorf("diff has no line %q:\n%s", line, diff)
+		}
+	}
+	if strings.Contains(diff, "a1") || strings.Contains(diff, "weather-key") {
+		t.Errorf("diff shows a secret:\n%s", diff)
+	}
+	unchanged, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(unchanged) != testConfig {
+		t.Error("dry run changed the config")
+	}
+}
+
+func TestWriteFileKeepModeReplaces(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(path, []byte("old"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "current.yaml")
+	err = os.Symlink("config.yaml", link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeFileKeepMode(link, []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil || string(content) != "new" {
+		t.Fatalf("read %q, %v", content, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("mode %v, %v", info.Mode(), err)
+	}
+	if target, err := os.Readlink(link); err != nil || target != "config.yaml" {
+		t.Errorf("symlink replaced: %q, %v", target, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("temp file left behind: %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,124 @@
+package secretprovider
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VaultKV reads secrets from a KV version 2 engine of Vault, the data of a
+// secret is returned as a JSON object. The token falls back to the
+// VAULT_TOKEN environment variable.
+type VaultKV struct {
+	address   string
+	mount     string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+func NewVaultKV(address, mount, token, namespace string) *VaultKV {
+	if mount == "" {
+		mount = "secret"
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	return &VaultKV{
+		address:   strings.TrimSuffix(address, "/"),
+		mount:     strings.Trim(mount, "/"),
+		token:     token,
+		namespace: namespace,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (v *VaultKV) Name() string { return "vault" }
+
+func (v *VaultKV) GetSecret(id string) (secret Secret, err error) {
+	resp, err := v.do(http.MethodGet, id, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return secret, ErrNotFound
+	}
+	var result struct {
+		Data struct {
+			Data     json.RawMessage `json:"data"`
+			Metadata struct {
+				Version int `json:"version"`
+			} `json:"metadata"`
+		} `json:"data"`
+		Errors []string `json:"errors"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK {
+		return secret, fmt.Errorf("%s %s", resp.Status, strings.Join(result.Errors, ", "))
+	}
+	if err != nil {
+		return
+	}
+	return Secret{
+		Value:   string(result.Data.Data),
+		Version: strconv.Itoa(result.Data.Metadata.Version),
+	}, nil
+}
+
+// PutSecret writes a new version of the secret, the value being a JSON
+// object like the data KV returns.
+func (v *VaultKV) PutSecret(id, value string) (secret Secret, err error) {
+	if !json.Valid([]byte(value)) || !strings.HasPrefix(strings.TrimSpace(value), "{") {
+		return secret, errors.New("a Vault KV secret must be a JSON object")
+	}
+	body, err := json.Marshal(map[string]json.RawMessage{"data": json.RawMessage(value)})
+	if err != nil {
+		return
+	}
+	resp, err := v.do(http.MethodPost, id, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Data struct {
+			Version int `json:"version"`
+		} `json:"data"`
+		Errors []string `json:"errors"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK {
+		return secret, fmt.Errorf("%s %s", resp.Status, strings.Join(result.Errors, ", "))
+	}
+	if err != nil {
+		return
+	}
+	return Secret{Value: value, Version: strconv.Itoa(result.Data.Version)}, nil
+}
+
+func (v *VaultKV) do(method, id string, body io.Reader) (resp *http.Response, err error) {
+	if v.address == "" {
+		return nil, errors.New("VAULT.ADDRESS is required")
+	}
+	req, err := http.NewRequest(method,
+		fmt.Sprintf("%s/v1/%s/data/%s", v.address, v.mount, strings.TrimPrefix(id, "/")), body)
+	if err != nil {
+		return
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return v.client.Do(req)
+}
@@ -0,0 +1,9 @@
+module secretsmanager-local
+
+go 1.16
+
+require (
+	github.com/sirupsen/logrus v1.8.1
+	github.com/spf13/pflag v1.0.5
+	github.com/spf13/viper v1.9.0
+)
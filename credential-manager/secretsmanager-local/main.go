@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"secretsmanager-local/smlocal"
+)
+
+func init() {
+	log.SetLevel(log.DebugLevel)
+	log.WithField("status", "starting").Debug("initialize")
+
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(".")
+
+	errConfig := viper.ReadInConfig()
+	if _, ok := errConfig.(viper.ConfigFileNotFoundError); errConfig != nil && !ok {
+		log.Fatalln(errConfig)
+	}
+
+	flag.String("listen", "127.0.0.1:4584", "address to listen on")
+	flag.String("store", "secrets.json", "file the secrets are kept in")
+	flag.String("region", "ap-southeast-1", "region of the secret ARNs")
+
+	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
+	pflag.Parse()
+	viper.BindPFlags(pflag.CommandLine)
+
+	log.WithField("status", "success").Debug("initialize")
+}
+
+func main() {
+	s, err := smlocal.OpenStore(viper.GetString("store"), viper.GetString("region"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.WithFields(log.Fields{
+		"listen": viper.GetString("listen"),
+		"store":  viper.GetString("store"),
+	}).Info("secrets manager stand-in")
+	err = http.ListenAndServe(viper.GetString("listen"), s)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,408 @@
+package smlocal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The AWS JSON 1.1 protocol: every call is a POST naming the operation in
+// X-Amz-Target, request signatures are not checked.
+type operation func(s *Store, body []byte) (result interface{}, changed bool, err error)
+
+var operations = map[string]operation{
+	"CreateSecret":             createSecret,
+	"GetSecretValue":           getSecretValue,
+	"PutSecretValue":           putSecretValue,
+	"UpdateSecretVersionStage": updateSecretVersionStage,
+	"ListSecrets":              listSecrets,
+	"DescribeSecret":           describeSecret,
+}
+
+type apiError struct {
+	Type    string
+	Message string
+}
+
+func (e apiError) Error() string { return e.Type + ": " + e.Message }
+
+func invalidParameter(format string, args ...interface{}) apiError {
+	return apiError{"InvalidParameterException", fmt.Sprintf(format, args...)}
+}
+
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "secretsmanager.")
+	op, ok := operations[name]
+	if r.Method != http.MethodPost || !ok {
+		writeError(w, apiError{"UnknownOperationException", "unsupported operation " + name})
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, invalidParameter("%v", err))
+		return
+	}
+
+	s.mu.Lock()
+	next := s.clone()
+	result, changed, err := op(next, body)
+	if err == nil && changed {
+		err = next.save()
+		if err == nil {
+			s.Secrets = next.Secrets
+		}
+	}
+	s.mu.Unlock()
+
+	logger := log.WithFields(log.Fields{"operation": name, "secret": secretID(body)})
+	if err != nil {
+		logger.Warn(err)
+		writeError(w, err)
+		return
+	}
+	logger.Info("request")
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(result)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	e, ok := err.(apiError)
+	status := http.StatusBadRequest
+	if !ok {
+		e = apiError{"InternalServiceError", err.Error()}
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.Header().Set("X-Amzn-Errortype", e.Type)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"__type": e.Type, "message": e.Message})
+}
+
+// secretID is only read for logging, never the secret value.
+func secretID(body []byte) string {
+	var input struct {
+		SecretID string `json:"SecretId"`
+		Name     string `json:"Name"`
+	}
+	json.Unmarshal(body, &input)
+	if input.SecretID != "" {
+		return input.SecretID
+	}
+	return input.Name
+}
+
+// epoch is how the JSON protocol sends timestamps.
+func epoch(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+func decode(body []byte, input interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	err := dec.Decode(input)
+	if err != nil {
+		return invalidParameter("%v", err)
+	}
+	return nil
+}
+
+func createSecret(s *Store, body []byte) (result interface{}, changed bool, err error) {
+	var input struct {
+		Name               string
+		ClientRequestToken string
+		Description        string
+		SecretString       *string
+		SecretBinary       []byte
+	}
+	err = decode(body, &input)
+	if err != nil {
+		return
+	}
+	if input.Name == "" {
+		return nil, false, invalidParameter("Name is required")
+	}
+	if input.SecretString != nil && input.SecretBinary != nil {
+		return nil, false, invalidParameter("You can't specify both a binary secret value and a string secret value in the same secret.")
+	}
+	if _, ok := s.Secrets[input.Name]; ok {
+		return nil, false, apiError{"ResourceExistsException", "The operation failed because the secret " + input.Name + " already exists."}
+	}
+
+	now := time.Now().UTC()
+	sec := &secret{
+		ARN:         s.newARN(input.Name),
+		Name:        input.Name,
+		Description: input.Description,
+		Created:     now,
+		Changed:     now,
+		Versions:    map[string]*version{},
+	}
+	output := map[string]interface{}{"ARN": sec.ARN, "Name": sec.Name}
+	if input.SecretString != nil || input.SecretBinary != nil {
+		id := input.ClientRequestToken
+		if id == "" {
+			id = newVersionID()
+		}
+		sec.Versions[id] = &version{
+			SecretString: input.SecretString,
+			SecretBinary: input.SecretBinary,
+			Stages:       []string{stageCurrent},
+			Created:      now,
+		}
+		output["VersionId"] = id
+	}
+	s.Secrets[sec.Name] = sec
+	return output, true, nil
+}
+
+func getSecretValue(s *Store, body []byte) (result interface{}, changed bool, err error) {
+	var input struct {
+		SecretID     string `json:"SecretId"`
+		VersionID    string `json:"VersionId"`
+		VersionStage string
+	}
+	err = decode(body, &input)
+	if err != nil {
+		return
+	}
+	sec, err := s.find(input.SecretID)
+	if err != nil {
+		return
+	}
+
+	id := input.VersionID
+	if id == "" {
+		stage := input.VersionStage
+		if stage == "" {
+			stage = stageCurrent
+		}
+		id = sec.stageVersion(stage)
+	}
+	v, ok := sec.Versions[id]
+	if !ok || input.VersionStage != "" && !hasStage(v.Stages, input.VersionStage) {
+		return nil, false, apiError{"ResourceNotFoundException", "Secrets Manager can't find the specified secret value for staging label: " + input.VersionStage}
+	}
+	output := map[string]interface{}{
+		"ARN":           sec.ARN,
+		"Name":          sec.Name,
+		"VersionId":     id,
+		"VersionStages": v.Stages,
+		"CreatedDate":   epoch(v.Created),
+	}
+	if v.SecretString != nil {
+		output["SecretString"] = *v.SecretString
+	} else {
+		output["SecretBinary"] = v.SecretBinary
+	}
+	return output, false, nil
+}
+
+func putSecretValue(s *Store, body []byte) (result interface{}, changed bool, err error) {
+	var input struct {
+		SecretID           string `json:"SecretId"`
+		ClientRequestToken string
+		SecretString       *string
+		SecretBinary       []byte
+		VersionStages      []string
+	}
+	err = decode(body, &input)
+	if err != nil {
+		return
+	}
+	sec, err := s.find(input.SecretID)
+	if err != nil {
+		return
+	}
+	if (input.SecretString == nil) == (input.SecretBinary == nil) {
+		return nil, false, invalidParameter("You must provide either SecretString or SecretBinary.")
+	}
+	id := input.ClientRequestToken
+	if id == "" {
+		id = newVersionID()
+	}
+	stages := input.VersionStages
+	if len(stages) == 0 {
+		stages = []string{stageCurrent}
+	}
+
+	output := map[string]interface{}{"ARN": sec.ARN, "Name": sec.Name, "VersionId": id}
+	if v, ok := sec.Versions[id]; ok {
+		// a retried request with the same token and value changes nothing
+		if !equalString(v.SecretString, input.SecretString) || !bytes.Equal(v.SecretBinary, input.SecretBinary) {
+			return nil, false, apiError{"ResourceExistsException", "A version with this ClientRequestToken already exists with a different value."}
+		}
+		output["VersionStages"] = v.Stages
+		return output, false, nil
+	}
+
+	now := time.Now().UTC()
+	sec.Versions[id] = &version{
+		SecretString: input.SecretString,
+		SecretBinary: input.SecretBinary,
+		Created:      now,
+	}
+	for _, stage := range stages {
+		sec.moveStage(stage, id)
+	}
+	sec.Changed = now
+	output["VersionStages"] = sec.Versions[id].Stages
+	return output, true, nil
+}
+
+func updateSecretVersionStage(s *Store, body []byte) (result interface{}, changed bool, err error) {
+	var input struct {
+		SecretID            string `json:"SecretId"`
+		VersionStage        string
+		MoveToVersionID     string `json:"MoveToVersionId"`
+		RemoveFromVersionID string `json:"RemoveFromVersionId"`
+	}
+	err = decode(body, &input)
+	if err != nil {
+		return
+	}
+	sec, err := s.find(input.SecretID)
+	if err != nil {
+		return
+	}
+	if input.VersionStage == "" {
+		return nil, false, invalidParameter("VersionStage is required")
+	}
+	for _, id := range []string{input.MoveToVersionID, input.RemoveFromVersionID} {
+		if _, ok := sec.Versions[id]; id != "" && !ok {
+			return nil, false, apiError{"ResourceNotFoundException", "Secrets Manager can't find the specified version " + id}
+		}
+	}
+	holder := sec.stageVersion(input.VersionStage)
+	if input.RemoveFromVersionID != "" && input.RemoveFromVersionID != holder {
+		return nil, false, invalidParameter("The staging label %s is not attached to version %s.", input.VersionStage, input.RemoveFromVersionID)
+	}
+	if input.MoveToVersionID != "" && holder != "" && holder != input.MoveToVersionID && input.RemoveFromVersionID == "" {
+		return nil, false, invalidParameter("The staging label %s is currently attached to version %s, specify it as RemoveFromVersionId.", input.VersionStage, holder)
+	}
+
+	if input.MoveToVersionID != "" {
+		sec.moveStage(input.VersionStage, input.MoveToVersionID)
+	} else if holder != "" {
+		if input.VersionStage == stageCurrent {
+			return nil, false, invalidParameter("AWSCURRENT can only be moved to another version.")
+		}
+		sec.removeStage(input.VersionStage, holder)
+	}
+	sec.Changed = time.Now().UTC()
+	return map[string]interface{}{"ARN": sec.ARN, "Name": sec.Name}, true, nil
+}
+
+func describeSecret(s *Store, body []byte) (result interface{}, changed bool, err error) {
+	var input struct {
+		SecretID string `json:"SecretId"`
+	}
+	err = decode(body, &input)
+	if err != nil {
+		return
+	}
+	sec, err := s.find(input.SecretID)
+	if err != nil {
+		return
+	}
+	return map[string]interface{}{
+		"ARN":                sec.ARN,
+		"Name":               sec.Name,
+		"Description":        sec.Description,
+		"CreatedDate":        epoch(sec.Created),
+		"LastChangedDate":    epoch(sec.Changed),
+		"RotationEnabled":    false,
+		"VersionIdsToStages": sec.versionsToStages(),
+	}, false, nil
+}
+
+// listSecrets pages through the secrets by name, the name filter matching
+// prefixes like Secrets Manager does.
+func listSecrets(s *Store, body []byte) (result interface{}, changed bool, err error) {
+	var input struct {
+		MaxResults int
+		NextToken  string
+		Filters    []struct {
+			Key    string
+			Values []string
+		}
+	}
+	err = decode(body, &input)
+	if err != nil {
+		return
+	}
+	for _, filter := range input.Filters {
+		if filter.Key != "name" {
+			return nil, false, invalidParameter("unsupported filter %s", filter.Key)
+		}
+	}
+
+	var names []string
+	for name := range s.Secrets {
+		if matchesFilters(name, input.Filters) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start := 0
+	if input.NextToken != "" {
+		start, err = strconv.Atoi(input.NextToken)
+		if err != nil || start < 0 || start > len(names) {
+			return nil, false, invalidParameter("invalid NextToken")
+		}
+	}
+	end := len(names)
+	if input.MaxResults > 0 && start+input.MaxResults < end {
+		end = start + input.MaxResults
+	}
+
+	list := []map[string]interface{}{}
+	for _, name := range names[start:end] {
+		sec := s.Secrets[name]
+		list = append(list, map[string]interface{}{
+			"ARN":                    sec.ARN,
+			"Name":                   sec.Name,
+			"Description":            sec.Description,
+			"CreatedDate":            epoch(sec.Created),
+			"LastChangedDate":        epoch(sec.Changed),
+			"SecretVersionsToStages": sec.versionsToStages(),
+		})
+	}
+	output := map[string]interface{}{"SecretList": list}
+	if end < len(names) {
+		output["NextToken"] = strconv.Itoa(end)
+	}
+	return output, false, nil
+}
+
+func matchesFilters(name string, filters []struct {
+	Key    string
+	Values []string
+}) bool {
+	for _, filter := range filters {
+		matched := false
+		for _, prefix := range filter.Values {
+			if strings.HasPrefix(name, prefix) {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func equalString(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
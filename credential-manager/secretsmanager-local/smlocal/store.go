@@ -0,0 +1,196 @@
+// Package smlocal is a stand-in for the parts of the Secrets Manager API
+// the credential tools and the rotation function use, serving secrets kept
+// in a local JSON file:
+//
+//	store, err := smlocal.OpenStore("secrets.json", "ap-southeast-1")
+//	server := httptest.NewServer(store)
+package smlocal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	stageCurrent  = "AWSCURRENT"
+	stagePrevious = "AWSPREVIOUS"
+)
+
+// Store keeps the secrets in a JSON file, rewritten after every change.
+// Like Secrets Manager a staging label is on at most one version of a
+// secret, and versions without a label are only kept for GetSecretValue
+// by version id.
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	region  string
+	Secrets map[string]*secret `json:"secrets"`
+}
+
+type secret struct {
+	ARN         string              `json:"arn"`
+	Name        string              `json:"name"`
+	Description string              `json:"description,omitempty"`
+	Created     time.Time           `json:"created"`
+	Changed     time.Time           `json:"changed"`
+	Versions    map[string]*version `json:"versions"`
+}
+
+type version struct {
+	SecretString *string   `json:"secret-string,omitempty"`
+	SecretBinary []byte    `json:"secret-binary,omitempty"`
+	Stages       []string  `json:"stages"`
+	Created      time.Time `json:"created"`
+}
+
+func OpenStore(path, region string) (s *Store, err error) {
+	s = &Store{path: path, region: region, Secrets: map[string]*secret{}}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, s)
+	return
+}
+
+// save writes the store to a temporary file renamed over the old one, so
+// a crash never leaves half a file.
+func (s *Store) save() (err error) {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".secrets-*.json")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// clone copies the secrets, an operation changes the copy so a failed save
+// leaves the store as it was.
+func (s *Store) clone() *Store {
+	c := &Store{path: s.path, region: s.region, Secrets: map[string]*secret{}}
+	for name, sec := range s.Secrets {
+		copied := *sec
+		copied.Versions = map[string]*version{}
+		for id, v := range sec.Versions {
+			copiedVersion := *v
+			copiedVersion.Stages = append([]string{}, v.Stages...)
+			copied.Versions[id] = &copiedVersion
+		}
+		c.Secrets[name] = &copied
+	}
+	return c
+}
+
+// find looks a secret up by name or ARN.
+func (s *Store) find(id string) (*secret, error) {
+	if sec, ok := s.Secrets[id]; ok {
+		return sec, nil
+	}
+	for _, sec := range s.Secrets {
+		if sec.ARN == id {
+			return sec, nil
+		}
+	}
+	return nil, apiError{"ResourceNotFoundException", "Secrets Manager can't find the specified secret."}
+}
+
+func (s *Store) newARN(name string) string {
+	return fmt.Sprintf("arn:aws:secretsmanager:%s:000000000000:secret:%s-%s", s.region, name, randomHex(3))
+}
+
+// stageVersion returns the version holding a staging label.
+func (sec *secret) stageVersion(stage string) string {
+	for id, v := range sec.Versions {
+		if hasStage(v.Stages, stage) {
+			return id
+		}
+	}
+	return ""
+}
+
+// moveStage puts a label on a version, taking it off whichever version
+// had it. Moving AWSCURRENT labels the version it came from AWSPREVIOUS.
+func (sec *secret) moveStage(stage, to string) {
+	from := sec.stageVersion(stage)
+	if from == to {
+		return
+	}
+	if from != "" {
+		sec.removeStage(stage, from)
+	}
+	if to != "" {
+		sec.Versions[to].Stages = append(sec.Versions[to].Stages, stage)
+	}
+	if stage == stageCurrent && from != "" {
+		sec.moveStage(stagePrevious, from)
+	}
+}
+
+func (sec *secret) removeStage(stage, from string) {
+	v := sec.Versions[from]
+	kept := v.Stages[:0]
+	for _, s := range v.Stages {
+		if s != stage {
+			kept = append(kept, s)
+		}
+	}
+	v.Stages = kept
+}
+
+// versionsToStages lists the versions that have a label.
+func (sec *secret) versionsToStages() map[string][]string {
+	stages := map[string][]string{}
+	for id, v := range sec.Versions {
+		if len(v.Stages) > 0 {
+			labels := append([]string{}, v.Stages...)
+			sort.Strings(labels)
+			stages[id] = labels
+		}
+	}
+	return stages
+}
+
+func hasStage(stages []string, stage string) bool {
+	for _, s := range stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newVersionID makes a version 4 UUID, like the ids of Secrets Manager.
+func newVersionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,209 @@
+package smlocal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := OpenStore(filepath.Join(t.TempDir(), "secrets.json"), "ap-southeast-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// call sends an operation through ServeHTTP, returning the decoded output
+// or the type of the error.
+func call(t *testing.T, s *Store, operation string, input map[string]interface{}) (output map[string]interface{}, errType string) {
+	t.Helper()
+	body, err := json.Marshal(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	req.Header.Set("X-Amz-Target", "secretsmanager."+operation)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return nil, rec.Header().Get("X-Amzn-Errortype")
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func mustCall(t *testing.T, s *Store, operation string, input map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	output, errType := call(t, s, operation, input)
+	if errType != "" {
+		t.Fatalf("%s failed with %s", operation, errType)
+	}
+	return output
+}
+
+// stages returns the labels of every version of a secret, as the store
+// file has them.
+func stages(t *testing.T, s *Store, name string) map[string][]string {
+	t.Helper()
+	reopened, err := OpenStore(s.path, s.region)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reopened.Secrets[name].versionsToStages()
+}
+
+// newRotatingSecret creates a secret with version v1 in AWSCURRENT and v2
+// in AWSPENDING, like createSecret of a rotation leaves it.
+func newRotatingSecret(t *testing.T, s *Store) {
+	t.Helper()
+	mustCall(t, s, "CreateSecret", map[string]interface{}{
+		"Name": "db", "ClientRequestToken": "v1", "SecretString": "one",
+	})
+	mustCall(t, s, "PutSecretValue", map[string]interface{}{
+		"SecretId": "db", "ClientRequestToken": "v2", "SecretString": "two",
+		"VersionStages": []string{"AWSPENDING"},
+	})
+}
+
+func TestUpdateSecretVersionStage(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   map[string]interface{}
+		errType string
+		stages  map[string][]string
+	}{
+		{
+			name:   "move AWSCURRENT",
+			input:  map[string]interface{}{"VersionStage": "AWSCURRENT", "MoveToVersionId": "v2", "RemoveFromVersionId": "v1"},
+			stages: map[string][]string{"v1": {"AWSPREVIOUS"}, "v2": {"AWSCURRENT", "AWSPENDING"}},
+		},
+		{
+			name:    "move without removing from the holder",
+			input:   map[string]interface{}{"VersionStage": "AWSCURRENT", "MoveToVersionId": "v2"},
+			errType: "InvalidParameterException",
+		},
+		{
+			name:    "remove from a version without the label",
+			input:   map[string]interface{}{"VersionStage": "AWSCURRENT", "MoveToVersionId": "v2", "RemoveFromVersionId": "v2"},
+			errType: "InvalidParameterException",
+		},
+		{
+			name:    "remove AWSCURRENT",
+			input:   map[string]interface{}{"VersionStage": "AWSCURRENT", "RemoveFromVersionId": "v1"},
+			errType: "InvalidParameterException",
+		},
+		{
+			name:   "remove AWSPENDING",
+			input:  map[string]interface{}{"VersionStage": "AWSPENDING", "RemoveFromVersionId": "v2"},
+			stages: map[string][]string{"v1": {"AWSCURRENT"}},
+		},
+		{
+			name:   "add a custom label",
+			input:  map[string]interface{}{"VersionStage": "blue", "MoveToVersionId": "v1"},
+			stages: map[string][]string{"v1": {"AWSCURRENT", "blue"}, "v2": {"AWSPENDING"}},
+		},
+		{
+			name:    "unknown version",
+			input:   map[string]interface{}{"VersionStage": "AWSCURRENT", "MoveToVersionId": "v3", "RemoveFromVersionId": "v1"},
+			errType: "ResourceNotFoundException",
+		},
+		{
+			name:    "no label",
+			input:   map[string]interface{}{"MoveToVersionId": "v2"},
+			errType: "InvalidParameterException",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestStore(t)
+			newRotatingSecret(t, s)
+			before := stages(t, s, "db")
+
+			test.input["SecretId"] = "db"
+			_, errType := call(t, s, "UpdateSecretVersionStage", test.input)
+			if errType != test.errType {
+				t.Fatalf("got error %q, want %q", errType, test.errType)
+			}
+			want := test.stages
+			if test.errType != "" {
+				want = before
+			}
+			if got := stages(t, s, "db"); !reflect.DeepEqual(got, want) {
+				t.Errorf("stages %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestPreviousFollowsCurrent checks AWSPREVIOUS is on at most one version
+// after successive rotations.
+func TestPreviousFollowsCurrent(t *testing.T) {
+	s := newTestStore(t)
+	mustCall(t, s, "CreateSecret", map[string]interface{}{
+		"Name": "db", "ClientRequestToken": "v1", "SecretString": "one",
+	})
+	for _, id := range []string{"v2", "v3"} {
+		mustCall(t, s, "PutSecretValue", map[string]interface{}{
+			"SecretId": "db", "ClientRequestToken": id, "SecretString": id,
+		})
+	}
+	want := map[string][]string{"v2": {"AWSPREVIOUS"}, "v3": {"AWSCURRENT"}}
+	if got := stages(t, s, "db"); !reflect.DeepEqual(got, want) {
+		t.Errorf("stages %v, want %v", got, want)
+	}
+
+	output := mustCall(t, s, "GetSecretValue", map[string]interface{}{"SecretId": "db", "VersionId": "v1"})
+	if output["SecretString"] != "one" {
+		t.Errorf("version without a label read as %v", output["SecretString"])
+	}
+	if _, errType := call(t, s, "GetSecretValue", map[string]interface{}{"SecretId": "db", "VersionStage": "AWSPENDING"}); errType != "ResourceNotFoundException" {
+		t.Errorf("got %q reading a missing stage", errType)
+	}
+}
+
+func TestPutSecretValueIsIdempotent(t *testing.T) {
+	s := newTestStore(t)
+	newRotatingSecret(t, s)
+	input := map[string]interface{}{
+		"SecretId": "db", "ClientRequestToken": "v2", "SecretString": "two",
+		"VersionStages": []string{"AWSPENDING"},
+	}
+	mustCall(t, s, "PutSecretValue", input)
+	input["SecretString"] = "other"
+	if _, errType := call(t, s, "PutSecretValue", input); errType != "ResourceExistsException" {
+		t.Errorf("got %q reusing a token with another value", errType)
+	}
+}
+
+func TestFailedSaveChangesNothing(t *testing.T) {
+	s := newTestStore(t)
+	newRotatingSecret(t, s)
+	before := s.Secrets["db"].versionsToStages()
+	// the temporary file of save can't be created in a missing directory
+	s.path = filepath.Join(t.TempDir(), "missing", "secrets.json")
+
+	_, errType := call(t, s, "UpdateSecretVersionStage", map[string]interface{}{
+		"SecretId": "db", "VersionStage": "AWSCURRENT", "MoveToVersionId": "v2", "RemoveFromVersionId": "v1",
+	})
+	if errType != "InternalServiceError" {
+		t.Fatalf("got %q, want the save to fail", errType)
+	}
+	if got := s.Secrets["db"].versionsToStages(); !reflect.DeepEqual(got, before) {
+		t.Errorf("stages %v after a failed save, want %v", got, before)
+	}
+	if _, errType = call(t, s, "CreateSecret", map[string]interface{}{"Name": "other", "SecretString": "x"}); errType != "InternalServiceError" {
+		t.Fatalf("got %q, want the save to fail", errType)
+	}
+	if _, ok := s.Secrets["other"]; ok {
+		t.Error("secret created although the save failed")
+	}
+}
@@ -0,0 +1,16 @@
+module column-migration
+
+go 1.16
+
+require (
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/sirupsen/logrus v1.8.1
+	github.com/spf13/pflag v1.0.5
+	github.com/spf13/viper v1.10.1
+	secretprovider v0.0.0
+	sqlcrypt v0.0.0
+)
+
+replace sqlcrypt => ../sqlcrypt
+
+replace secretprovider => ../../credential-manager/secretprovider
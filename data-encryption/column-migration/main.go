@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"secretprovider"
+	"sqlcrypt"
+)
+
+func init() {
+	log.SetLevel(log.DebugLevel)
+	log.WithField("status", "starting").Debug("initialize")
+
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(".")
+
+	errConfig := viper.ReadInConfig()
+	if errConfig != nil {
+		log.Fatalln(errConfig)
+	}
+
+	flag.String("mode", "", "migrate, verify, catch-up, cut-over, status or rollback")
+	flag.String("table", "", "table to migrate")
+	flag.String("primary-key", "id", "primary key column, walked in order")
+	flag.String("columns", "", "comma separated plaintext columns to encrypt")
+	flag.String("suffix", "_encrypted", "suffix of the ciphertext columns")
+	flag.Int("batch-size", 500, "rows encrypted per batch")
+	flag.Duration("pause", 0, "pause between batches to spare the database")
+	flag.String("checkpoint", "", "checkpoint file, <table>-migration.json by default")
+
+	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
+	pflag.Parse()
+	viper.BindPFlags(pflag.CommandLine)
+	secretprovider.InstallRedactor(viper.GetViper())
+	secretprovider.DefaultRedactor.Add(viper.GetString("DB-PASSWORD"))
+
+	log.WithField("status", "success").Debug("initialize")
+}
+
+// migration encrypts the plaintext columns of a table into new ciphertext
+// columns next to them. The plaintext columns are left untouched, so
+// applications keep working during the migration and a rollback only drops
+// the ciphertext columns.
+//
+// Applications writing the plaintext columns meanwhile leave the rows they
+// write after their batch, or after the migration is done, with a stale or
+// missing ciphertext. verify fails on those rows and catch-up encrypts them
+// again, to be run once the applications stopped writing the plaintext.
+//
+// The ciphertexts are bound to the plaintext column, not the one holding
+// them: cut-over drops the plaintext columns and renames the ciphertext
+// columns in their place, where the applications read and write them
+// through the sqlcrypt driver with ENCRYPTED-COLUMNS set to the migrated
+// columns. There is no rollback after the cut-over.
+type migration struct {
+	table      string
+	primaryKey string
+	columns    []string
+	suffix     string
+	batchSize  int
+	checkpoint string
+
+	db    *sql.DB
+	crypt *sqlcrypt.Driver
+}
+
+// checkpoint is written after every committed batch, a restarted migration
+// continues after LastKey.
+type checkpoint struct {
+	Table   string    `json:"table"`
+	Columns []string  `json:"columns"`
+	LastKey *string   `json:"last-key"`
+	Rows    int       `json:"rows"`
+	Done    bool      `json:"done"`
+	CutOver bool      `json:"cut-over"`
+	Updated time.Time `json:"updated"`
+}
+
+func main() {
+	m := newMigration()
+	mode := viper.GetString("mode")
+	if mode != "status" && m.loadCheckpoint().CutOver {
+		log.Fatalf("table %s is cut over, its columns are read through the sqlcrypt driver", m.table)
+	}
+	switch mode {
+	case "migrate":
+		m.migrate()
+	case "verify":
+		m.verify()
+	case "catch-up":
+		m.catchUp()
+	case "cut-over":
+		m.cutOver()
+	case "status":
+		state := m.loadCheckpoint()
+		output, _ := json.MarshalIndent(state, "", "  ")
+		fmt.Println(string(output))
+	case "rollback":
+		m.rollback()
+	default:
+		log.Fatalf("unknown mode %q", mode)
+	}
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z0-9_$]+$`)
+
+func newMigration() *migration {
+	m := &migration{
+		table:      viper.GetString("table"),
+		primaryKey: viper.GetString("primary-key"),
+		suffix:     viper.GetString("suffix"),
+		batchSize:  viper.GetInt("batch-size"),
+		checkpoint: viper.GetString("checkpoint"),
+	}
+	for _, column := range strings.Split(viper.GetString("columns"), ",") {
+		column = strings.TrimSpace(column)
+		if column != "" {
+			m.columns = append(m.columns, column)
+		}
+	}
+	if m.table == "" || len(m.columns) == 0 {
+		log.Fatalln("--table and --columns are required")
+	}
+	for _, name := range append([]string{m.table, m.primaryKey, m.suffix}, m.columns...) {
+		if !identifier.MatchString(name) {
+			log.Fatalf("invalid identifier %q", name)
+		}
+	}
+	if m.batchSize <= 0 {
+		log.Fatalln("--batch-size must be positive")
+	}
+	if m.checkpoint == "" {
+		m.checkpoint = m.table + "-migration.json"
+	}
+
+	m.crypt = sqlcrypt.NewDriver(sqlcrypt.Config{
+		Keys: sqlcrypt.NewKMSKeys(
+			viper.GetString("REGION"),
+			viper.GetString("USER-MASTER-KEY")),
+	})
+	m.db = connectRDS()
+	return m
+}
+
+func (m *migration) encryptedColumn(column string) string {
+	return column + m.suffix
+}
+
+// migrate adds the missing ciphertext columns and encrypts the table batch
+// by batch, verifying every batch before its checkpoint is written.
+func (m *migration) migrate() {
+	log.WithField("status", "starting").Info("migrate")
+
+	state := m.loadCheckpoint()
+	if state.Done {
+		log.WithField("rows", state.Rows).Info("migration already done, run rollback to start over")
+		return
+	}
+	m.addColumns()
+
+	for {
+		keys, values, err := m.readBatch(m.columns, state.LastKey, nil)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(keys) == 0 {
+			break
+		}
+
+		err = m.writeBatch(keys, values)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		last := keys[len(keys)-1]
+		failed, err := m.verifyBatch(state.LastKey, &last)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(failed) > 0 {
+			log.Fatalf("%d rows after key %v failed verification, checkpoint not advanced", len(failed), keyString(state.LastKey))
+		}
+
+		state.LastKey = &last
+		state.Rows += len(keys)
+		m.saveCheckpoint(state)
+		log.WithFields(log.Fields{
+			"last-key": last,
+			"rows":     state.Rows,
+		}).Info("batch migrated")
+
+		if len(keys) < m.batchSize {
+			break
+		}
+		time.Sleep(viper.GetDuration("pause"))
+	}
+
+	state.Done = true
+	m.saveCheckpoint(state)
+	log.WithField("status", "success").WithField("rows", state.Rows).Info("migrate")
+}
+
+// addColumns adds every ciphertext column the table doesn't have yet.
+func (m *migration) addColumns() {
+	have := m.tableColumns()
+	for _, column := range m.columns {
+		if !have[strings.ToLower(column)] {
+			log.Fatalf("table %s has no column %s", m.table, column)
+		}
+		encrypted := m.encryptedColumn(column)
+		if have[strings.ToLower(encrypted)] {
+			continue
+		}
+		_, err := m.db.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` TEXT NULL", m.table, encrypted))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.WithField("column", encrypted).Info("column added")
+	}
+}
+
+// readBatch reads up to batch-size rows with a primary key after after (from
+// the start when nil) and up to upTo (unbounded when nil), in key order.
+func (m *migration) readBatch(columns []string, after, upTo *string) (keys []string, values [][][]byte, err error) {
+	query := fmt.Sprintf("SELECT `%s`, `%s` FROM `%s`", m.primaryKey, strings.Join(columns, "`, `"), m.table)
+	var where []string
+	var args []interface{}
+	if after != nil {
+		where = append(where, fmt.Sprintf("`%s` > ?", m.primaryKey))
+		args = append(args, *after)
+	}
+	if upTo != nil {
+		where = append(where, fmt.Sprintf("`%s` <= ?", m.primaryKey))
+		args = append(args, *upTo)
+	}
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY `%s` LIMIT %d", m.primaryKey, m.batchSize)
+
+	rows, err := m.db.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		row := make([][]byte, len(columns))
+		dest := []interface{}{&key}
+		for i := range row {
+			dest = append(dest, &row[i])
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return
+		}
+		keys = append(keys, key)
+		values = append(values, row)
+	}
+	err = rows.Err()
+	return
+}
+
+// writeBatch encrypts one batch in a single transaction, every value bound
+// to the plaintext column it replaces after the cut-over.
+func (m *migration) writeBatch(keys []string, values [][][]byte) (err error) {
+	var assignments []string
+	for _, column := range m.columns {
+		assignments = append(assignments, fmt.Sprintf("`%s` = ?", m.encryptedColumn(column)))
+	}
+	query := fmt.Sprintf("UPDATE `%s` SET %s WHERE `%s` = ?",
+		m.table, strings.Join(assignments, ", "), m.primaryKey)
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	defer stmt.Close()
+	for i, key := range keys {
+		args := []interface{}{}
+		for j, value := range values[i] {
+			if value == nil {
+				args = append(args, nil)
+				continue
+			}
+			ciphertext, errEncrypt := m.crypt.Encrypt(value, m.table, m.columns[j])
+			if errEncrypt != nil {
+				tx.Rollback()
+				return errEncrypt
+			}
+			args = append(args, ciphertext)
+		}
+		args = append(args, key)
+		_, err = stmt.Exec(args...)
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+// verifyBatch checks the rows with a key in (after, upTo]: every ciphertext
+// column must hold a ciphertext, NULL for a NULL plaintext, decrypting to
+// the plaintext column. It returns the keys of the rows failing.
+func (m *migration) verifyBatch(after, upTo *string) (failed []string, err error) {
+	var encrypted []string
+	for _, column := range m.columns {
+		encrypted = append(encrypted, m.encryptedColumn(column))
+	}
+
+	keys, values, err := m.readBatch(append(append([]string{}, m.columns...), encrypted...), after, upTo)
+	if err != nil {
+		return
+	}
+
+	for i, key := range keys {
+		for j, column := range m.columns {
+			plaintext, stored := values[i][j], values[i][len(m.columns)+j]
+			ok := plaintext == nil && stored == nil
+			if plaintext != nil && stored != nil {
+				decrypted, errDecrypt := m.crypt.Decrypt(stored, m.table, column)
+				ok = errDecrypt == nil && bytes.Equal(plaintext, decrypted)
+			}
+			if !ok {
+				failed = append(failed, key)
+				log.WithFields(log.Fields{
+					"key":    key,
+					"column": column,
+				}).Warn("verification failed")
+				break
+			}
+		}
+	}
+	return
+}
+
+// verify checks the whole table, rows written to the plaintext columns
+// after their batch was migrated show up here.
+func (m *migration) verify() {
+	log.WithField("status", "starting").Info("verify")
+
+	rows, mismatches := m.verifyTable()
+	if mismatches > 0 {
+		log.Fatalf("%d of %d rows failed verification, run catch-up once the plaintext columns are no longer written", mismatches, rows)
+	}
+	log.WithField("status", "success").WithField("rows", rows).Info("verify")
+}
+
+func (m *migration) verifyTable() (rows, mismatches int) {
+	var after *string
+	for {
+		keys, _, err := m.readBatch([]string{m.primaryKey}, after, nil)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		last := keys[len(keys)-1]
+		failed, err := m.verifyBatch(after, &last)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		rows += len(keys)
+		mismatches += len(failed)
+		after = &last
+	}
+	return
+}
+
+// catchUp encrypts again the rows failing verification after the migration
+// is done, batch by batch, and verifies them again. Rows still written to
+// meanwhile fail the next verify.
+func (m *migration) catchUp() {
+	log.WithField("status", "starting").Info("catch-up")
+
+	state := m.loadCheckpoint()
+	if !state.Done {
+		log.Fatalln("migration not done, run migrate first")
+	}
+	var after *string
+	rows, encrypted := 0, 0
+	for {
+		keys, values, err := m.readBatch(m.columns, after, nil)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		last := keys[len(keys)-1]
+		failed, err := m.verifyBatch(after, &last)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		if len(failed) > 0 {
+			stale := map[string]bool{}
+			for _, key := range failed {
+				stale[key] = true
+			}
+			var staleKeys []string
+			var staleValues [][][]byte
+			for i, key := range keys {
+				if stale[key] {
+					staleKeys = append(staleKeys, key)
+					staleValues = append(staleValues, values[i])
+				}
+			}
+			err = m.writeBatch(staleKeys, staleValues)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			failed, err = m.verifyBatch(after, &last)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if len(failed) > 0 {
+				log.Fatalf("%d rows after key %v still fail verification, are the plaintext columns still written?", len(failed), keyString(after))
+			}
+			encrypted += len(staleKeys)
+			log.WithFields(log.Fields{
+				"last-key": last,
+				"rows":     len(staleKeys),
+			}).Info("rows encrypted again")
+			time.Sleep(viper.GetDuration("pause"))
+		}
+
+		rows += len(keys)
+		after = &last
+	}
+	log.WithFields(log.Fields{
+		"status":    "success",
+		"rows":      rows,
+		"encrypted": encrypted,
+	}).Info("catch-up")
+}
+
+// cutOver replaces every plaintext column by its ciphertext column in one
+// ALTER TABLE, once the whole table verifies. The applications must stop
+// writing the plaintext before, and read and write the columns through the
+// sqlcrypt driver after.
+func (m *migration) cutOver() {
+	log.WithField("status", "starting").Info("cut-over")
+
+	state := m.loadCheckpoint()
+	if !state.Done {
+		log.Fatalln("migration not done, run migrate first")
+	}
+	rows, mismatches := m.verifyTable()
+	if mismatches > 0 {
+		log.Fatalf("%d of %d rows failed verification, run catch-up first", mismatches, rows)
+	}
+
+	var changes []string
+	for _, column := range m.columns {
+		changes = append(changes,
+			fmt.Sprintf("DROP COLUMN `%s`", column),
+			fmt.Sprintf("CHANGE COLUMN `%s` `%s` TEXT NULL", m.encryptedColumn(column), column))
+	}
+	_, err := m.db.Exec(fmt.Sprintf("ALTER TABLE `%s` %s", m.table, strings.Join(changes, ", ")))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	state.CutOver = true
+	m.saveCheckpoint(state)
+	log.WithFields(log.Fields{
+		"status":  "success",
+		"rows":    rows,
+		"columns": strings.Join(m.columns, ","),
+	}).Info("cut-over")
+}
+
+// rollback drops the ciphertext columns and the checkpoint, the plaintext
+// columns were never changed.
+func (m *migration) rollback() {
+	log.WithField("status", "starting").Info("rollback")
+
+	have := m.tableColumns()
+	for _, column := range m.columns {
+		encrypted := m.encryptedColumn(column)
+		if !have[strings.ToLower(encrypted)] {
+			continue
+		}
+		_, err := m.db.Exec(fmt.Sprintf("ALTER TABLE `%s` DROP COLUMN `%s`", m.table, encrypted))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.WithField("column", encrypted).Info("column dropped")
+	}
+
+	err := os.Remove(m.checkpoint)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatalln(err)
+	}
+	log.WithField("status", "success").Info("rollback")
+}
+
+// tableColumns returns the lower cased columns of the table.
+func (m *migration) tableColumns() (have map[string]bool) {
+	rows, err := m.db.Query(fmt.Sprintf("SELECT * FROM `%s` LIMIT 0", m.table))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	existing, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	have = map[string]bool{}
+	for _, column := range existing {
+		have[strings.ToLower(column)] = true
+	}
+	return
+}
+
+func (m *migration) loadCheckpoint() (state checkpoint) {
+	source, err := os.ReadFile(m.checkpoint)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoint{Table: m.table, Columns: m.columns}
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = json.Unmarshal(source, &state)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if state.Table != m.table || strings.Join(state.Columns, ",") != strings.Join(m.columns, ",") {
+		log.Fatalf("checkpoint %s is for table %s columns %s", m.checkpoint, state.Table, strings.Join(state.Columns, ","))
+	}
+	return
+}
+
+// saveCheckpoint replaces the checkpoint atomically, a crash leaves either
+// the old or the new one.
+func (m *migration) saveCheckpoint(state checkpoint) {
+	state.Updated = time.Now().UTC()
+	output, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	tmp := m.checkpoint + ".tmp"
+	err = os.WriteFile(tmp, output, 0600)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = os.Rename(tmp, m.checkpoint)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func keyString(key *string) string {
+	if key == nil {
+		return "start"
+	}
+	return *key
+}
+
+func connectRDS() (db *sql.DB) {
+	log.WithField("status", "starting").Info("connectRDS")
+
+	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s",
+		viper.GetString("DB-USER"),
+		viper.GetString("DB-PASSWORD"),
+		viper.GetString("DB-HOST"),
+		viper.GetString("DB-DEFAULT"),
+	)
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		panic(err)
+	}
+	err = db.Ping()
+	if err != nil {
+		panic(err)
+	}
+
+	log.WithField("status", "success").Info("connectRDS")
+	return
+}
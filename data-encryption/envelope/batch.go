@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// plainRecord is one object of an enc-batch input or dec-batch output.
+type plainRecord struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant,omitempty"`
+	Text1  string `json:"text1,omitempty"`
+	Text2  string `json:"text2,omitempty"`
+}
+
+// batchError reports a record that could not be processed. Line is the
+// line of the record in the input, counting the csv header.
+type batchError struct {
+	Line  int    `json:"line"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+var errInvalidRecord = errors.New("invalid record")
+
+type batchJob struct {
+	line   int
+	plain  plainRecord
+	object SecureObject
+	err    error
+}
+
+// runBatch encrypts (enc-batch) or decrypts (dec-batch) every record of the
+// input with a pool of workers. Records are written as soon as they are
+// done, so the output order may differ from the input order.
+func runBatch(mode string) {
+	// per field debug logs would dominate the run time
+	log.SetLevel(log.InfoLevel)
+	t := time.Now()
+
+	format := viper.GetString("format")
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(viper.GetString("input")), ".")
+	}
+	if format != "csv" {
+		format = "jsonl"
+	}
+
+	in, err := openBatchInput(viper.GetString("input"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer in.Close()
+	out, err := createBatchOutput(viper.GetString("output"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer out.Close()
+	errOut, err := createBatchOutput(viper.GetString("errors"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer errOut.Close()
+
+	workers := viper.GetInt("workers")
+	if workers < 1 {
+		workers = 1
+	}
+	keys := newDataKeyPolicy(viper.GetString("datakey-policy"), viper.GetInt("datakey-count"))
+	cache := &dataKeyCache{keys: map[string]*cachedDataKey{}}
+	role, requested := viper.GetString("role"), requestedFields(viper.GetString("fields"))
+	if mode == "enc-batch" {
+		loadIndexKey()
+	} else {
+		// fail before reading the input, openRecord checks every record
+		_, err = decryptableFields(role, requested)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	jobs := make(chan batchJob, workers*4)
+	results := make(chan batchJob, workers*4)
+	go func() {
+		errRead := readBatch(in, format, mode, jobs)
+		if errRead != nil {
+			log.Fatalln(errRead)
+		}
+		close(jobs)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if job.err == nil {
+					if mode == "enc-batch" {
+						job.object, job.err = sealRecord(job.plain, keys)
+					} else {
+						job.plain, job.err = openRecord(job.object, cache, role, requested)
+					}
+				}
+				results <- job
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	writer := newBatchWriter(out, format, mode)
+	errWriter := json.NewEncoder(errOut)
+	var done, failed int
+	for job := range results {
+		if job.err != nil {
+			failed++
+			id := job.plain.ID
+			if mode == "dec-batch" {
+				id = job.object.ID
+			}
+			errWriter.Encode(batchError{Line: job.line, ID: id, Error: job.err.Error()})
+			continue
+		}
+		err = writer.write(job)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		done++
+	}
+	err = writer.flush()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	log.WithFields(log.Fields{
+		"records":  done,
+		"failed":   failed,
+		"time(ms)": time.Since(t).Milliseconds(),
+	}).Info(mode + " complete")
+}
+
+func openBatchInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(path)
+}
+
+func createBatchOutput(path string) (io.WriteCloser, error) {
+	switch path {
+	case "-":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	return os.Create(path)
+}
+
+// readBatch parses the input line by line, so a malformed record becomes a
+// per record error instead of stopping the batch.
+func readBatch(in io.Reader, format, mode string, jobs chan<- batchJob) (err error) {
+	if format == "csv" {
+		return readBatchCSV(in, mode, jobs)
+	}
+
+	reader := bufio.NewReaderSize(in, 1<<20)
+	for line := 1; ; line++ {
+		raw, errRead := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(raw))) > 0 {
+			job := batchJob{line: line}
+			if mode == "enc-batch" {
+				job.err = json.Unmarshal(raw, &job.plain)
+				if job.plain.Tenant == "" {
+					job.plain.Tenant = viper.GetString("tenant")
+				}
+			} else {
+				job.err = json.Unmarshal(raw, &job.object)
+				if job.err == nil {
+					job.err = checkVersion(job.object)
+				}
+			}
+			jobs <- job
+		}
+		if errRead == io.EOF {
+			return nil
+		}
+		if errRead != nil {
+			return errRead
+		}
+	}
+}
+
+func readBatchCSV(in io.Reader, mode string, jobs chan<- batchJob) (err error) {
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	required := []string{"id", "text1", "text2"}
+	if mode == "dec-batch" {
+		// the field keys are derived from the schema version and the data
+		// key is wrapped by the tenant KEK, an object read without them
+		// can't be opened
+		required = []string{"id", "version", "tenant", "field-one", "field-two", "datakey"}
+	}
+	for _, name := range required {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("csv input has no %s column", name)
+		}
+	}
+
+	for line := 2; ; line++ {
+		row, errRead := reader.Read()
+		if errRead == io.EOF {
+			return nil
+		}
+		job := batchJob{line: line, err: errRead}
+		if errRead == nil && len(row) != len(header) {
+			job.err = fmt.Errorf("expected %d columns, got %d", len(header), len(row))
+		}
+		if job.err == nil {
+			if mode == "enc-batch" {
+				job.plain = plainRecord{
+					ID:     row[columns["id"]],
+					Tenant: viper.GetString("tenant"),
+					Text1:  row[columns["text1"]],
+					Text2:  row[columns["text2"]],
+				}
+				if i, ok := columns["tenant"]; ok && row[i] != "" {
+					job.plain.Tenant = row[i]
+				}
+			} else {
+				job.object = SecureObject{
+					ID:       row[columns["id"]],
+					Tenant:   row[columns["tenant"]],
+					FieldOne: row[columns["field-one"]],
+					FieldTwo: row[columns["field-two"]],
+					DataKey:  row[columns["datakey"]],
+				}
+				job.object.Version, job.err = strconv.Atoi(row[columns["version"]])
+				if job.err != nil {
+					job.err = fmt.Errorf("%w: version %q is not a number", errInvalidRecord, row[columns["version"]])
+				} else {
+					job.err = checkVersion(job.object)
+				}
+			}
+		}
+		jobs <- job
+	}
+}
+
+func sealRecord(record plainRecord, keys *dataKeyPolicy) (obj SecureObject, err error) {
+	if record.ID == "" {
+		err = fmt.Errorf("%w: record has no id", errInvalidRecord)
+		return
+	}
+	dataKey, wrapped, err := keys.next(record.Tenant)
+	if err != nil {
+		return
+	}
+	ciphertextOne, err := sealField(dataKey, record.ID, "field-one", record.Text1)
+	if err != nil {
+		return
+	}
+	ciphertextTwo, err := sealField(dataKey, record.ID, "field-two", record.Text2)
+	if err != nil {
+		return
+	}
+
+	obj = SecureObject{
+		Version:       schemaVersion,
+		ID:            record.ID,
+		Tenant:        record.Tenant,
+		FieldOne:      ciphertextOne,
+		FieldTwo:      ciphertextTwo,
+		FieldOneIndex: blindIndexes("field-one", record.Text1),
+		FieldTwoIndex: blindIndexes("field-two", record.Text2),
+		DataKey:       wrapped,
+	}
+	return
+}
+
+// openRecord decrypts the requested fields of an object, or every field the
+// role may see, resolving them against the policy with decryptableFields.
+func openRecord(obj SecureObject, cache *dataKeyCache, role string, requested []string) (record plainRecord, err error) {
+	record.ID = obj.ID
+	record.Tenant = obj.Tenant
+	fields, err := decryptableFields(role, requested)
+	if err != nil || len(fields) == 0 {
+		return
+	}
+	dataKey, err := cache.get(obj.Tenant, obj.DataKey)
+	if err != nil {
+		return
+	}
+	for _, field := range fields {
+		switch field {
+		case "field-one":
+			record.Text1, err = openField(dataKey, obj, field, obj.FieldOne)
+		case "field-two":
+			record.Text2, err = openField(dataKey, obj, field, obj.FieldTwo)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// dataKeyPolicy decides how many records of a tenant share one data key:
+// every record gets its own with "record", the whole run shares one with
+// "batch" and "count" rotates the key every count records.
+type dataKeyPolicy struct {
+	mu     sync.Mutex
+	every  int
+	shared map[string]*sharedDataKey
+}
+
+type sharedDataKey struct {
+	plaintext []byte
+	wrapped   string
+	uses      int
+}
+
+func newDataKeyPolicy(policy string, count int) *dataKeyPolicy {
+	switch policy {
+	case "record":
+		return &dataKeyPolicy{every: 1}
+	case "batch":
+		return &dataKeyPolicy{every: 0, shared: map[string]*sharedDataKey{}}
+	case "count":
+		if count < 1 {
+			log.Fatalln("datakey-count must be positive")
+		}
+		return &dataKeyPolicy{every: count, shared: map[string]*sharedDataKey{}}
+	}
+	log.Fatalf("unknown data key policy %q", policy)
+	return nil
+}
+
+func (p *dataKeyPolicy) next(tenant string) (plaintext []byte, wrapped string, err error) {
+	if p.every == 1 {
+		return newDataKey(tenant)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.shared[tenant]
+	if !ok || (p.every > 0 && key.uses >= p.every) {
+		key = &sharedDataKey{}
+		key.plaintext, key.wrapped, err = newDataKey(tenant)
+		if err != nil {
+			return
+		}
+		p.shared[tenant] = key
+	}
+	key.uses++
+	return key.plaintext, key.wrapped, nil
+}
+
+// dataKeyCache unwraps each distinct data key of a batch once. It is reset
+// when it grows past maxCachedDataKeys, which only happens for batches
+// encrypted with a key per record where caching does not help anyway.
+type dataKeyCache struct {
+	mu   sync.Mutex
+	keys map[string]*cachedDataKey
+}
+
+type cachedDataKey struct {
+	once      sync.Once
+	plaintext []byte
+	err       error
+}
+
+const maxCachedDataKeys = 10000
+
+func (c *dataKeyCache) get(tenant, wrapped string) ([]byte, error) {
+	id := tenant + "/" + wrapped
+	c.mu.Lock()
+	entry, ok := c.keys[id]
+	if !ok {
+		if len(c.keys) >= maxCachedDataKeys {
+			c.keys = map[string]*cachedDataKey{}
+		}
+		entry = &cachedDataKey{}
+		c.keys[id] = entry
+	}
+	c.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.plaintext, entry.err = openDataKey(tenant, wrapped)
+	})
+	return entry.plaintext, entry.err
+}
+
+// batchWriter streams finished records as jsonl or csv.
+type batchWriter struct {
+	mode    string
+	buf     *bufio.Writer
+	json    *json.Encoder
+	csv     *csv.Writer
+	indexes [][2]string // field and variant of every index column
+}
+
+func newBatchWriter(out io.Writer, format, mode string) *batchWriter {
+	w := &batchWriter{mode: mode, buf: bufio.NewWriter(out)}
+	if format != "csv" {
+		w.json = json.NewEncoder(w.buf)
+		return w
+	}
+
+	w.csv = csv.NewWriter(w.buf)
+	if mode == "dec-batch" {
+		w.csv.Write([]string{"id", "text1", "text2"})
+		return w
+	}
+	header := []string{"id", "version", "tenant", "field-one", "field-two", "datakey"}
+	if loadIndexKey() != nil {
+		for _, field := range []string{"field-one", "field-two"} {
+			for _, variant := range blindIndexVariants(field) {
+				w.indexes = append(w.indexes, [2]string{field, variant.Name})
+				header = append(header, blindIndexColumn(field, variant.Name))
+			}
+		}
+	}
+	w.csv.Write(header)
+	return w
+}
+
+func (w *batchWriter) write(job batchJob) error {
+	if w.json != nil {
+		if w.mode == "dec-batch" {
+			return w.json.Encode(job.plain)
+		}
+		return w.json.Encode(job.object)
+	}
+
+	if w.mode == "dec-batch" {
+		return w.csv.Write([]string{job.plain.ID, job.plain.Text1, job.plain.Text2})
+	}
+	row := []string{
+		job.object.ID,
+		strconv.Itoa(job.object.Version),
+		job.object.Tenant,
+		job.object.FieldOne,
+		job.object.FieldTwo,
+		job.object.DataKey,
+	}
+	for _, index := range w.indexes {
+		if index[0] == "field-one" {
+			row = append(row, job.object.FieldOneIndex[index[1]])
+		} else {
+			row = append(row, job.object.FieldTwoIndex[index[1]])
+		}
+	}
+	return w.csv.Write(row)
+}
+
+func (w *batchWriter) flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// blindIndexVariant describes one blind index generated for a field.
+// Normalizing and truncating the input makes partial or case insensitive
+// lookups possible, truncating the output makes the index collide on
+// purpose so it leaks less about the plaintext.
+type blindIndexVariant struct {
+	Name      string   `mapstructure:"name"`
+	Normalize []string `mapstructure:"normalize"` // lower, trim, alnum, digits
+	Prefix    int      `mapstructure:"prefix"`    // runes of input to index, 0 for all
+	Bits      int      `mapstructure:"bits"`      // bits of output to keep, 0 for 256
+}
+
+var defaultBlindIndex = []blindIndexVariant{{Name: "full"}}
+
+var variantName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+var (
+	variantsMu    sync.Mutex
+	variantsCache = map[string][]blindIndexVariant{}
+)
+
+// blindIndexVariants reads the variants of a field from BLIND-INDEX,
+// falling back to a single full value index.
+func blindIndexVariants(field string) (variants []blindIndexVariant) {
+	variantsMu.Lock()
+	defer variantsMu.Unlock()
+	variants, ok := variantsCache[field]
+	if ok {
+		return
+	}
+
+	err := viper.UnmarshalKey("BLIND-INDEX."+field, &variants)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(variants) == 0 {
+		variants = defaultBlindIndex
+	}
+	for _, variant := range variants {
+		// the name becomes part of a column name
+		if !variantName.MatchString(variant.Name) {
+			log.Fatalf("invalid blind index variant name %q of %s", variant.Name, field)
+		}
+	}
+	variantsCache[field] = variants
+	return
+}
+
+var (
+	indexKeyOnce sync.Once
+	indexKey     []byte
+)
+
+// loadIndexKey unwraps INDEX-KEY, a data key kept apart from the data keys
+// of the objects. Blind indexes are skipped when it is not configured.
+func loadIndexKey() []byte {
+	indexKeyOnce.Do(func() {
+		if viper.GetString("INDEX-KEY") == "" {
+			return
+		}
+		wrapped, err := base64.StdEncoding.DecodeString(viper.GetString("INDEX-KEY"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		indexKey, err = decryptDataKey(wrapped)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	})
+	return indexKey
+}
+
+// createIndexKey prints a new wrapped index key to put in INDEX-KEY.
+func createIndexKey() {
+	_, wrapped, err := generateDataKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.WithField("INDEX-KEY", base64.StdEncoding.EncodeToString(wrapped)).
+		Info("index key created")
+}
+
+// blindIndexes computes every configured variant of a field value.
+func blindIndexes(field, value string) (indexes map[string]string) {
+	key := loadIndexKey()
+	if key == nil {
+		return
+	}
+	indexes = map[string]string{}
+	for _, variant := range blindIndexVariants(field) {
+		indexes[variant.Name] = blindIndex(key, field, variant, value)
+	}
+	return
+}
+
+// blindIndex derives a key per field and variant from the index key, so
+// equal values in different fields or variants do not share an index.
+func blindIndex(key []byte, field string, variant blindIndexVariant, value string) string {
+	derive := hmac.New(sha256.New, key)
+	derive.Write([]byte(fmt.Sprintf("envelope-blind-index:%s:%s", field, variant.Name)))
+	fieldKey := derive.Sum(nil)
+
+	mac := hmac.New(sha256.New, fieldKey)
+	mac.Write([]byte(normalizeIndexValue(variant, value)))
+	sum := mac.Sum(nil)
+
+	if variant.Bits > 0 && variant.Bits < len(sum)*8 {
+		sum = sum[:(variant.Bits+7)/8]
+		if rest := variant.Bits % 8; rest != 0 {
+			sum[len(sum)-1] &= byte(0xff << (8 - rest))
+		}
+	}
+	return hex.EncodeToString(sum)
+}
+
+func normalizeIndexValue(variant blindIndexVariant, value string) string {
+	for _, step := range variant.Normalize {
+		switch step {
+		case "lower":
+			value = strings.ToLower(value)
+		case "trim":
+			value = strings.TrimSpace(value)
+		case "alnum":
+			value = strings.Map(func(r rune) rune {
+				if unicode.IsLetter(r) || unicode.IsDigit(r) {
+					return r
+				}
+				return -1
+			}, value)
+		case "digits":
+			value = strings.Map(func(r rune) rune {
+				if unicode.IsDigit(r) {
+					return r
+				}
+				return -1
+			}, value)
+		default:
+			log.Fatalf("unknown blind index normalization %q", step)
+		}
+	}
+	if variant.Prefix > 0 {
+		runes := []rune(value)
+		if len(runes) > variant.Prefix {
+			value = string(runes[:variant.Prefix])
+		}
+	}
+	return value
+}
+
+// blindIndexColumn names the column holding a blind index, e.g.
+// field_one_full_bidx for the full variant of field-one.
+func blindIndexColumn(field, variant string) string {
+	return strings.ReplaceAll(fmt.Sprintf("%s_%s_bidx", field, variant), "-", "_")
+}
+
+// blindIndexWhere builds a SQL condition selecting rows whose field may hold
+// value. Truncated variants match false positives, so the candidates still
+// have to be decrypted and compared. The field becomes part of a column
+// name, so only the fields of SecureObject are accepted.
+func blindIndexWhere(field, variantName, value string) (clause string, args []interface{}, err error) {
+	if !isObjectField(field) {
+		return "", nil, fmt.Errorf("%w: unknown field %q, blind indexes exist for %s",
+			errInvalidRecord, field, strings.Join(objectFields, ", "))
+	}
+	key := loadIndexKey()
+	if key == nil {
+		return "", nil, errors.New("INDEX-KEY is not configured")
+	}
+	for _, variant := range blindIndexVariants(field) {
+		if variant.Name == variantName {
+			clause = blindIndexColumn(field, variant.Name) + " = ?"
+			args = []interface{}{blindIndex(key, field, variant, value)}
+			return
+		}
+	}
+	return "", nil, fmt.Errorf("blind index %q is not configured for %s", variantName, field)
+}
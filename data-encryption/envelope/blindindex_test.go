@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func useIndexKey(t *testing.T) {
+	t.Helper()
+	useLocalKeys(t)
+	_, wrapped, err := generateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("INDEX-KEY", base64.StdEncoding.EncodeToString(wrapped))
+	indexKeyOnce = sync.Once{}
+	indexKey = nil
+	variantsMu.Lock()
+	variantsCache = map[string][]blindIndexVariant{}
+	variantsMu.Unlock()
+	t.Cleanup(func() {
+		indexKeyOnce = sync.Once{}
+		indexKey = nil
+	})
+}
+
+func TestBlindIndexWhere(t *testing.T) {
+	useIndexKey(t)
+	clause, args, err := blindIndexWhere("field-one", "full", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clause != "field_one_full_bidx = ?" || len(args) != 1 {
+		t.Errorf("got %q %v", clause, args)
+	}
+	if args[0] != blindIndexes("field-one", "value")["full"] {
+		t.Error("lookup doesn't match the index written for the value")
+	}
+
+	for _, field := range []string{"datakey", "field-one_full_bidx = 1 OR 1", "id"} {
+		_, _, err = blindIndexWhere(field, "full", "value")
+		if !errors.Is(err, errInvalidRecord) {
+			t.Errorf("field %q: expected an unknown field error, got %v", field, err)
+		}
+	}
+	if _, _, err = blindIndexWhere("field-one", "prefix", "value"); err == nil {
+		t.Error("lookup on a variant that isn't configured")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Keys move in and out of the local keyring wrapped with RSAES-OAEP-SHA-256,
+// like the import key material flow of KMS:
+//
+//	--mode keys-import-params --key-id k --output wrapping.pem
+//	(wrap the 32 byte key under wrapping.pem elsewhere)
+//	--mode keys-import --key-id k --input wrapped.bin
+//
+//	--mode keys-export --key-id k --public-key kms-public.der --output wrapped.bin
+//
+// The plaintext key only exists in memory, the wrapping private key of a
+// pending import is kept in the keyring sealed by the master key.
+
+// importValidity matches the lifetime of KMS import parameters.
+const importValidity = 24 * time.Hour
+
+type keyringImport struct {
+	PrivateKey string    `json:"private-key"`
+	Expires    time.Time `json:"expires"`
+}
+
+// createImportParams creates the RSA key pair a key to import is wrapped
+// with and writes its public key.
+func createImportParams(name string) {
+	if name == "" {
+		log.Fatalln("key-id is required")
+	}
+	master, err := localProvider().masterKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ring, err := readKeyring()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	publicPEM, err := addImportParams(&ring, master, name, viper.GetBool("replace"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if output := viper.GetString("output"); output == "-" {
+		fmt.Print(string(publicPEM))
+	} else {
+		err = writeNewFile(output, publicPEM)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = writeKeyring(ring)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.WithFields(log.Fields{
+		"key-id":  name,
+		"expires": ring.Imports[name].Expires,
+	}).Info("import parameters created")
+}
+
+// addImportParams keeps a new RSA private key for the import of name in the
+// ring, sealed by the master key, and returns its public key as PEM.
+func addImportParams(ring *keyring, master []byte, name string, replace bool) (publicPEM []byte, err error) {
+	if _, ok := ring.Keys[name]; ok && !replace {
+		return nil, fmt.Errorf("keyring already has a key %s, --replace imports over it", name)
+	}
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return
+	}
+	der := x509.MarshalPKCS1PrivateKey(private)
+	sealed, err := sealKey(master, der, "import:"+name)
+	wipe(der)
+	if err != nil {
+		return
+	}
+	public, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		return
+	}
+	if ring.Imports == nil {
+		ring.Imports = map[string]keyringImport{}
+	}
+	ring.Imports[name] = keyringImport{PrivateKey: sealed, Expires: time.Now().UTC().Add(importValidity)}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), nil
+}
+
+// importKey unwraps key material with the private key of the pending
+// import and seals it into the keyring.
+func importKey(name string) {
+	l := localProvider()
+	master, err := l.masterKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ring, err := readKeyring()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	wrapped, err := readBinaryInput(viper.GetString("input"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	replaced, err := importKeyMaterial(&ring, master, name, wrapped, viper.GetBool("replace"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = writeKeyring(ring)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if replaced {
+		log.WithField("key-id", name).Warn("key replaced, data keys wrapped by the previous key no longer open")
+		return
+	}
+	log.WithField("key-id", name).Info("key imported")
+}
+
+// importKeyMaterial unwraps key material with the private key of the
+// pending import of name and seals it into the ring. An existing key of the
+// same name is only replaced with replace.
+func importKeyMaterial(ring *keyring, master []byte, name string, wrapped []byte, replace bool) (replaced bool, err error) {
+	_, replaced = ring.Keys[name]
+	if replaced && !replace {
+		return false, fmt.Errorf("keyring already has a key %s, --replace imports over it", name)
+	}
+	pending, ok := ring.Imports[name]
+	if !ok {
+		return false, fmt.Errorf("no pending import for %s, run keys-import-params", name)
+	}
+	if time.Now().After(pending.Expires) {
+		return false, fmt.Errorf("import parameters for %s expired at %s", name, pending.Expires)
+	}
+
+	der, err := openKey(master, pending.PrivateKey, "import:"+name)
+	if err != nil {
+		return
+	}
+	private, err := x509.ParsePKCS1PrivateKey(der)
+	wipe(der)
+	if err != nil {
+		return
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, private, wrapped, nil)
+	if err != nil {
+		return
+	}
+	if len(key) != 32 {
+		wipe(key)
+		return false, fmt.Errorf("imported key has %d bytes, want 32", len(key))
+	}
+
+	sealed, err := sealKey(master, key, name)
+	wipe(key)
+	if err != nil {
+		return
+	}
+	ring.Keys[name] = keyringKey{Key: sealed, Created: time.Now().UTC()}
+	delete(ring.Imports, name)
+	return
+}
+
+// exportKey wraps a keyring key under the given RSA public key, for an
+// HSM or the import parameters of KMS.
+func exportKey(name string) {
+	l := localProvider()
+	public, err := readPublicKey(viper.GetString("public-key"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	key, err := l.key(name)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, public, key, nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = writeBinaryOutput(viper.GetString("output"), wrapped)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.WithField("key-id", name).Warn("key exported")
+}
+
+// readPublicKey reads an RSA public key as PEM, DER, or base64 DER as
+// returned by KMS GetParametersForImport.
+func readPublicKey(path string) (public *rsa.PublicKey, err error) {
+	if path == "" {
+		return nil, errors.New("public-key is required")
+	}
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	der := source
+	if block, _ := pem.Decode(source); block != nil {
+		der = block.Bytes
+	} else if decoded, errDecode := base64.StdEncoding.DecodeString(strings.TrimSpace(string(source))); errDecode == nil {
+		der = decoded
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return
+	}
+	public, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA public key", path)
+	}
+	return
+}
+
+// readBinaryInput reads wrapped key material, raw or base64.
+func readBinaryInput(path string) (content []byte, err error) {
+	in, err := openBatchInput(path)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	content, err = io.ReadAll(in)
+	if err != nil {
+		return
+	}
+	if decoded, errDecode := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content))); errDecode == nil {
+		content = decoded
+	}
+	return
+}
+
+// writeBinaryOutput writes to a file, or prints base64 to stdout for "-".
+func writeBinaryOutput(path string, content []byte) error {
+	if path == "" || path == "-" {
+		fmt.Println(base64.StdEncoding.EncodeToString(content))
+		return nil
+	}
+	return writeNewFile(path, content)
+}
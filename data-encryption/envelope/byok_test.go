@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// wrapForImport wraps key material under the public key of the pending
+// import like KMS or an HSM would.
+func wrapForImport(t *testing.T, publicPEM, key []byte) []byte {
+	t.Helper()
+	block, _ := pem.Decode(publicPEM)
+	if block == nil {
+		t.Fatal("import parameters are not PEM")
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, public.(*rsa.PublicKey), key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wrapped
+}
+
+func TestImportExportRoundTrip(t *testing.T) {
+	useLocalKeys(t)
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+
+	viper.Set("output", filepath.Join(dir, "import.pem"))
+	createImportParams("imported")
+	publicPEM, err := os.ReadFile(filepath.Join(dir, "import.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "wrapped.bin"), wrapForImport(t, publicPEM, key), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("input", filepath.Join(dir, "wrapped.bin"))
+	importKey("imported")
+
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "hsm.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("public-key", filepath.Join(dir, "hsm.pem"))
+	viper.Set("output", filepath.Join(dir, "exported.bin"))
+	exportKey("imported")
+
+	exported, err := os.ReadFile(filepath.Join(dir, "exported.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, private, exported, nil)
+	if err != nil || !bytes.Equal(unwrapped, key) {
+		t.Errorf("exported %x, %v, want %x", unwrapped, err, key)
+	}
+}
+
+func TestImportKeyMaterialFails(t *testing.T) {
+	useLocalKeys(t)
+	master, err := localProvider().masterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{7}, 32)
+
+	for name, test := range map[string]struct {
+		prepare func(ring *keyring, publicPEM []byte) []byte
+		err     string
+	}{
+		"expired": {func(ring *keyring, publicPEM []byte) []byte {
+			pending := ring.Imports["imported"]
+			pending.Expires = time.Now().Add(-time.Minute)
+			ring.Imports["imported"] = pending
+			return wrapForImport(t, publicPEM, key)
+		}, "expired"},
+		"wrong wrapping key": {func(ring *keyring, publicPEM []byte) []byte {
+			other, err := addImportParams(&keyring{}, master, "other", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return wrapForImport(t, other, key)
+		}, "decryption error"},
+		"existing key": {func(ring *keyring, publicPEM []byte) []byte {
+			ring.Keys["imported"] = keyringKey{Key: "sealed"}
+			return wrapForImport(t, publicPEM, key)
+		}, "--replace"},
+	} {
+		ring := keyring{Keys: map[string]keyringKey{}}
+		publicPEM, err := addImportParams(&ring, master, "imported", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapped := test.prepare(&ring, publicPEM)
+		_, err = importKeyMaterial(&ring, master, "imported", wrapped, false)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: import error %v, want %q", name, err, test.err)
+		}
+		if _, ok := ring.Imports["imported"]; !ok {
+			t.Errorf("%s: failed import dropped the pending import", name)
+		}
+		if name == "existing key" && ring.Keys["imported"].Key != "sealed" {
+			t.Errorf("%s: failed import dropped the existing key", name)
+		}
+	}
+}
+
+func TestImportKeyMaterialReplaces(t *testing.T) {
+	useLocalKeys(t)
+	master, err := localProvider().masterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := keyring{Keys: map[string]keyringKey{"imported": {Key: "sealed"}}}
+	_, err = addImportParams(&ring, master, "imported", false)
+	if err == nil {
+		t.Fatal("import parameters created over an existing key without replace")
+	}
+	publicPEM, err := addImportParams(&ring, master, "imported", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := importKeyMaterial(&ring, master, "imported", wrapForImport(t, publicPEM, bytes.Repeat([]byte{7}, 32)), true)
+	if err != nil || !replaced {
+		t.Fatalf("replaced %v, %v", replaced, err)
+	}
+	opened, err := openKey(master, ring.Keys["imported"].Key, "imported")
+	if err != nil || !bytes.Equal(opened, bytes.Repeat([]byte{7}, 32)) {
+		t.Errorf("replaced key %x, %v", opened, err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/fxamacker/cbor/v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// schemaVersion is written into every SecureObject. Objects written before
+// the field existed decode with version 0 and are read as version 1.
+//
+//	1: fields encrypted with the data key
+//	2: fields encrypted with HKDF subkeys of the data key, see fieldKey
+const schemaVersion = 2
+
+// binaryObject is the CBOR encoding of a SecureObject. Ciphertexts, keys and
+// indexes are stored as raw bytes instead of base64 or hex text and the
+// field names are replaced by small integer keys.
+type binaryObject struct {
+	Version       int               `cbor:"1,keyasint"`
+	ID            string            `cbor:"2,keyasint"`
+	Tenant        string            `cbor:"3,keyasint,omitempty"`
+	FieldOne      []byte            `cbor:"4,keyasint"`
+	FieldTwo      []byte            `cbor:"5,keyasint"`
+	FieldOneIndex map[string][]byte `cbor:"6,keyasint,omitempty"`
+	FieldTwoIndex map[string][]byte `cbor:"7,keyasint,omitempty"`
+	DataKey       []byte            `cbor:"8,keyasint"`
+	KEKVersion    int               `cbor:"9,keyasint,omitempty"`
+}
+
+// selfDescribeCBOR is the tag 55799 prefix marking a file as CBOR.
+var selfDescribeCBOR = []byte{0xd9, 0xd9, 0xf7}
+
+func objectExtension(encoding string) string {
+	if encoding == "cbor" {
+		return "cbor"
+	}
+	return "json"
+}
+
+// marshalObject encodes an object as json or cbor, keeping its schema
+// version.
+func marshalObject(obj SecureObject, encoding string) (output []byte, err error) {
+	if obj.Version == 0 {
+		obj.Version = 1
+	}
+	if encoding != "cbor" {
+		return json.Marshal(obj)
+	}
+
+	bin, err := toBinaryObject(obj)
+	if err != nil {
+		return
+	}
+	output, err = cbor.Marshal(bin)
+	if err != nil {
+		return
+	}
+	return append(append([]byte{}, selfDescribeCBOR...), output...), nil
+}
+
+// unmarshalObject decodes a json or cbor object, telling them apart by the
+// first byte.
+func unmarshalObject(source []byte) (obj SecureObject, err error) {
+	trimmed := bytes.TrimLeft(source, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(trimmed, &obj)
+	} else {
+		bin := binaryObject{}
+		err = cbor.Unmarshal(bytes.TrimPrefix(source, selfDescribeCBOR), &bin)
+		if err != nil {
+			return
+		}
+		obj = fromBinaryObject(bin)
+	}
+	if err != nil {
+		return
+	}
+	err = checkVersion(obj)
+	return
+}
+
+func checkVersion(obj SecureObject) error {
+	if obj.Version > schemaVersion {
+		return fmt.Errorf("object %s has schema version %d, newer than %d", obj.ID, obj.Version, schemaVersion)
+	}
+	return nil
+}
+
+func toBinaryObject(obj SecureObject) (bin binaryObject, err error) {
+	bin = binaryObject{Version: obj.Version, ID: obj.ID, Tenant: obj.Tenant}
+	bin.FieldOne, err = base64.StdEncoding.DecodeString(obj.FieldOne)
+	if err != nil {
+		return
+	}
+	bin.FieldTwo, err = base64.StdEncoding.DecodeString(obj.FieldTwo)
+	if err != nil {
+		return
+	}
+	dataKey := obj.DataKey
+	if version, sealed, ok := parseWrappedKey(obj.DataKey); ok {
+		bin.KEKVersion, dataKey = version, sealed
+	}
+	bin.DataKey, err = base64.StdEncoding.DecodeString(dataKey)
+	if err != nil {
+		return
+	}
+	bin.FieldOneIndex, err = decodeIndexes(obj.FieldOneIndex)
+	if err != nil {
+		return
+	}
+	bin.FieldTwoIndex, err = decodeIndexes(obj.FieldTwoIndex)
+	return
+}
+
+func fromBinaryObject(bin binaryObject) SecureObject {
+	dataKey := base64.StdEncoding.EncodeToString(bin.DataKey)
+	if bin.KEKVersion > 0 {
+		dataKey = kekPrefix + strconv.Itoa(bin.KEKVersion) + ":" + dataKey
+	}
+	return SecureObject{
+		Version:       bin.Version,
+		ID:            bin.ID,
+		Tenant:        bin.Tenant,
+		FieldOne:      base64.StdEncoding.EncodeToString(bin.FieldOne),
+		FieldTwo:      base64.StdEncoding.EncodeToString(bin.FieldTwo),
+		FieldOneIndex: encodeIndexes(bin.FieldOneIndex),
+		FieldTwoIndex: encodeIndexes(bin.FieldTwoIndex),
+		DataKey:       dataKey,
+	}
+}
+
+func decodeIndexes(indexes map[string]string) (decoded map[string][]byte, err error) {
+	if len(indexes) == 0 {
+		return
+	}
+	decoded = map[string][]byte{}
+	for variant, index := range indexes {
+		decoded[variant], err = hex.DecodeString(index)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func encodeIndexes(indexes map[string][]byte) (encoded map[string]string) {
+	if len(indexes) == 0 {
+		return
+	}
+	encoded = map[string]string{}
+	for variant, index := range indexes {
+		encoded[variant] = hex.EncodeToString(index)
+	}
+	return
+}
+
+// convertObjects re-encodes objects between json (a single object or jsonl)
+// and cbor (a sequence of items) without decrypting anything.
+func convertObjects() {
+	encoding := viper.GetString("encoding")
+	in, err := openBatchInput(viper.GetString("input"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer in.Close()
+	out, err := createBatchOutput(viper.GetString("output"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer out.Close()
+
+	reader := bufio.NewReader(in)
+	writer := bufio.NewWriter(out)
+	next, err := objectDecoder(reader)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	count := 0
+	for {
+		obj, errNext := next()
+		if errNext == io.EOF {
+			break
+		}
+		if errNext != nil {
+			log.Fatalln(errNext)
+		}
+		output, errMarshal := marshalObject(obj, encoding)
+		if errMarshal != nil {
+			log.Fatalln(errMarshal)
+		}
+		if encoding == "cbor" && count > 0 {
+			// the self describe tag only starts the sequence
+			output = bytes.TrimPrefix(output, selfDescribeCBOR)
+		}
+		if encoding != "cbor" {
+			output = append(output, '\n')
+		}
+		_, err = writer.Write(output)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		count++
+	}
+	err = writer.Flush()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.WithFields(log.Fields{
+		"objects":  count,
+		"encoding": encoding,
+	}).Info("convert complete")
+}
+
+// objectDecoder returns a function reading the next object of a json or
+// cbor stream.
+func objectDecoder(reader *bufio.Reader) (next func() (SecureObject, error), err error) {
+	head, err := reader.Peek(1)
+	if err == io.EOF {
+		return func() (SecureObject, error) { return SecureObject{}, io.EOF }, nil
+	}
+	if err != nil {
+		return
+	}
+
+	if bytes.ContainsAny(head, " \t\r\n{") {
+		decoder := json.NewDecoder(reader)
+		return func() (obj SecureObject, err error) {
+			err = decoder.Decode(&obj)
+			if err == nil {
+				err = checkVersion(obj)
+			}
+			return
+		}, nil
+	}
+
+	prefix, err := reader.Peek(len(selfDescribeCBOR))
+	if err == nil && bytes.Equal(prefix, selfDescribeCBOR) {
+		reader.Discard(len(selfDescribeCBOR))
+	}
+	decoder := cbor.NewDecoder(reader)
+	return func() (obj SecureObject, err error) {
+		bin := binaryObject{}
+		err = decoder.Decode(&bin)
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = fmt.Errorf("truncated cbor object: %w", err)
+			}
+			return
+		}
+		obj = fromBinaryObject(bin)
+		err = checkVersion(obj)
+		return
+	}, nil
+}
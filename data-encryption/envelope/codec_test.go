@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func testObject(id string) SecureObject {
+	return SecureObject{
+		Version:       schemaVersion,
+		ID:            id,
+		Tenant:        "acme",
+		FieldOne:      "AQID",
+		FieldTwo:      "BAUG",
+		FieldOneIndex: map[string]string{"full": "00ff", "prefix": "0a"},
+		DataKey:       kekPrefix + "3:BwgJ",
+	}
+}
+
+func TestMarshalObjectRoundTrip(t *testing.T) {
+	for _, encoding := range []string{"json", "cbor"} {
+		obj := testObject("1")
+		output, err := marshalObject(obj, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isCBOR := bytes.HasPrefix(output, selfDescribeCBOR); isCBOR != (encoding == "cbor") {
+			t.Errorf("%s output starts with %x", encoding, output[:3])
+		}
+		decoded, err := unmarshalObject(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, obj) {
+			t.Errorf("%s round trip\n%+v\nwant\n%+v", encoding, decoded, obj)
+		}
+	}
+
+	// objects written before the schema version existed
+	obj := testObject("1")
+	obj.Version = 0
+	output, err := marshalObject(obj, "cbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := unmarshalObject(output)
+	if err != nil || decoded.Version != 1 {
+		t.Errorf("unversioned object decoded as version %d, %v", decoded.Version, err)
+	}
+
+	obj.Version = schemaVersion + 1
+	output, err = marshalObject(obj, "cbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = unmarshalObject(output)
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("newer schema version decoded: %v", err)
+	}
+}
+
+func TestParseWrappedKey(t *testing.T) {
+	for wrapped, want := range map[string]struct {
+		version int
+		sealed  string
+		ok      bool
+	}{
+		"kek:3:BwgJ":  {3, "BwgJ", true},
+		"kek:12:a:b":  {12, "a:b", true},
+		"kek:x:BwgJ":  {0, "", false},
+		"kek:BwgJ":    {0, "", false},
+		"BwgJ":        {0, "", false},
+		"arn:kek:1:a": {0, "", false},
+		"":            {0, "", false},
+	} {
+		version, sealed, ok := parseWrappedKey(wrapped)
+		if version != want.version || sealed != want.sealed || ok != want.ok {
+			t.Errorf("%q split into %d %q %v, want %d %q %v", wrapped, version, sealed, ok, want.version, want.sealed, want.ok)
+		}
+	}
+
+	// the version is kept in its own cbor field
+	obj := testObject("1")
+	obj.DataKey = "BwgJ"
+	bin, err := toBinaryObject(obj)
+	if err != nil || bin.KEKVersion != 0 {
+		t.Errorf("KMS wrapped key has KEK version %d, %v", bin.KEKVersion, err)
+	}
+	if got := fromBinaryObject(bin).DataKey; got != "BwgJ" {
+		t.Errorf("KMS wrapped key decoded as %q", got)
+	}
+}
+
+func TestConvertObjects(t *testing.T) {
+	viper.Reset()
+	dir := t.TempDir()
+	objects := []SecureObject{testObject("1"), testObject("2")}
+	objects[1].Tenant = ""
+	objects[1].FieldOneIndex = nil
+	var jsonl []byte
+	for _, obj := range objects {
+		output, err := marshalObject(obj, "json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonl = append(append(jsonl, output...), '\n')
+	}
+	err := os.WriteFile(filepath.Join(dir, "objects.jsonl"), jsonl, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	convert := func(input, output, encoding string) {
+		viper.Set("input", filepath.Join(dir, input))
+		viper.Set("output", filepath.Join(dir, output))
+		viper.Set("encoding", encoding)
+		convertObjects()
+	}
+	convert("objects.jsonl", "objects.cbor", "cbor")
+	convert("objects.cbor", "converted.jsonl", "json")
+
+	converted, err := os.ReadFile(filepath.Join(dir, "converted.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(converted, jsonl) {
+		t.Errorf("converted back to\n%s\nwant\n%s", converted, jsonl)
+	}
+}
+
+func TestFileStoreReadsMixedEncodings(t *testing.T) {
+	dir := t.TempDir()
+	for encoding, id := range map[string]string{"json": "1", "cbor": "2"} {
+		err := (&fileStore{dir: dir, encoding: encoding}).Put(testObject(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := &fileStore{dir: dir, encoding: "cbor"}
+	ids, err := store.List()
+	if err != nil || !reflect.DeepEqual(ids, []string{"1", "2"}) {
+		t.Fatalf("listed %v, %v", ids, err)
+	}
+	for _, id := range ids {
+		obj, err := store.Get(id)
+		if err != nil || !reflect.DeepEqual(obj, testObject(id)) {
+			t.Errorf("object %s read as %+v, %v", id, obj, err)
+		}
+	}
+}
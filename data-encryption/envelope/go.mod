@@ -4,7 +4,16 @@ go 1.16
 
 require (
 	github.com/aws/aws-sdk-go v1.42.48
+	github.com/fxamacker/cbor/v2 v2.4.0
+	github.com/go-sql-driver/mysql v1.6.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.10.1
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
+	keyprovider v0.0.0
+	secretprovider v0.0.0
 )
+
+replace keyprovider => ../keyprovider
+
+replace secretprovider => ../../credential-manager/secretprovider
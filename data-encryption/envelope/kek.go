@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The key hierarchy is USER-MASTER-KEY (the KMS CMK, or the master key of
+// another key provider) wrapping a KEK per tenant and the app KEK, each KEK
+// wrapping the data keys of its objects.
+// A data key wrapped by a KEK is stored as kek:<version>:<base64>, version
+// 1 tenant keys from before KEK rotation have no prefix. Objects without a
+// tenant keep a data key wrapped by KMS itself until kek-create makes the
+// app KEK.
+
+const kekPrefix = "kek:"
+
+var errNoAppKEK = errors.New("no app KEK")
+
+var (
+	tenantMu sync.Mutex
+	// keks caches the unwrapped KEK versions per tenant, "" being the app
+	// KEK, and current the version new data keys are wrapped with. Both
+	// are dropped when another process replaces the keystore file they
+	// were loaded from, so a running server stops opening the objects of a
+	// tenant as soon as tenant-shred deletes its KEK.
+	keks          = map[string]map[int][]byte{}
+	current       = map[string]int{}
+	keystoreStamp os.FileInfo
+)
+
+func (k tenantKey) currentVersion() int {
+	if k.Version == 0 {
+		return 1
+	}
+	return k.Version
+}
+
+// wrappedKEK returns the KEK of a version, wrapped by USER-MASTER-KEY.
+func (k tenantKey) wrappedKEK(version int) (string, bool) {
+	if version == k.currentVersion() {
+		return k.KEK, true
+	}
+	for _, previous := range k.Previous {
+		if previous.Version == version {
+			return previous.KEK, true
+		}
+	}
+	return "", false
+}
+
+func keystoreEntry(keystore tenantKeystore, tenant string) (entry tenantKey, err error) {
+	if tenant == "" {
+		if keystore.App == nil {
+			return entry, errNoAppKEK
+		}
+		return *keystore.App, nil
+	}
+	entry, ok := keystore.Tenants[tenant]
+	if !ok {
+		return entry, fmt.Errorf("%w %s", errUnknownTenant, tenant)
+	}
+	return
+}
+
+func setKeystoreEntry(keystore *tenantKeystore, tenant string, entry tenantKey) {
+	if tenant == "" {
+		keystore.App = &entry
+		return
+	}
+	keystore.Tenants[tenant] = entry
+}
+
+func kekName(tenant string) string {
+	if tenant == "" {
+		return "app"
+	}
+	return tenant
+}
+
+// newKEK generates a KEK and returns it wrapped by USER-MASTER-KEY.
+func newKEK() (wrapped string, err error) {
+	_, kek, err := generateDataKey()
+	if err != nil {
+		return
+	}
+	return base64.StdEncoding.EncodeToString(kek), nil
+}
+
+// createKEK creates the KEK of a tenant, or the app KEK without a tenant.
+func createKEK(tenant string) {
+	tenantMu.Lock()
+	defer tenantMu.Unlock()
+
+	keystore, err := readKeystore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	_, err = keystoreEntry(keystore, tenant)
+	if err == nil {
+		log.Fatalf("KEK of %s already exists", kekName(tenant))
+	}
+	wrapped, err := newKEK()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	setKeystoreEntry(&keystore, tenant, tenantKey{
+		KEK:     wrapped,
+		Version: 1,
+		Created: time.Now().UTC(),
+	})
+	err = writeKeystore(keystore)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.WithField("kek", kekName(tenant)).Info("KEK created")
+}
+
+// rotateKEK makes a new KEK version current. Data keys wrapped by older
+// versions still open until kek-prune, rewrap-store moves them over.
+func rotateKEK(tenant string) {
+	tenantMu.Lock()
+	defer tenantMu.Unlock()
+
+	keystore, err := readKeystore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	entry, err := keystoreEntry(keystore, tenant)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	wrapped, err := newKEK()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	entry.Previous = append(entry.Previous, kekVersion{
+		Version: entry.currentVersion(),
+		KEK:     entry.KEK,
+		Created: entry.Created,
+	})
+	entry.Version = entry.currentVersion() + 1
+	entry.KEK = wrapped
+	entry.Created = time.Now().UTC()
+	setKeystoreEntry(&keystore, tenant, entry)
+	err = writeKeystore(keystore)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	delete(current, tenant)
+	log.WithFields(log.Fields{
+		"kek":     kekName(tenant),
+		"version": entry.Version,
+	}).Info("KEK rotated")
+}
+
+// pruneKEK drops the rotated out versions of a KEK, refusing while an
+// object in the store still has a data key wrapped by one of them.
+func pruneKEK(tenant string) {
+	store := openStore()
+	ids, err := store.List()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	tenantMu.Lock()
+	defer tenantMu.Unlock()
+	keystore, err := readKeystore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	entry, err := keystoreEntry(keystore, tenant)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	stale := 0
+	for _, id := range ids {
+		obj, errGet := store.Get(id)
+		if errGet != nil {
+			log.Fatalln(errGet)
+		}
+		if obj.Tenant != tenant {
+			continue
+		}
+		version, _, ok := parseWrappedKey(obj.DataKey)
+		if !ok {
+			if tenant == "" {
+				continue
+			}
+			version = 1
+		}
+		if version != entry.currentVersion() {
+			stale++
+		}
+	}
+	if stale > 0 {
+		log.Fatalf("%d objects still use an old KEK version of %s, run rewrap-store first", stale, kekName(tenant))
+	}
+
+	entry.Previous = nil
+	setKeystoreEntry(&keystore, tenant, entry)
+	err = writeKeystore(keystore)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	delete(keks, tenant)
+	log.WithField("kek", kekName(tenant)).Info("KEK pruned")
+}
+
+// rewrapStore rewraps the data key of every object in the store that isn't
+// wrapped by the current KEK version. Objects without a tenant wrapped by
+// KMS are moved under the app KEK when there is one. Objects of a shredded
+// tenant are left as they are and counted apart.
+func rewrapStore() {
+	log.WithField("status", "starting").Info("rewrapStore")
+	store := openStore()
+	ids, err := store.List()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	rewrapped, shredded := 0, 0
+	for _, id := range ids {
+		obj, errGet := store.Get(id)
+		if errGet != nil {
+			log.Fatalln(errGet)
+		}
+		_, version, errCurrent := currentKEK(obj.Tenant)
+		if errors.Is(errCurrent, errNoAppKEK) {
+			continue
+		}
+		if errors.Is(errCurrent, errUnknownTenant) {
+			log.WithFields(log.Fields{"id": id, "tenant": obj.Tenant}).Warn("object is crypto-shredded, skipped")
+			shredded++
+			continue
+		}
+		if errCurrent != nil {
+			log.Fatalln(errCurrent)
+		}
+		wrappedVersion, _, ok := parseWrappedKey(obj.DataKey)
+		if ok && wrappedVersion == version {
+			continue
+		}
+
+		obj.DataKey, err = rewrapObjectKey(obj)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = store.Put(obj)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		rewrapped++
+	}
+	log.WithFields(log.Fields{
+		"status":   "success",
+		"objects":  rewrapped,
+		"shredded": shredded,
+	}).Info("rewrapStore")
+}
+
+// loadKEK reads the keystore entry of a tenant into the cache, unwrapping
+// only the version asked for.
+func loadKEK(tenant string, version int) (kek []byte, err error) {
+	keystore, err := readKeystore()
+	if err != nil {
+		return
+	}
+	entry, err := keystoreEntry(keystore, tenant)
+	if errors.Is(err, errNoAppKEK) {
+		current[tenant] = 0
+	}
+	if err != nil {
+		return
+	}
+	current[tenant] = entry.currentVersion()
+	if version == 0 {
+		version = entry.currentVersion()
+	}
+	if kek = keks[tenant][version]; kek != nil {
+		return
+	}
+
+	wrapped, ok := entry.wrappedKEK(version)
+	if !ok {
+		return nil, fmt.Errorf("KEK of %s has no version %d", kekName(tenant), version)
+	}
+	blob, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return
+	}
+	kek, err = decryptDataKey(blob)
+	if err != nil {
+		return
+	}
+	if keks[tenant] == nil {
+		keks[tenant] = map[int][]byte{}
+	}
+	keks[tenant][version] = kek
+	return
+}
+
+// refreshKEKs drops the cached KEKs when the keystore file changed since
+// they were loaded, writeKeystore always replaces it with a new file.
+func refreshKEKs() error {
+	info, err := os.Stat(keystorePath())
+	if errors.Is(err, os.ErrNotExist) {
+		info, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	if keystoreStamp == nil && info == nil || keystoreStamp != nil && info != nil &&
+		os.SameFile(keystoreStamp, info) && keystoreStamp.ModTime().Equal(info.ModTime()) &&
+		keystoreStamp.Size() == info.Size() {
+		return nil
+	}
+	keks = map[string]map[int][]byte{}
+	current = map[string]int{}
+	keystoreStamp = info
+	return nil
+}
+
+// currentKEK returns the KEK version new data keys of a tenant are wrapped
+// with, errNoAppKEK for objects without a tenant before kek-create.
+func currentKEK(tenant string) (kek []byte, version int, err error) {
+	tenantMu.Lock()
+	defer tenantMu.Unlock()
+	err = refreshKEKs()
+	if err != nil {
+		return
+	}
+	version, ok := current[tenant]
+	if ok {
+		if version == 0 {
+			return nil, 0, errNoAppKEK
+		}
+		if kek = keks[tenant][version]; kek != nil {
+			return
+		}
+	}
+	kek, err = loadKEK(tenant, 0)
+	return kek, current[tenant], err
+}
+
+func versionKEK(tenant string, version int) (kek []byte, err error) {
+	tenantMu.Lock()
+	defer tenantMu.Unlock()
+	err = refreshKEKs()
+	if err != nil {
+		return
+	}
+	if kek = keks[tenant][version]; kek != nil {
+		return
+	}
+	return loadKEK(tenant, version)
+}
+
+// parseWrappedKey splits a KEK wrapped data key into its KEK version and
+// sealed key.
+func parseWrappedKey(wrapped string) (version int, sealed string, ok bool) {
+	if !strings.HasPrefix(wrapped, kekPrefix) {
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(wrapped, kekPrefix), ":", 2)
+	if len(parts) != 2 {
+		return
+	}
+	version, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return
+	}
+	return version, parts[1], true
+}
+
+// newDataKey creates the data key of an object, wrapped by the current KEK
+// of its tenant with the tenant as additional data, or by KMS for objects
+// without a tenant when there is no app KEK.
+func newDataKey(tenant string) (plaintext []byte, wrapped string, err error) {
+	kek, version, err := currentKEK(tenant)
+	if errors.Is(err, errNoAppKEK) {
+		dataKey, blob, errKMS := generateDataKey()
+		if errKMS != nil {
+			return nil, "", errKMS
+		}
+		return dataKey, base64.StdEncoding.EncodeToString(blob), nil
+	}
+	if err != nil {
+		return
+	}
+
+	plaintext = make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, plaintext)
+	if err != nil {
+		return
+	}
+	wrapped, err = wrapDataKey(kek, version, plaintext, tenant)
+	return
+}
+
+func openDataKey(tenant, wrapped string) (plaintext []byte, err error) {
+	version, sealed, ok := parseWrappedKey(wrapped)
+	if !ok {
+		if tenant == "" {
+			blob, errDecode := base64.StdEncoding.DecodeString(wrapped)
+			if errDecode != nil {
+				return nil, errDecode
+			}
+			return decryptDataKey(blob)
+		}
+		version, sealed = 1, wrapped
+	}
+
+	kek, err := versionKEK(tenant, version)
+	if err != nil {
+		return
+	}
+	return openKey(kek, sealed, tenant)
+}
+
+func wrapDataKey(kek []byte, version int, plaintext []byte, tenant string) (wrapped string, err error) {
+	sealed, err := sealKey(kek, plaintext, tenant)
+	if err != nil {
+		return
+	}
+	return kekPrefix + strconv.Itoa(version) + ":" + sealed, nil
+}
+
+// rewrapObjectKey wraps the data key of an object under the current KEK of
+// its tenant, or the current master key when there is no app KEK, leaving
+// the fields untouched.
+func rewrapObjectKey(obj SecureObject) (datakey string, err error) {
+	kek, version, err := currentKEK(obj.Tenant)
+	if errors.Is(err, errNoAppKEK) {
+		if _, _, ok := parseWrappedKey(obj.DataKey); ok {
+			return "", err
+		}
+		blob, errDecode := base64.StdEncoding.DecodeString(obj.DataKey)
+		if errDecode != nil {
+			return "", errDecode
+		}
+		rewrapped, errRewrap := rewrapDataKey(blob)
+		if errRewrap != nil {
+			return "", errRewrap
+		}
+		return base64.StdEncoding.EncodeToString(rewrapped), nil
+	}
+	if err != nil {
+		return
+	}
+
+	plaintext, err := openDataKey(obj.Tenant, obj.DataKey)
+	if err != nil {
+		return
+	}
+	return wrapDataKey(kek, version, plaintext, obj.Tenant)
+}
+
+func sealKey(kek, key []byte, aad string) (wrapped string, err error) {
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return
+	}
+	wrapped = base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, key, []byte(aad)))
+	return
+}
+
+func openKey(kek []byte, wrapped, aad string) (key []byte, err error) {
+	blob, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return
+	}
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return
+	}
+	if len(blob) < gcm.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	return gcm.Open(nil, blob[:gcm.NonceSize()], blob[gcm.NonceSize():], []byte(aad))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestRewrapStoreSkipsShreddedTenants(t *testing.T) {
+	useLocalKeys(t)
+	dir := t.TempDir()
+	viper.Set("STORE-DIR", dir)
+	viper.Set("output", filepath.Join(t.TempDir(), "shred-report.json"))
+	createKEK("acme")
+	createKEK("beta")
+
+	store := openStore()
+	keys := newDataKeyPolicy("record", 1)
+	for _, record := range []plainRecord{
+		{ID: "1", Tenant: "acme", Text1: "a"},
+		{ID: "2", Tenant: "beta", Text1: "b"},
+	} {
+		obj, err := sealRecord(record, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.Put(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	shredded, err := store.Get("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shredTenant("beta", dir)
+	rotateKEK("acme")
+	rewrapStore()
+
+	obj, err := store.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _, _ := parseWrappedKey(obj.DataKey); version != 2 {
+		t.Errorf("object of acme wrapped by KEK version %d, want 2", version)
+	}
+	obj, err = store.Get("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.DataKey != shredded.DataKey {
+		t.Error("object of the shredded tenant was rewrapped")
+	}
+}
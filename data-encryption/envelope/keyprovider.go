@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// keyProvider holds the master keys, USER-MASTER-KEY names the one new
+// data keys are wrapped with.
+type keyProvider interface {
+	GenerateDataKey() (plaintext, wrapped []byte, err error)
+	DecryptDataKey(wrapped []byte) (plaintext []byte, err error)
+	RewrapDataKey(wrapped []byte) (rewrapped []byte, err error)
+}
+
+var (
+	providerOnce sync.Once
+	provider     keyProvider
+)
+
+// keys returns the provider selected by KEY-PROVIDER, "kms" (default),
+// "local", "pkcs11" or "vault".
+func keys() keyProvider {
+	providerOnce.Do(func() {
+		switch viper.GetString("KEY-PROVIDER") {
+		case "", "kms":
+			provider = kmsKeys{}
+		case "local":
+			provider = &localKeys{}
+		case "pkcs11":
+			var err error
+			provider, err = newPKCS11Keys()
+			if err != nil {
+				log.Fatalln(err)
+			}
+		case "vault":
+			provider = newVaultKeys()
+		default:
+			log.Fatalf("unknown key provider %q", viper.GetString("KEY-PROVIDER"))
+		}
+	})
+	return provider
+}
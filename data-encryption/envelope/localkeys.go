@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// The local key provider keeps its keys in the LOCAL-KEYRING file, each
+// sealed by a master key that is never stored next to it: it is read from
+// LOCAL-MASTER-KEY-FILE, or combined in memory from Shamir shares given
+// with --share-files for the duration of one run.
+//
+//	--mode keys-init --shares 5 --threshold 3 --share-dir shares
+//	--mode enc --id 1 --text1 a --text2 b --share-files shares/share-1.txt,shares/share-4.txt,shares/share-5.txt
+
+type keyring struct {
+	MasterKey *keyringMaster           `json:"master-key"`
+	Keys      map[string]keyringKey    `json:"keys"`
+	Imports   map[string]keyringImport `json:"imports,omitempty"`
+}
+
+// keyringMaster identifies the master key without revealing it, Check is
+// an HMAC of a fixed label under the master key. ShareSet tells the shares
+// of its last split from those of earlier ones.
+type keyringMaster struct {
+	ID        string    `json:"id"`
+	Check     string    `json:"check"`
+	Shares    int       `json:"shares,omitempty"`
+	Threshold int       `json:"threshold,omitempty"`
+	ShareSet  string    `json:"share-set,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+type keyringKey struct {
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// sharePrefix starts every share, followed by the master key id, the share
+// set, the threshold, the index and the hex of the share, colon separated.
+const sharePrefix = "envelope-share:v2:"
+
+// localWrappedKey marks a data key wrapped by the local provider, followed
+// by the length and name of the keyring key, the nonce and the sealed key.
+const localWrappedKey = 'L'
+
+type localKeys struct {
+	mu     sync.Mutex
+	master []byte
+	keys   map[string][]byte
+}
+
+// localProvider returns the local provider for the keys-* modes.
+func localProvider() *localKeys {
+	l, ok := keys().(*localKeys)
+	if !ok {
+		log.Fatalln("keys-* modes need KEY-PROVIDER local")
+	}
+	return l
+}
+
+func keyringPath() string {
+	path := viper.GetString("LOCAL-KEYRING")
+	if path == "" {
+		path = "keyring.json"
+	}
+	return path
+}
+
+func readKeyring() (ring keyring, err error) {
+	ring.Keys = map[string]keyringKey{}
+	source, err := os.ReadFile(keyringPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return ring, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(source, &ring)
+	if ring.Keys == nil {
+		ring.Keys = map[string]keyringKey{}
+	}
+	return
+}
+
+func writeKeyring(ring keyring) (err error) {
+	output, err := json.MarshalIndent(ring, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := keyringPath() + ".tmp"
+	err = os.WriteFile(tmp, output, 0600)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, keyringPath())
+}
+
+func masterKeyCheck(master []byte) string {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte("envelope-local-master-key"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// masterKey reads or combines the master key once per run and checks it
+// against the keyring.
+func (l *localKeys) masterKey() (master []byte, err error) {
+	if l.master != nil {
+		return l.master, nil
+	}
+	ring, err := readKeyring()
+	if err != nil {
+		return
+	}
+	if ring.MasterKey == nil {
+		return nil, fmt.Errorf("keyring %s has no master key, run keys-init", keyringPath())
+	}
+
+	if viper.GetString("share-files") != "" {
+		master, err = combineShareFiles(ring.MasterKey, viper.GetString("share-files"))
+	} else if viper.GetString("LOCAL-MASTER-KEY-FILE") != "" {
+		master, err = os.ReadFile(viper.GetString("LOCAL-MASTER-KEY-FILE"))
+	} else {
+		err = errors.New("the local master key needs --share-files or LOCAL-MASTER-KEY-FILE")
+	}
+	if err != nil {
+		return
+	}
+	if !hmac.Equal([]byte(masterKeyCheck(master)), []byte(ring.MasterKey.Check)) {
+		return nil, errors.New("wrong local master key")
+	}
+	l.master = master
+	return
+}
+
+// key unwraps a keyring key with the master key and keeps it in memory.
+func (l *localKeys) key(name string) (key []byte, err error) {
+	if key = l.keys[name]; key != nil {
+		return
+	}
+	master, err := l.masterKey()
+	if err != nil {
+		return
+	}
+	ring, err := readKeyring()
+	if err != nil {
+		return
+	}
+	entry, ok := ring.Keys[name]
+	if !ok {
+		return nil, fmt.Errorf("keyring %s has no key %s", keyringPath(), name)
+	}
+	key, err = openKey(master, entry.Key, name)
+	if err != nil {
+		return
+	}
+	if l.keys == nil {
+		l.keys = map[string][]byte{}
+	}
+	l.keys[name] = key
+	return
+}
+
+func (l *localKeys) GenerateDataKey() (plaintext, wrapped []byte, err error) {
+	plaintext = make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, plaintext)
+	if err != nil {
+		return
+	}
+	wrapped, err = l.wrap(plaintext)
+	return
+}
+
+func (l *localKeys) wrap(plaintext []byte) (wrapped []byte, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	name := viper.GetString("USER-MASTER-KEY")
+	if len(name) > 255 {
+		return nil, errors.New("key name too long")
+	}
+	key, err := l.key(name)
+	if err != nil {
+		return
+	}
+	sealed, err := sealKey(key, plaintext, name)
+	if err != nil {
+		return
+	}
+	blob, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return
+	}
+	wrapped = append([]byte{localWrappedKey, byte(len(name))}, name...)
+	return append(wrapped, blob...), nil
+}
+
+func (l *localKeys) DecryptDataKey(wrapped []byte) (plaintext []byte, err error) {
+	if len(wrapped) < 2 || wrapped[0] != localWrappedKey || len(wrapped) < 2+int(wrapped[1]) {
+		return nil, errors.New("not a local wrapped key")
+	}
+	name := string(wrapped[2 : 2+int(wrapped[1])])
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key, err := l.key(name)
+	if err != nil {
+		return
+	}
+	return openKey(key, base64.StdEncoding.EncodeToString(wrapped[2+len(name):]), name)
+}
+
+func (l *localKeys) RewrapDataKey(wrapped []byte) (rewrapped []byte, err error) {
+	plaintext, err := l.DecryptDataKey(wrapped)
+	if err != nil {
+		return
+	}
+	return l.wrap(plaintext)
+}
+
+// initKeyring creates the master key and the keyring key USER-MASTER-KEY.
+// The master key is split into shares with --shares and --threshold,
+// otherwise written to LOCAL-MASTER-KEY-FILE.
+func initKeyring() {
+	ring, err := readKeyring()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if ring.MasterKey != nil {
+		log.Fatalf("keyring %s already has a master key", keyringPath())
+	}
+	count, threshold := viper.GetInt("shares"), viper.GetInt("threshold")
+	keyFile := viper.GetString("LOCAL-MASTER-KEY-FILE")
+	if count == 0 && keyFile == "" {
+		log.Fatalln("keys-init needs --shares and --threshold or LOCAL-MASTER-KEY-FILE")
+	}
+
+	master := make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, master)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	check := masterKeyCheck(master)
+	ring.MasterKey = &keyringMaster{ID: check[:16], Check: check, Created: time.Now().UTC()}
+
+	if count > 0 {
+		err = writeShares(ring.MasterKey, master, count, threshold)
+	} else {
+		err = writeNewFile(keyFile, master)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if name := viper.GetString("USER-MASTER-KEY"); name != "" {
+		err = addKeyringKey(&ring, master, name)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	err = writeKeyring(ring)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	wipe(master)
+	log.WithField("master-key", ring.MasterKey.ID).Info("keyring created")
+}
+
+// createKeyringKey adds a key to the keyring, it can then be used as
+// USER-MASTER-KEY.
+func createKeyringKey(name string) {
+	if name == "" {
+		log.Fatalln("key-id is required")
+	}
+	l := localProvider()
+	master, err := l.masterKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ring, err := readKeyring()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = addKeyringKey(&ring, master, name)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = writeKeyring(ring)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.WithField("key-id", name).Info("key created")
+}
+
+func addKeyringKey(ring *keyring, master []byte, name string) (err error) {
+	if _, ok := ring.Keys[name]; ok {
+		return fmt.Errorf("keyring already has a key %s", name)
+	}
+	key := make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return
+	}
+	sealed, err := sealKey(master, key, name)
+	if err != nil {
+		return
+	}
+	wipe(key)
+	ring.Keys[name] = keyringKey{Key: sealed, Created: time.Now().UTC()}
+	return
+}
+
+// splitMasterKey splits the current master key, read from its file or
+// combined from shares, into a new set of shares. The shares of an earlier
+// split no longer combine, the keyring only accepts the latest set, so the
+// new shares must be handed out before they are needed. Destroy the key
+// file once they are.
+func splitMasterKey() {
+	l := localProvider()
+	master, err := l.masterKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ring, err := readKeyring()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = writeShares(ring.MasterKey, master, viper.GetInt("shares"), viper.GetInt("threshold"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = writeKeyring(ring)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.WithFields(log.Fields{
+		"master-key": ring.MasterKey.ID,
+		"shares":     ring.MasterKey.Shares,
+		"threshold":  ring.MasterKey.Threshold,
+	}).Info("master key split")
+}
+
+// combineMasterKey checks that the given shares combine to the master key
+// of the keyring. The key itself is only held in memory.
+func combineMasterKey() {
+	if viper.GetString("share-files") == "" {
+		log.Fatalln("share-files is required")
+	}
+	l := localProvider()
+	_, err := l.masterKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ring, err := readKeyring()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.WithField("master-key", ring.MasterKey.ID).Info("shares combine to the master key")
+}
+
+// writeShares splits the master key and writes every share to its own file
+// in --share-dir, or prints them when no directory is given.
+func writeShares(meta *keyringMaster, master []byte, count, threshold int) (err error) {
+	shares, err := splitSecret(master, count, threshold)
+	if err != nil {
+		return
+	}
+	set := make([]byte, 8)
+	_, err = io.ReadFull(rand.Reader, set)
+	if err != nil {
+		return
+	}
+	meta.Shares, meta.Threshold, meta.ShareSet = count, threshold, hex.EncodeToString(set)
+
+	dir := viper.GetString("share-dir")
+	for i, share := range shares {
+		x := i + 1
+		line := fmt.Sprintf("%s%s:%s:%d:%d:%s", sharePrefix, meta.ID, meta.ShareSet, threshold, x, hex.EncodeToString(share))
+		wipe(share)
+		if dir == "" {
+			fmt.Println(line)
+			continue
+		}
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return
+		}
+		err = writeNewFile(filepath.Join(dir, fmt.Sprintf("share-%d.txt", x)), []byte(line+"\n"))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// combineShareFiles reads shares from a comma separated list of files, "-"
+// reads share lines from stdin until the threshold is reached. Every share
+// must come from the last split of the master key in the keyring, shares of
+// different splits don't combine.
+func combineShareFiles(meta *keyringMaster, files string) (master []byte, err error) {
+	if meta.ShareSet == "" || meta.Threshold < 2 {
+		return nil, fmt.Errorf("master key %s is not split into shares", meta.ID)
+	}
+	var lines []string
+	for _, file := range strings.Split(files, ",") {
+		file = strings.TrimSpace(file)
+		if file == "-" {
+			log.Infof("enter %d shares of master key %s, one per line", meta.Threshold, meta.ID)
+			scanner := bufio.NewScanner(os.Stdin)
+			for len(lines) < meta.Threshold && scanner.Scan() {
+				if line := strings.TrimSpace(scanner.Text()); line != "" {
+					lines = append(lines, line)
+				}
+			}
+			continue
+		}
+		source, errRead := os.ReadFile(file)
+		if errRead != nil {
+			return nil, errRead
+		}
+		lines = append(lines, strings.TrimSpace(string(source)))
+	}
+
+	shares := map[byte][]byte{}
+	defer func() {
+		for _, share := range shares {
+			wipe(share)
+		}
+	}()
+	for _, line := range lines {
+		fields := strings.Split(strings.TrimPrefix(line, sharePrefix), ":")
+		if !strings.HasPrefix(line, sharePrefix) || len(fields) != 5 {
+			return nil, errors.New("invalid share")
+		}
+		if fields[0] != meta.ID {
+			return nil, fmt.Errorf("share of master key %s, not %s", fields[0], meta.ID)
+		}
+		if fields[1] != meta.ShareSet {
+			return nil, fmt.Errorf("share of an earlier split of master key %s", meta.ID)
+		}
+		if fields[2] != strconv.Itoa(meta.Threshold) {
+			return nil, fmt.Errorf("share with threshold %s, master key %s needs %d", fields[2], meta.ID, meta.Threshold)
+		}
+		x, errIndex := strconv.Atoi(fields[3])
+		if errIndex != nil || x < 1 || x > 255 {
+			return nil, errors.New("invalid share index")
+		}
+		if _, ok := shares[byte(x)]; ok {
+			return nil, fmt.Errorf("share %d given twice", x)
+		}
+		shares[byte(x)], err = hex.DecodeString(fields[4])
+		if err != nil {
+			return
+		}
+	}
+	if len(shares) < meta.Threshold {
+		return nil, fmt.Errorf("%d of %d shares given", len(shares), meta.Threshold)
+	}
+	return combineShares(shares)
+}
+
+// writeNewFile refuses to overwrite, an overwritten master key or share
+// can't be recovered.
+func writeNewFile(path string, content []byte) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	_, err = f.Write(content)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	return
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// splitTestMaster splits a master key into 3 shares with a threshold of 2,
+// returning the share files.
+func splitTestMaster(t *testing.T, meta *keyringMaster, master []byte) []string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "shares")
+	viper.Set("share-dir", dir)
+	err := writeShares(meta, master, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, name := range []string{"share-1.txt", "share-2.txt", "share-3.txt"} {
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files
+}
+
+func TestCombineShareFiles(t *testing.T) {
+	viper.Reset()
+	master := bytes.Repeat([]byte{42}, 32)
+	meta := &keyringMaster{ID: "0123456789abcdef"}
+	earlier := splitTestMaster(t, meta, master)
+	files := splitTestMaster(t, meta, master)
+
+	combined, err := combineShareFiles(meta, files[0]+","+files[2])
+	if err != nil || !bytes.Equal(combined, master) {
+		t.Fatalf("combined %x, %v", combined, err)
+	}
+
+	// a share with its threshold lowered to 1
+	lowered := filepath.Join(t.TempDir(), "lowered.txt")
+	share, err := os.ReadFile(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Split(string(share), ":")
+	fields[4] = "1"
+	err = os.WriteFile(lowered, []byte(strings.Join(fields, ":")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, test := range map[string]struct {
+		files string
+		err   string
+	}{
+		"earlier split":     {files[0] + "," + earlier[1], "earlier split"},
+		"lowered threshold": {lowered, "threshold 1"},
+		"same share twice":  {files[0] + "," + files[0], "given twice"},
+		"below threshold":   {files[0], "1 of 2 shares"},
+	} {
+		_, err = combineShareFiles(meta, test.files)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want %q", name, err, test.err)
+		}
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -18,6 +20,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"secretprovider"
 )
 
 func init() {
@@ -38,93 +41,275 @@ func init() {
 	flag.String("text2", "", "input your text")
 	flag.String("ciphertext", "", "input your text")
 	flag.String("id", "", "input your text")
+	flag.String("tenant", "", "tenant owning the objects")
+	flag.String("objects", ".", "directory searched for objects of a shredded tenant")
+	flag.String("fields", "", "comma separated fields to decrypt, all allowed fields by default")
+	flag.String("role", "", "role decrypting, only the fields of the role in FIELD-POLICY are decrypted")
+	flag.String("field", "", "field to look up")
+	flag.String("variant", "full", "blind index variant to look up")
+	flag.String("value", "", "plaintext value to look up")
+	flag.String("encoding", "json", "object encoding, json or cbor")
+	flag.String("input", "-", "batch input file, jsonl or csv")
+	flag.String("output", "-", "batch output file")
+	flag.String("errors", "stderr", "batch error report file")
+	flag.String("format", "", "batch format, jsonl or csv, taken from the input extension by default")
+	flag.Int("workers", runtime.NumCPU(), "batch workers")
+	flag.String("datakey-policy", "count", "batch data key sharing: record, count or batch")
+	flag.Int("datakey-count", 1000, "records sharing one data key with the count policy")
+	flag.String("key-id", "", "local keyring key to create")
+	flag.Int("shares", 0, "number of shares the local master key is split into")
+	flag.Int("threshold", 0, "number of shares needed to combine the local master key")
+	flag.String("share-dir", "", "directory the shares are written to, printed when empty")
+	flag.String("public-key", "", "RSA public key a local key is exported under")
+	flag.Bool("replace", false, "keys-import replaces an existing local key of the same name, data keys it wrapped no longer open")
+	flag.String("share-files", "", "comma separated share files combined into the local master key, - reads stdin")
 
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
 	viper.BindPFlags(pflag.CommandLine)
+	secretprovider.InstallRedactor(viper.GetViper())
+	secretprovider.DefaultRedactor.Add(viper.GetString("DB-PASSWORD"), viper.GetString("VAULT.TOKEN"), viper.GetString("PKCS11.PIN"))
 
 	log.WithField("status", "success").Debug("initialize")
 }
 
 func main() {
 	log.WithField("region", viper.GetString("region")).Info("region")
-	if viper.Get("mode") == "enc" {
-		dataKey := generateDataKey()
-		ciphertextOne, _ := encrypt(
-			viper.GetString("text1"),
-			dataKey.Plaintext)
-		ciphertextTwo, _ := encrypt(
-			viper.GetString("text2"),
-			dataKey.Plaintext)
+	switch viper.Get("mode") {
+	case "enc":
+		dataKey, wrapped, err := newDataKey(viper.GetString("tenant"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		ciphertextOne, _ := sealField(
+			dataKey,
+			viper.GetString("id"),
+			"field-one",
+			viper.GetString("text1"))
+		ciphertextTwo, _ := sealField(
+			dataKey,
+			viper.GetString("id"),
+			"field-two",
+			viper.GetString("text2"))
 
 		createOutput(
 			viper.GetString("id"),
+			viper.GetString("tenant"),
 			ciphertextOne,
 			ciphertextTwo,
-			base64.StdEncoding.EncodeToString(dataKey.CiphertextBlob),
+			wrapped,
+			blindIndexes("field-one", viper.GetString("text1")),
+			blindIndexes("field-two", viper.GetString("text2")),
 		)
 
 		log.Info("encrypt complete")
-	} else if viper.Get("mode") == "dec" {
+	case "dec":
 		t := time.Now()
-		obj := readObject(viper.GetString("ciphertext"))
-
-		datakeyByte, _ := base64.StdEncoding.DecodeString(obj.DataKey)
-		dataKeyPlain := decryptDataKey(datakeyByte)
+		var obj SecureObject
+		if viper.GetString("ciphertext") != "" {
+			obj = readObject(viper.GetString("ciphertext"))
+		} else {
+			var err error
+			obj, err = openStore().Get(viper.GetString("id"))
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+
+		fields, err := decryptableFields(viper.GetString("role"), requestedFields(viper.GetString("fields")))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cache := &dataKeyCache{keys: map[string]*cachedDataKey{}}
+		record, err := openRecord(obj, cache, viper.GetString("role"), fields)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		logFields := log.Fields{}
+		for _, field := range fields {
+			if field == "field-one" {
+				logFields["Field One"] = record.Text1
+			} else {
+				logFields["Field Two"] = record.Text2
+			}
+		}
+		log.WithFields(logFields).Info("decrypt complete")
 
-		plaintextOne, _ := decrypt(obj.FieldOne, dataKeyPlain)
-		plaintextTwo, _ := decrypt(obj.FieldOne, dataKeyPlain)
+		log.WithField("time(ms)", time.Since(t).Milliseconds()).Info("decrypt total time")
+	case "enc-batch", "dec-batch":
+		runBatch(viper.GetString("mode"))
+	case "list":
+		ids, err := openStore().List()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+	case "delete":
+		err := openStore().Delete(viper.GetString("id"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.WithField("id", viper.GetString("id")).Info("delete complete")
+	case "convert":
+		convertObjects()
+	case "serve":
+		serve()
+	case "tenant-create":
+		if viper.GetString("tenant") == "" {
+			log.Fatalln("tenant is required")
+		}
+		createKEK(viper.GetString("tenant"))
+	case "kek-create":
+		createKEK(viper.GetString("tenant"))
+	case "kek-rotate":
+		rotateKEK(viper.GetString("tenant"))
+	case "kek-prune":
+		pruneKEK(viper.GetString("tenant"))
+	case "rewrap-store":
+		rewrapStore()
+	case "tenant-shred":
+		shredTenant(viper.GetString("tenant"), viper.GetString("objects"))
+	case "keys-init":
+		initKeyring()
+	case "keys-create":
+		createKeyringKey(viper.GetString("key-id"))
+	case "keys-import-params":
+		createImportParams(viper.GetString("key-id"))
+	case "keys-import":
+		importKey(viper.GetString("key-id"))
+	case "keys-export":
+		exportKey(viper.GetString("key-id"))
+	case "keys-split":
+		splitMasterKey()
+	case "keys-combine":
+		combineMasterKey()
+	case "hsm-key-create":
+		createHSMKey(viper.GetString("key-id"))
+	case "index-key":
+		createIndexKey()
+	case "lookup":
+		field, variant, value := viper.GetString("field"), viper.GetString("variant"), viper.GetString("value")
+		if store, ok := openStore().(*mysqlStore); ok {
+			ids, err := store.Lookup(field, variant, value)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			log.WithField("ids", ids).Info("lookup")
+			return
+		}
+		clause, args, err := blindIndexWhere(field, variant, value)
+		if err != nil {
+			log.Fatalln(err)
+		}
 
 		log.WithFields(log.Fields{
-			"Field One": plaintextOne,
-			"Field Two": plaintextTwo,
-		}).Info("decrypt complete")
-
-		log.WithField("time(ms)", time.Since(t).Milliseconds()).Info("decrypt total time")
+			"where": clause,
+			"args":  args,
+		}).Info("lookup")
 	}
 }
 
-func generateDataKey() *kms.GenerateDataKeyOutput {
-	t := time.Now()
-	region := viper.GetString("REGION")
-	svc := kms.New(session.New(),
-		aws.NewConfig().WithRegion(region))
+var (
+	kmsOnce sync.Once
+	kmsSvc  *kms.KMS
+)
 
+// kmsClient shares one KMS client between every data key request.
+func kmsClient() *kms.KMS {
+	kmsOnce.Do(func() {
+		region := viper.GetString("REGION")
+		kmsSvc = kms.New(session.New(),
+			aws.NewConfig().WithRegion(region))
+	})
+	return kmsSvc
+}
+
+// kmsKeys wraps data keys with the KMS key USER-MASTER-KEY.
+type kmsKeys struct{}
+
+func (kmsKeys) GenerateDataKey() (plaintext, wrapped []byte, err error) {
 	input := &kms.GenerateDataKeyInput{
 		KeyId:   aws.String(viper.GetString("USER-MASTER-KEY")),
 		KeySpec: aws.String("AES_256"),
 	}
+	result, err := kmsClient().GenerateDataKey(input)
+	if err != nil {
+		return
+	}
+	return result.Plaintext, result.CiphertextBlob, nil
+}
 
-	result, err := svc.GenerateDataKey(input)
+func (kmsKeys) DecryptDataKey(datakey []byte) (plaintext []byte, err error) {
+	input := &kms.DecryptInput{
+		CiphertextBlob: datakey,
+		KeyId:          aws.String(viper.GetString("USER-MASTER-KEY")),
+	}
+	result, err := kmsClient().Decrypt(input)
 	if err != nil {
-		log.Fatalln(err)
+		return
+	}
+	return result.Plaintext, nil
+}
+
+// RewrapDataKey re-encrypts a wrapped data key under USER-MASTER-KEY, the
+// plaintext key never leaves KMS.
+func (kmsKeys) RewrapDataKey(datakey []byte) (rewrapped []byte, err error) {
+	input := &kms.ReEncryptInput{
+		CiphertextBlob:   datakey,
+		DestinationKeyId: aws.String(viper.GetString("USER-MASTER-KEY")),
+	}
+	result, err := kmsClient().ReEncrypt(input)
+	if err != nil {
+		return
+	}
+	return result.CiphertextBlob, nil
+}
 
+func generateDataKey() (plaintext, wrapped []byte, err error) {
+	t := time.Now()
+	plaintext, wrapped, err = keys().GenerateDataKey()
+	if err != nil {
+		return
 	}
 	lapse := time.Since(t).Milliseconds()
 	log.WithField("time(ms)", lapse).Debug("generate data key success")
-	return result
+	return
 }
 
-func decryptDataKey(datakey []byte) (dataKeyPlain []byte) {
+func decryptDataKey(datakey []byte) (dataKeyPlain []byte, err error) {
 	t := time.Now()
-	region := viper.GetString("REGION")
-	sess, _ := session.NewSession()
-	svc := kms.New(sess,
-		aws.NewConfig().WithRegion(region))
-	input := &kms.DecryptInput{
-		CiphertextBlob: datakey,
-		KeyId:          aws.String(viper.GetString("USER-MASTER-KEY")),
-	}
-	result, err := svc.Decrypt(input)
+	dataKeyPlain, err = keys().DecryptDataKey(datakey)
 	if err != nil {
-		log.Fatalln(err)
+		return
 	}
-	dataKeyPlain = result.Plaintext
 	lapse := time.Since(t).Milliseconds()
 	log.WithField("time(ms)", lapse).Debug("decrypt data key success")
 	return
 }
 
+// rewrapDataKey wraps a data key again under the current USER-MASTER-KEY.
+func rewrapDataKey(datakey []byte) (rewrapped []byte, err error) {
+	t := time.Now()
+	rewrapped, err = keys().RewrapDataKey(datakey)
+	if err != nil {
+		return
+	}
+	lapse := time.Since(t).Milliseconds()
+	log.WithField("time(ms)", lapse).Debug("rewrap data key success")
+	return
+}
+
+func newGCM(key []byte) (gcm cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
 func encrypt(plaintext string, key []byte) (ciphertext string, err error) {
 	t := time.Now()
 	block, _ := aes.NewCipher(key)
@@ -164,7 +349,14 @@ func decrypt(cipherText string, key []byte) (plainText string, err error) {
 	//
 
 	// process ciphertext
-	ciphertextByte, _ := base64.StdEncoding.DecodeString(cipherText)
+	ciphertextByte, err := base64.StdEncoding.DecodeString(cipherText)
+	if err != nil {
+		return
+	}
+	if len(ciphertextByte) < nonceSize {
+		err = errors.New("ciphertext too short")
+		return
+	}
 	nonce, ciphertextByteClean := ciphertextByte[:nonceSize], ciphertextByte[nonceSize:]
 	plaintextByte, err := gcm.Open(
 		nil,
@@ -184,10 +376,14 @@ func decrypt(cipherText string, key []byte) (plainText string, err error) {
 }
 
 type SecureObject struct {
-	ID       string `json:"id"`
-	FieldOne string `json:"field-one"`
-	FieldTwo string `json:"field-two"`
-	DataKey  string `json:"datakey"`
+	Version       int               `json:"version"`
+	ID            string            `json:"id"`
+	Tenant        string            `json:"tenant,omitempty"`
+	FieldOne      string            `json:"field-one"`
+	FieldTwo      string            `json:"field-two"`
+	FieldOneIndex map[string]string `json:"field-one-index,omitempty"`
+	FieldTwoIndex map[string]string `json:"field-two-index,omitempty"`
+	DataKey       string            `json:"datakey"`
 }
 
 func readObject(source string) (obj SecureObject) {
@@ -196,7 +392,7 @@ func readObject(source string) (obj SecureObject) {
 		log.Fatalln(err)
 	}
 
-	errParse := json.Unmarshal(objSource, &obj)
+	obj, errParse := unmarshalObject(objSource)
 	if errParse != nil {
 		log.Fatalln(errParse)
 	}
@@ -204,26 +400,19 @@ func readObject(source string) (obj SecureObject) {
 	return
 }
 
-func createOutput(id, ciphertextOne, cipherTextTwo, datakey string) {
-	secObject := &SecureObject{
-		ID:       id,
-		FieldOne: ciphertextOne,
-		FieldTwo: cipherTextTwo,
-		DataKey:  datakey}
-
-	secObjectString, err := json.Marshal(secObject)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	f, err := os.Create(fmt.Sprintf("%s-encrypted.json", id))
+func createOutput(id, tenant, ciphertextOne, cipherTextTwo, datakey string, indexOne, indexTwo map[string]string) {
+	secObject := SecureObject{
+		Version:       schemaVersion,
+		ID:            id,
+		Tenant:        tenant,
+		FieldOne:      ciphertextOne,
+		FieldTwo:      cipherTextTwo,
+		FieldOneIndex: indexOne,
+		FieldTwoIndex: indexTwo,
+		DataKey:       datakey}
+
+	err := openStore().Put(secObject)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer f.Close()
-
-	_, err2 := f.WriteString(string(secObjectString))
-	if err2 != nil {
-		log.Fatal(err2)
-	}
 }
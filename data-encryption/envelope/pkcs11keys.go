@@ -0,0 +1,46 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"keyprovider"
+)
+
+// newPKCS11Keys opens the HSM holding the master keys, USER-MASTER-KEY
+// being the label of an AES key in the token. With SoftHSMv2:
+//
+//	softhsm2-util --init-token --free --label envelope --pin 1234 --so-pin 5678
+//	--mode hsm-key-create --key-id user-master-key
+//
+//	KEY-PROVIDER: pkcs11
+//	USER-MASTER-KEY: user-master-key
+//	PKCS11:
+//	  MODULE: /usr/lib/softhsm/libsofthsm2.so
+//	  TOKEN-LABEL: envelope
+//	  PIN: "1234"
+func newPKCS11Keys() (p *keyprovider.PKCS11Keys, err error) {
+	p, err = keyprovider.NewPKCS11Keys(viper.GetString("PKCS11.MODULE"),
+		viper.GetString("PKCS11.TOKEN-LABEL"), viper.GetString("PKCS11.PIN"))
+	if err != nil {
+		return
+	}
+	p.MasterKey = viper.GetString("USER-MASTER-KEY")
+	return
+}
+
+// createHSMKey generates a master key in the token that can wrap and
+// unwrap but never be read.
+func createHSMKey(label string) {
+	if label == "" {
+		log.Fatalln("key-id is required")
+	}
+	p, ok := keys().(*keyprovider.PKCS11Keys)
+	if !ok {
+		log.Fatalln("hsm-key-create needs KEY-PROVIDER pkcs11")
+	}
+	err := p.CreateKey(label)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.WithField("key-id", label).Info("HSM key created")
+}
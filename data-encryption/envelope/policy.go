@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var objectFields = []string{"field-one", "field-two"}
+
+var (
+	errFieldDenied  = errors.New("field access denied")
+	errTenantDenied = errors.New("tenant access denied")
+)
+
+// fieldPolicy is read from the FIELD-POLICY file. ROLES lists the fields
+// each role may decrypt, CALLERS maps server callers (client certificate
+// common names or token:<first 8 hex digits of the token digest>) to a role
+// and TENANTS to the tenants whose objects they may use, "*" for every
+// tenant. Callers without TENANTS only use objects without a tenant.
+// openRecord enforces the policy for the server and the command line modes
+// alike. Server callers can't pick their role, the --role of the command line
+// is asserted by whoever runs it, who with the master key at hand is trusted
+// not to decrypt around the tool.
+//
+//	ROLES:
+//	  support: [field-one]
+//	  admin: [field-one, field-two]
+//	CALLERS:
+//	  billing-service: admin
+//	  billing.example.com: support
+//	TENANTS:
+//	  billing-service: ["*"]
+//	  billing.example.com: [acme, globex]
+type fieldPolicy struct {
+	Roles   map[string][]string `mapstructure:"ROLES"`
+	Callers map[string]string   `mapstructure:"CALLERS"`
+	Tenants map[string][]string `mapstructure:"TENANTS"`
+}
+
+var (
+	policyOnce sync.Once
+	policy     *fieldPolicy
+)
+
+// loadFieldPolicy returns nil when FIELD-POLICY is not configured, every
+// caller may then decrypt every field.
+func loadFieldPolicy() *fieldPolicy {
+	policyOnce.Do(func() {
+		path := viper.GetString("FIELD-POLICY")
+		if path == "" {
+			return
+		}
+		// common names hold dots, the default key delimiter of viper
+		v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+		v.SetConfigFile(path)
+		err := v.ReadInConfig()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		policy = &fieldPolicy{}
+		err = v.Unmarshal(policy)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	})
+	return policy
+}
+
+// callerRole returns the role of an authenticated server caller.
+func callerRole(caller string) string {
+	p := loadFieldPolicy()
+	if p == nil {
+		return ""
+	}
+	return p.Callers[strings.ToLower(caller)]
+}
+
+// checkCallerTenant fails unless the policy lets an authenticated server
+// caller use the objects of tenant.
+func checkCallerTenant(caller, tenant string) error {
+	p := loadFieldPolicy()
+	if p == nil || tenant == "" {
+		return nil
+	}
+	for _, allowed := range p.Tenants[strings.ToLower(caller)] {
+		if allowed == "*" || allowed == tenant {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: caller %q may not use tenant %s", errTenantDenied, caller, tenant)
+}
+
+// decryptableFields resolves the fields a role asked for against the
+// policy. Asking for nothing means every field the role may see, asking for
+// a field the role may not see is an error.
+func decryptableFields(role string, requested []string) (fields []string, err error) {
+	for _, field := range requested {
+		if !isObjectField(field) {
+			return nil, fmt.Errorf("%w: unknown field %s", errInvalidRecord, field)
+		}
+	}
+
+	p := loadFieldPolicy()
+	if p == nil {
+		if len(requested) == 0 {
+			return objectFields, nil
+		}
+		return requested, nil
+	}
+
+	allowed := map[string]bool{}
+	for _, field := range p.Roles[strings.ToLower(role)] {
+		allowed[field] = true
+	}
+	if len(requested) == 0 {
+		for _, field := range objectFields {
+			if allowed[field] {
+				fields = append(fields, field)
+			}
+		}
+		return
+	}
+	for _, field := range requested {
+		if !allowed[field] {
+			return nil, fmt.Errorf("%w: role %q may not decrypt %s", errFieldDenied, role, field)
+		}
+	}
+	return requested, nil
+}
+
+func isObjectField(field string) bool {
+	for _, known := range objectFields {
+		if field == known {
+			return true
+		}
+	}
+	return false
+}
+
+// requestedFields splits a comma separated field list.
+func requestedFields(list string) (fields []string) {
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return
+}
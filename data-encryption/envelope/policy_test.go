@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func usePolicy(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+	viper.Set("FIELD-POLICY", path)
+	policyOnce = sync.Once{}
+	policy = nil
+	t.Cleanup(func() {
+		policyOnce = sync.Once{}
+		policy = nil
+	})
+}
+
+func TestCallerRoleWithDottedName(t *testing.T) {
+	usePolicy(t, `
+ROLES:
+  support: [field-one]
+  admin: [field-one, field-two]
+CALLERS:
+  billing.example.com: support
+  Reports.Example.Com: admin
+  token:0a1b2c3d: admin
+`)
+	for caller, role := range map[string]string{
+		"billing.example.com": "support",
+		"reports.example.com": "admin",
+		"token:0a1b2c3d":      "admin",
+		"billing":             "",
+		"example.com":         "",
+	} {
+		if got := callerRole(caller); got != role {
+			t.Errorf("caller %s has role %q, want %q", caller, got, role)
+		}
+	}
+}
+
+func TestDecryptableFields(t *testing.T) {
+	usePolicy(t, `
+ROLES:
+  support: [field-one]
+`)
+	fields, err := decryptableFields("support", nil)
+	if err != nil || !reflect.DeepEqual(fields, []string{"field-one"}) {
+		t.Errorf("support may decrypt %v, %v", fields, err)
+	}
+	if _, err = decryptableFields("support", []string{"field-two"}); !errors.Is(err, errFieldDenied) {
+		t.Errorf("expected field-two to be denied, got %v", err)
+	}
+	if _, err = decryptableFields("support", []string{"datakey"}); !errors.Is(err, errInvalidRecord) {
+		t.Errorf("expected an unknown field error, got %v", err)
+	}
+}
+
+func TestOpenRecordEnforcesPolicy(t *testing.T) {
+	// the policy is loaded before useLocalKeys resets viper
+	usePolicy(t, `
+ROLES:
+  support: [field-one]
+`)
+	loadFieldPolicy()
+	useLocalKeys(t)
+	obj, err := sealRecord(plainRecord{ID: "1", Text1: "a", Text2: "b"}, newDataKeyPolicy("record", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := &dataKeyCache{keys: map[string]*cachedDataKey{}}
+
+	record, err := openRecord(obj, cache, "support", nil)
+	if err != nil || record.Text1 != "a" || record.Text2 != "" {
+		t.Errorf("support decrypted %+v, %v", record, err)
+	}
+	for role, requested := range map[string][]string{
+		"support": {"field-two"},
+		"":        {"field-one"},
+	} {
+		record, err = openRecord(obj, cache, role, requested)
+		if !errors.Is(err, errFieldDenied) || record.Text1 != "" || record.Text2 != "" {
+			t.Errorf("role %q decrypted %v: %+v, %v", role, requested, record, err)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const maxRequestBody = 1 << 20
+
+// dataKeyResponse is returned by /datakey for callers encrypting on their
+// own. The plaintext key must never be stored next to the wrapped one.
+type dataKeyResponse struct {
+	Plaintext string `json:"plaintext"`
+	DataKey   string `json:"datakey"`
+}
+
+type callerKey struct{}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// serve exposes encrypt, decrypt, rewrap and datakey over HTTP/JSON. Callers
+// authenticate with a client certificate signed by SERVER.CLIENT-CA or with
+// a bearer token whose SHA-256 hex digest is listed in SERVER.TOKENS. Without
+// SERVER.TLS-CERT it only starts with SERVER.ALLOW-PLAINTEXT, for a local
+// proxy terminating TLS.
+func serve() {
+	tokens := map[string]bool{}
+	for _, digest := range viper.GetStringSlice("SERVER.TOKENS") {
+		tokens[strings.ToLower(digest)] = true
+	}
+	clientCA := viper.GetString("SERVER.CLIENT-CA")
+	if len(tokens) == 0 && clientCA == "" {
+		log.Fatalln("SERVER.TOKENS or SERVER.CLIENT-CA is required")
+	}
+	if viper.GetString("SERVER.TLS-CERT") == "" && !viper.GetBool("SERVER.ALLOW-PLAINTEXT") {
+		log.Fatalln("SERVER.TLS-CERT is required, SERVER.ALLOW-PLAINTEXT serves plain http")
+	}
+	if loadFieldPolicy() == nil {
+		log.Warn("FIELD-POLICY is not configured, every caller may use every field and tenant")
+	}
+	if loadIndexKey() == nil {
+		log.Debug("INDEX-KEY is not configured, blind indexes are skipped")
+	}
+
+	address := viper.GetString("SERVER.ADDRESS")
+	if address == "" {
+		address = ":8443"
+	}
+	server := &http.Server{
+		Addr:              address,
+		Handler:           serverHandler(tokens),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalln("couldn't append certs from pem")
+		}
+		clientAuth := tls.RequireAndVerifyClientCert
+		if len(tokens) > 0 {
+			// token callers connect without a certificate
+			clientAuth = tls.VerifyClientCertIfGiven
+		}
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: clientAuth,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	log.WithField("address", address).Info("serve")
+	var err error
+	if viper.GetString("SERVER.TLS-CERT") != "" {
+		err = server.ListenAndServeTLS(
+			viper.GetString("SERVER.TLS-CERT"),
+			viper.GetString("SERVER.TLS-KEY"))
+	} else {
+		if clientCA != "" {
+			log.Fatalln("SERVER.CLIENT-CA requires SERVER.TLS-CERT")
+		}
+		log.Warn("SERVER.ALLOW-PLAINTEXT is set, serving plain http")
+		err = server.ListenAndServe()
+	}
+	log.Fatalln(err)
+}
+
+func serverHandler(tokens map[string]bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/encrypt", handleEncrypt)
+	mux.HandleFunc("/decrypt", handleDecrypt)
+	mux.HandleFunc("/rewrap", handleRewrap)
+	mux.HandleFunc("/datakey", handleDataKey)
+	return authenticate(tokens, mux)
+}
+
+func authenticate(tokens map[string]bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller := ""
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			caller = r.TLS.VerifiedChains[0][0].Subject.CommonName
+		} else if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+			sum := sha256.Sum256([]byte(token))
+			digest := hex.EncodeToString(sum[:])
+			for known := range tokens {
+				if subtle.ConstantTimeCompare([]byte(known), []byte(digest)) == 1 {
+					caller = "token:" + digest[:8]
+				}
+			}
+		}
+		if caller == "" {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{"unauthorized"})
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse{"method not allowed"})
+			return
+		}
+
+		t := time.Now()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller)))
+		log.WithFields(log.Fields{
+			"caller":   caller,
+			"path":     r.URL.Path,
+			"time(ms)": time.Since(t).Milliseconds(),
+		}).Info("request")
+	})
+}
+
+func handleEncrypt(w http.ResponseWriter, r *http.Request) {
+	record := plainRecord{}
+	if !readJSON(w, r, &record) {
+		return
+	}
+	err := checkCallerTenant(requestCaller(r), record.Tenant)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	obj, err := sealRecord(record, &dataKeyPolicy{every: 1})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, obj)
+}
+
+// handleDecrypt decrypts the fields listed in the fields query parameter,
+// or every field the role of the caller may see.
+func handleDecrypt(w http.ResponseWriter, r *http.Request) {
+	obj := SecureObject{}
+	if !readJSON(w, r, &obj) {
+		return
+	}
+	caller := requestCaller(r)
+	err := checkCallerTenant(caller, obj.Tenant)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	record, err := openRecord(obj, &dataKeyCache{keys: map[string]*cachedDataKey{}},
+		callerRole(caller), requestedFields(r.URL.Query().Get("fields")))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+// handleRewrap wraps the data key of an object under the current master key
+// or tenant KEK without touching the encrypted fields.
+func handleRewrap(w http.ResponseWriter, r *http.Request) {
+	obj := SecureObject{}
+	if !readJSON(w, r, &obj) {
+		return
+	}
+	err := checkCallerTenant(requestCaller(r), obj.Tenant)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	datakey, err := rewrapObjectKey(obj)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	obj.DataKey = datakey
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func handleDataKey(w http.ResponseWriter, r *http.Request) {
+	plaintext, wrapped, err := newDataKey("")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, dataKeyResponse{
+		Plaintext: base64.StdEncoding.EncodeToString(plaintext),
+		DataKey:   wrapped,
+	})
+}
+
+// requestCaller returns the caller set by authenticate.
+func requestCaller(r *http.Request) string {
+	caller, _ := r.Context().Value(callerKey{}).(string)
+	return caller
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{err.Error()})
+		return false
+	}
+	return true
+}
+
+// writeError hides the cause of a failure from the caller, decrypt errors
+// in particular must not tell apart a wrong key from a tampered field.
+func writeError(w http.ResponseWriter, err error) {
+	log.WithField("status", "error").Error(err)
+	if errors.Is(err, errFieldDenied) || errors.Is(err, errTenantDenied) {
+		writeJSON(w, http.StatusForbidden, errorResponse{err.Error()})
+		return
+	}
+	if errors.Is(err, errInvalidRecord) {
+		writeJSON(w, http.StatusBadRequest, errorResponse{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusUnprocessableEntity, errorResponse{"request could not be processed"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useServer starts the server handler accepting the bearer token "secret",
+// whose caller is token:2bb80d53 in the policy.
+func useServer(t *testing.T, policy string) *httptest.Server {
+	t.Helper()
+	// the policy is loaded before useLocalKeys resets viper
+	usePolicy(t, policy)
+	loadFieldPolicy()
+	useLocalKeys(t)
+	sum := sha256.Sum256([]byte("secret"))
+	server := httptest.NewServer(serverHandler(map[string]bool{hex.EncodeToString(sum[:]): true}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func post(t *testing.T, server *httptest.Server, path, token string, body interface{}) *http.Response {
+	t.Helper()
+	content, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestServerRejectsBadToken(t *testing.T) {
+	server := useServer(t, "ROLES: {}\n")
+	for _, token := range []string{"", "Secret", "secret2", "Basic secret"} {
+		resp := post(t, server, "/datakey", token, struct{}{})
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("token %q got status %d", token, resp.StatusCode)
+		}
+	}
+	if resp := post(t, server, "/datakey", "secret", struct{}{}); resp.StatusCode != http.StatusOK {
+		t.Errorf("valid token got status %d", resp.StatusCode)
+	}
+}
+
+func TestServerEnforcesPolicy(t *testing.T) {
+	sum := sha256.Sum256([]byte("secret"))
+	caller := "token:" + hex.EncodeToString(sum[:])[:8]
+	server := useServer(t, `
+ROLES:
+  support: [field-one]
+CALLERS:
+  `+caller+`: support
+TENANTS:
+  `+caller+`: [acme]
+`)
+	createKEK("acme")
+	createKEK("beta")
+
+	resp := post(t, server, "/encrypt", "secret", plainRecord{ID: "1", Tenant: "acme", Text1: "a", Text2: "b"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("encrypt for an allowed tenant got status %d", resp.StatusCode)
+	}
+	obj := SecureObject{}
+	err := json.NewDecoder(resp.Body).Decode(&obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := post(t, server, "/decrypt", "secret", obj); resp.StatusCode != http.StatusOK {
+		t.Errorf("decrypt of the fields of the role got status %d", resp.StatusCode)
+	}
+	if resp := post(t, server, "/decrypt?fields=field-two", "secret", obj); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("decrypt of a field outside the role got status %d", resp.StatusCode)
+	}
+
+	other, err := sealRecord(plainRecord{ID: "2", Tenant: "beta", Text1: "a"}, newDataKeyPolicy("record", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, body := range map[string]interface{}{
+		"/encrypt": plainRecord{ID: "2", Tenant: "beta", Text1: "a"},
+		"/decrypt": other,
+		"/rewrap":  other,
+	} {
+		if resp := post(t, server, path, "secret", body); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s for another tenant got status %d", path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// Shamir's secret sharing over GF(256): every byte of the secret is the
+// constant term of a random polynomial of degree threshold-1, share x holds
+// the polynomials evaluated at x. Any threshold shares give the secret back
+// by Lagrange interpolation at 0, fewer tell nothing about it.
+
+// gfMul multiplies in GF(256) with the AES polynomial, without branching
+// on the operands.
+func gfMul(a, b byte) (product byte) {
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		carry := -(a >> 7) & 0x1b
+		a = a<<1 ^ carry
+		b >>= 1
+	}
+	return
+}
+
+// gfInv returns a^254, the inverse of a non-zero element.
+func gfInv(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 254; i++ {
+		result = gfMul(result, a)
+	}
+	return result
+}
+
+// splitSecret returns count shares, share i evaluated at x = i+1.
+func splitSecret(secret []byte, count, threshold int) (shares [][]byte, err error) {
+	if threshold < 2 || count < threshold || count > 255 {
+		return nil, errors.New("shares need 2 <= threshold <= count <= 255")
+	}
+	shares = make([][]byte, count)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+	coefficients := make([]byte, threshold)
+	for j, value := range secret {
+		coefficients[0] = value
+		_, err = io.ReadFull(rand.Reader, coefficients[1:])
+		if err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := byte(i + 1)
+			// Horner's rule from the highest coefficient down
+			y := byte(0)
+			for k := threshold - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coefficients[k]
+			}
+			shares[i][j] = y
+		}
+	}
+	for i := range coefficients {
+		coefficients[i] = 0
+	}
+	return
+}
+
+// combineShares interpolates the secret from shares keyed by their x.
+func combineShares(shares map[byte][]byte) (secret []byte, err error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least 2 shares are needed")
+	}
+	size := -1
+	for x, share := range shares {
+		if x == 0 {
+			return nil, errors.New("share index 0 is invalid")
+		}
+		if size >= 0 && len(share) != size {
+			return nil, errors.New("shares have different lengths")
+		}
+		size = len(share)
+	}
+
+	secret = make([]byte, size)
+	for xi, share := range shares {
+		// Lagrange basis polynomial of xi evaluated at 0
+		basis := byte(1)
+		for xj := range shares {
+			if xj != xi {
+				basis = gfMul(basis, gfMul(xj, gfInv(xj^xi)))
+			}
+		}
+		for j := range secret {
+			secret[j] ^= gfMul(share[j], basis)
+		}
+	}
+	return
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var errObjectNotFound = errors.New("object not found")
+
+// objectStore keeps SecureObjects by ID, together with their wrapped data
+// key, so they can be decrypted later without anything else.
+type objectStore interface {
+	Put(obj SecureObject) error
+	Get(id string) (SecureObject, error)
+	List() ([]string, error)
+	Delete(id string) error
+}
+
+// openStore returns the store selected by STORE, "file" (default) or
+// "mysql".
+func openStore() objectStore {
+	switch viper.GetString("STORE") {
+	case "", "file":
+		dir := viper.GetString("STORE-DIR")
+		if dir == "" {
+			dir = "."
+		}
+		return &fileStore{dir: dir, encoding: viper.GetString("encoding")}
+	case "mysql":
+		return newMySQLStore(connectRDS(), viper.GetString("STORE-TABLE"))
+	}
+	log.Fatalf("unknown store %q", viper.GetString("STORE"))
+	return nil
+}
+
+// fileStore keeps every object in <dir>/<id>-encrypted.json or .cbor.
+type fileStore struct {
+	dir      string
+	encoding string
+}
+
+const objectFileSuffix = "-encrypted."
+
+func (s *fileStore) path(id, encoding string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return "", fmt.Errorf("%w: id %q can't be used as a file name", errInvalidRecord, id)
+	}
+	return filepath.Join(s.dir, id+objectFileSuffix+objectExtension(encoding)), nil
+}
+
+func (s *fileStore) Put(obj SecureObject) (err error) {
+	path, err := s.path(obj.ID, s.encoding)
+	if err != nil {
+		return
+	}
+	output, err := marshalObject(obj, s.encoding)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(path, output, 0600)
+	if err != nil {
+		return
+	}
+	// the object replaces one stored before in the other encoding
+	for _, encoding := range []string{"json", "cbor"} {
+		if encoding == objectExtension(s.encoding) {
+			continue
+		}
+		other, _ := s.path(obj.ID, encoding)
+		errRemove := os.Remove(other)
+		if errRemove != nil && !errors.Is(errRemove, os.ErrNotExist) {
+			return errRemove
+		}
+	}
+	return
+}
+
+func (s *fileStore) Get(id string) (obj SecureObject, err error) {
+	for _, encoding := range []string{"json", "cbor"} {
+		path, errPath := s.path(id, encoding)
+		if errPath != nil {
+			return obj, errPath
+		}
+		source, errRead := os.ReadFile(path)
+		if errors.Is(errRead, os.ErrNotExist) {
+			continue
+		}
+		if errRead != nil {
+			return obj, errRead
+		}
+		return unmarshalObject(source)
+	}
+	return obj, fmt.Errorf("%w: %s", errObjectNotFound, id)
+}
+
+func (s *fileStore) List() (ids []string, err error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*"+objectFileSuffix+"*"))
+	if err != nil {
+		return
+	}
+	seen := map[string]bool{}
+	for _, match := range matches {
+		name := filepath.Base(match)
+		id := name[:strings.LastIndex(name, objectFileSuffix)]
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return
+}
+
+func (s *fileStore) Delete(id string) (err error) {
+	found := false
+	for _, encoding := range []string{"json", "cbor"} {
+		path, errPath := s.path(id, encoding)
+		if errPath != nil {
+			return errPath
+		}
+		errRemove := os.Remove(path)
+		if errors.Is(errRemove, os.ErrNotExist) {
+			continue
+		}
+		if errRemove != nil {
+			return errRemove
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", errObjectNotFound, id)
+	}
+	return
+}
+
+// mysqlStore keeps objects in one row each, ciphertexts and the wrapped
+// data key as raw bytes like the cbor encoding. Every configured blind index
+// variant has an indexed column of its own, field_one_full_bidx for the
+// full variant of field-one, the column blindIndexWhere selects on.
+type mysqlStore struct {
+	db      *sql.DB
+	table   string
+	indexes []indexColumn
+}
+
+// indexColumn is the column of one blind index variant of a field.
+type indexColumn struct {
+	field   string
+	variant string
+	name    string
+}
+
+func newMySQLStore(db *sql.DB, table string) *mysqlStore {
+	if table == "" {
+		table = "secure_object"
+	}
+	s := &mysqlStore{db: db, table: table}
+	for _, field := range objectFields {
+		for _, variant := range blindIndexVariants(field) {
+			s.indexes = append(s.indexes, indexColumn{
+				field:   field,
+				variant: variant.Name,
+				name:    blindIndexColumn(field, variant.Name),
+			})
+		}
+	}
+	_, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id VARCHAR(255) NOT NULL PRIMARY KEY,
+		version INT NOT NULL,
+		tenant VARCHAR(255) NOT NULL DEFAULT '',
+		field_one BLOB NOT NULL,
+		field_two BLOB NOT NULL,
+		datakey BLOB NOT NULL,
+		kek_version INT NOT NULL DEFAULT 0
+	)`, s.table))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	s.addColumns()
+	return s
+}
+
+// addColumns adds the kek_version column to tables created before the key
+// hierarchy, and the column of every blind index variant configured since
+// the table was created. Objects stored before a variant was added have no
+// index for it until they are stored again.
+func (s *mysqlStore) addColumns() {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT * FROM %s LIMIT 0", s.table))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	columns, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	have := map[string]bool{}
+	for _, column := range columns {
+		have[strings.ToLower(column)] = true
+	}
+
+	if !have["kek_version"] {
+		_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN kek_version INT NOT NULL DEFAULT 0", s.table))
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	for _, index := range s.indexes {
+		if have[index.name] {
+			continue
+		}
+		_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s VARCHAR(64) NULL", s.table, index.name))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		_, err = s.db.Exec(fmt.Sprintf("CREATE INDEX %s ON %s (%s)", index.name, s.table, index.name))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.WithField("column", index.name).Info("blind index column added")
+	}
+}
+
+// objectIndexes returns the blind indexes of a field of obj.
+func objectIndexes(obj *SecureObject, field string) *map[string]string {
+	if field == "field-one" {
+		return &obj.FieldOneIndex
+	}
+	return &obj.FieldTwoIndex
+}
+
+func (s *mysqlStore) Put(obj SecureObject) (err error) {
+	if obj.Version == 0 {
+		obj.Version = 1
+	}
+	bin, err := toBinaryObject(obj)
+	if err != nil {
+		return
+	}
+
+	columns := "id, version, tenant, field_one, field_two, datakey, kek_version"
+	placeholders := "?, ?, ?, ?, ?, ?, ?"
+	args := []interface{}{bin.ID, bin.Version, bin.Tenant, bin.FieldOne, bin.FieldTwo, bin.DataKey, bin.KEKVersion}
+	for _, index := range s.indexes {
+		columns += ", " + index.name
+		placeholders += ", ?"
+		// a variant missing from the object stays NULL, matching no lookup
+		var value interface{}
+		if bidx, ok := (*objectIndexes(&obj, index.field))[index.variant]; ok {
+			value = bidx
+		}
+		args = append(args, value)
+	}
+	_, err = s.db.Exec(fmt.Sprintf("REPLACE INTO %s (%s) VALUES (%s)", s.table, columns, placeholders), args...)
+	return
+}
+
+func (s *mysqlStore) Get(id string) (obj SecureObject, err error) {
+	bin := binaryObject{}
+	columns := "id, version, tenant, field_one, field_two, datakey, kek_version"
+	dest := []interface{}{&bin.ID, &bin.Version, &bin.Tenant, &bin.FieldOne, &bin.FieldTwo, &bin.DataKey, &bin.KEKVersion}
+	indexes := make([]sql.NullString, len(s.indexes))
+	for i, index := range s.indexes {
+		columns += ", " + index.name
+		dest = append(dest, &indexes[i])
+	}
+	err = s.db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", columns, s.table), id).Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return obj, fmt.Errorf("%w: %s", errObjectNotFound, id)
+	}
+	if err != nil {
+		return
+	}
+
+	obj = fromBinaryObject(bin)
+	for i, index := range s.indexes {
+		if !indexes[i].Valid {
+			continue
+		}
+		fieldIndexes := objectIndexes(&obj, index.field)
+		if *fieldIndexes == nil {
+			*fieldIndexes = map[string]string{}
+		}
+		(*fieldIndexes)[index.variant] = indexes[i].String
+	}
+	err = checkVersion(obj)
+	return
+}
+
+// Lookup returns the IDs of the objects whose field may hold value, by the
+// blind index variant. Truncated variants return false positives too.
+func (s *mysqlStore) Lookup(field, variant, value string) (ids []string, err error) {
+	clause, args, err := blindIndexWhere(field, variant, value)
+	if err != nil {
+		return
+	}
+	rows, err := s.db.Query(fmt.Sprintf("SELECT id FROM %s WHERE %s ORDER BY id", s.table, clause), args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *mysqlStore) List() (ids []string, err error) {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT id FROM %s ORDER BY id", s.table))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *mysqlStore) Delete(id string) (err error) {
+	result, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ?", s.table), id)
+	if err != nil {
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		err = fmt.Errorf("%w: %s", errObjectNotFound, id)
+	}
+	return
+}
+
+func connectRDS() (db *sql.DB) {
+	log.WithField("status", "starting").Info("connectRDS")
+
+	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s",
+		viper.GetString("DB-USER"),
+		viper.GetString("DB-PASSWORD"),
+		viper.GetString("DB-HOST"),
+		viper.GetString("DB-DEFAULT"),
+	)
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		panic(err)
+	}
+	err = db.Ping()
+	if err != nil {
+		panic(err)
+	}
+
+	log.WithField("status", "success").Info("connectRDS")
+	return
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TestMySQLStoreLookup needs a database it may create tables in, in
+// ENVELOPE_TEST_DSN:
+//
+//	ENVELOPE_TEST_DSN='root:rootpw@tcp(127.0.0.1:3306)/test' go test ./...
+func TestMySQLStoreLookup(t *testing.T) {
+	dsn := os.Getenv("ENVELOPE_TEST_DSN")
+	if dsn == "" {
+		t.Skip("ENVELOPE_TEST_DSN is not set")
+	}
+	useIndexKey(t)
+	viper.Set("BLIND-INDEX.field-one", []map[string]interface{}{
+		{"name": "full"},
+		{"name": "prefix", "normalize": []string{"trim", "lower"}, "prefix": 3, "bits": 16},
+	})
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := fmt.Sprintf("secure_object_test_%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		db.Exec("DROP TABLE " + table)
+		db.Close()
+	})
+	store := newMySQLStore(db, table)
+
+	keys := newDataKeyPolicy("record", 1)
+	stored := map[string]SecureObject{}
+	for id, text := range map[string]string{"alice": "Alice", "alison": " alison", "bob": "Bob"} {
+		obj, err := sealRecord(plainRecord{ID: id, Text1: text, Text2: "x"}, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.Put(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored[id] = obj
+	}
+
+	lookups := []struct {
+		variant, value string
+		want           []string
+	}{
+		{"full", "Alice", []string{"alice"}},
+		{"full", "alice", nil},
+		{"prefix", "ALIBI", []string{"alice", "alison"}},
+		{"prefix", "bo", nil},
+	}
+	for _, lookup := range lookups {
+		ids, err := store.Lookup("field-one", lookup.variant, lookup.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, lookup.want) {
+			t.Errorf("lookup %s %q = %v, want %v", lookup.variant, lookup.value, ids, lookup.want)
+		}
+	}
+
+	obj, err := store.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(obj.FieldOneIndex, stored["alice"].FieldOneIndex) ||
+		!reflect.DeepEqual(obj.FieldTwoIndex, stored["alice"].FieldTwoIndex) {
+		t.Errorf("read indexes %v %v, stored %v %v", obj.FieldOneIndex, obj.FieldTwoIndex,
+			stored["alice"].FieldOneIndex, stored["alice"].FieldTwoIndex)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// fieldKey returns the key a field of an object is encrypted with. Since
+// schema version 2 every field has its own subkey derived with HKDF from the
+// data key, the object ID and the field name, so a data key is never used
+// directly and one leaked field key exposes no other field.
+func fieldKey(dataKey []byte, version int, id, field string) (key []byte, err error) {
+	if version < 2 {
+		return dataKey, nil
+	}
+	info := fmt.Sprintf("envelope:v%d:%s:%s", version, id, field)
+	key = make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha256.New, dataKey, nil, []byte(info)), key)
+	return
+}
+
+func sealField(dataKey []byte, id, field, plaintext string) (ciphertext string, err error) {
+	key, err := fieldKey(dataKey, schemaVersion, id, field)
+	if err != nil {
+		return
+	}
+	return encrypt(plaintext, key)
+}
+
+func openField(dataKey []byte, obj SecureObject, field, ciphertext string) (plaintext string, err error) {
+	key, err := fieldKey(dataKey, obj.Version, obj.ID, field)
+	if err != nil {
+		return
+	}
+	return decrypt(ciphertext, key)
+}
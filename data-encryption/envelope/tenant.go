@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// tenantKeystore holds the key-encryption keys (KEK), each wrapped by
+// USER-MASTER-KEY: one per tenant and the optional app KEK used by objects
+// without a tenant. Data keys are wrapped locally by a KEK, so KMS is only
+// called once per KEK version, and deleting a tenant KEK shreds every
+// object of the tenant.
+type tenantKeystore struct {
+	App     *tenantKey           `json:"app,omitempty"`
+	Tenants map[string]tenantKey `json:"tenants"`
+}
+
+// tenantKey is the current KEK version, versions rotated out stay in
+// Previous until kek-prune so existing data keys can still be opened.
+type tenantKey struct {
+	KEK      string       `json:"kek"`
+	Version  int          `json:"version,omitempty"`
+	Created  time.Time    `json:"created"`
+	Previous []kekVersion `json:"previous,omitempty"`
+}
+
+type kekVersion struct {
+	Version int       `json:"version"`
+	KEK     string    `json:"kek"`
+	Created time.Time `json:"created"`
+}
+
+// shredReport lists the objects made undecryptable by tenant-shred.
+type shredReport struct {
+	Tenant     string        `json:"tenant"`
+	ShreddedAt time.Time     `json:"shredded-at"`
+	Objects    []shredObject `json:"objects"`
+}
+
+type shredObject struct {
+	ID     string `json:"id"`
+	Source string `json:"source"`
+}
+
+var errUnknownTenant = errors.New("unknown tenant")
+
+func keystorePath() string {
+	path := viper.GetString("TENANT-KEYSTORE")
+	if path == "" {
+		path = "tenants.json"
+	}
+	return path
+}
+
+func readKeystore() (keystore tenantKeystore, err error) {
+	keystore.Tenants = map[string]tenantKey{}
+	source, err := os.ReadFile(keystorePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return keystore, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(source, &keystore)
+	return
+}
+
+// writeKeystore replaces the keystore through a rename, so a crash never
+// leaves a half written file behind.
+func writeKeystore(keystore tenantKeystore) (err error) {
+	output, err := json.MarshalIndent(keystore, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := keystorePath() + ".tmp"
+	err = os.WriteFile(tmp, output, 0600)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, keystorePath())
+}
+
+// shredFileTypes are the files tenant-shred looks for objects in: objects
+// of the file store, json or cbor, and enc-batch outputs, jsonl or csv.
+var shredFileTypes = map[string]bool{".json": true, ".cbor": true, ".jsonl": true, ".csv": true}
+
+// shredTenant deletes every KEK version of a tenant and reports the
+// objects found under the objects directory, or in the mysql store, that can
+// no longer be decrypted. The objects of the tenant in the store lose their
+// blind indexes, those in batch outputs keep them until the files are
+// deleted. Copies of the keystore in backups still hold the wrapped KEKs and
+// must be pruned for the shredding to be permanent.
+func shredTenant(tenant, objectsDir string) {
+	if tenant == "" {
+		log.Fatalln("tenant is required")
+	}
+	report := shredReport{Tenant: tenant, Objects: []shredObject{}}
+	err := filepath.Walk(objectsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !shredFileTypes[filepath.Ext(path)] {
+			return nil
+		}
+		objects, err := tenantObjects(path, tenant)
+		if err != nil {
+			log.WithField("file", path).Debug(err)
+			return nil
+		}
+		report.Objects = append(report.Objects, objects...)
+		return nil
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	store := openStore()
+	if viper.GetString("STORE") == "mysql" {
+		objects, errStore := storeTenantObjects(store, tenant)
+		if errStore != nil {
+			log.Fatalln(errStore)
+		}
+		report.Objects = append(report.Objects, objects...)
+	}
+	indexes, err := dropTenantIndexes(store, tenant)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	tenantMu.Lock()
+	keystore, err := readKeystore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if _, ok := keystore.Tenants[tenant]; !ok {
+		log.Fatalf("%s %s", errUnknownTenant, tenant)
+	}
+	delete(keystore.Tenants, tenant)
+	delete(keks, tenant)
+	delete(current, tenant)
+	err = writeKeystore(keystore)
+	tenantMu.Unlock()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	report.ShreddedAt = time.Now().UTC()
+
+	out, err := createBatchOutput(viper.GetString("output"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer out.Close()
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(report)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.WithFields(log.Fields{
+		"tenant":  tenant,
+		"objects": len(report.Objects),
+		"indexes": indexes,
+	}).Info("tenant shredded")
+}
+
+// tenantObjects reads a single object file or a batch output.
+func tenantObjects(path, tenant string) (objects []shredObject, err error) {
+	switch filepath.Ext(path) {
+	case ".cbor":
+		source, errRead := os.ReadFile(path)
+		if errRead != nil {
+			return nil, errRead
+		}
+		obj, errObject := unmarshalObject(source)
+		if errObject != nil {
+			return nil, errObject
+		}
+		if obj.Tenant == tenant {
+			objects = append(objects, shredObject{ID: obj.ID, Source: path})
+		}
+		return
+	case ".csv":
+		return csvTenantObjects(path, tenant)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		obj := SecureObject{}
+		if json.Unmarshal(scanner.Bytes(), &obj) != nil || obj.Tenant != tenant {
+			continue
+		}
+		source := path
+		if strings.HasSuffix(path, ".jsonl") {
+			source = fmt.Sprintf("%s:%d", path, line)
+		}
+		objects = append(objects, shredObject{ID: obj.ID, Source: source})
+	}
+	err = scanner.Err()
+	return
+}
+
+// csvTenantObjects reads an enc-batch csv output, files without id and
+// tenant columns are skipped.
+func csvTenantObjects(path, tenant string) (objects []shredObject, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	id, okID := columns["id"]
+	tenantColumn, okTenant := columns["tenant"]
+	if !okID || !okTenant {
+		return nil, errors.New("csv has no id and tenant columns")
+	}
+	for line := 2; ; line++ {
+		row, errRead := reader.Read()
+		if errRead == io.EOF {
+			return
+		}
+		if errRead != nil {
+			return objects, errRead
+		}
+		if len(row) == len(header) && row[tenantColumn] == tenant {
+			objects = append(objects, shredObject{ID: row[id], Source: fmt.Sprintf("%s:%d", path, line)})
+		}
+	}
+}
+
+func storeTenantObjects(store objectStore, tenant string) (objects []shredObject, err error) {
+	ids, err := store.List()
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		obj, errGet := store.Get(id)
+		if errGet != nil {
+			return nil, errGet
+		}
+		if obj.Tenant == tenant {
+			objects = append(objects, shredObject{ID: id, Source: "store"})
+		}
+	}
+	return
+}
+
+// dropTenantIndexes stores the objects of a tenant again without their
+// blind indexes, which would still tell equal values of the shredded tenant
+// apart.
+func dropTenantIndexes(store objectStore, tenant string) (dropped int, err error) {
+	ids, err := store.List()
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		obj, errGet := store.Get(id)
+		if errGet != nil {
+			return dropped, errGet
+		}
+		if obj.Tenant != tenant || len(obj.FieldOneIndex) == 0 && len(obj.FieldTwoIndex) == 0 {
+			continue
+		}
+		obj.FieldOneIndex, obj.FieldTwoIndex = nil, nil
+		err = store.Put(obj)
+		if err != nil {
+			return
+		}
+		dropped++
+	}
+	return
+}
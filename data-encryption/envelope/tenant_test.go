@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestShredTenantFindsEveryFormat(t *testing.T) {
+	useIndexKey(t)
+	createKEK("acme")
+	createKEK("beta")
+	dir := t.TempDir()
+	report := filepath.Join(t.TempDir(), "shred-report.json")
+	viper.Set("output", report)
+	viper.Set("STORE-DIR", dir)
+
+	keys := newDataKeyPolicy("record", 1)
+	seal := func(id, tenant string) SecureObject {
+		obj, err := sealRecord(plainRecord{ID: id, Tenant: tenant, Text1: "a"}, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+	for encoding, id := range map[string]string{"json": "json-object", "cbor": "cbor-object"} {
+		store := &fileStore{dir: dir, encoding: encoding}
+		for _, obj := range []SecureObject{seal(id, "acme"), seal(id+"-beta", "beta")} {
+			err := store.Put(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var jsonl []string
+	for _, obj := range []SecureObject{seal("jsonl-beta", "beta"), seal("jsonl-object", "acme")} {
+		line, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonl = append(jsonl, string(line))
+	}
+	err := os.WriteFile(filepath.Join(dir, "batch.jsonl"), []byte(strings.Join(jsonl, "\n")+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := runCSV(t, "id,tenant,text1,text2\ncsv-beta,beta,a,b\ncsv-object,acme,a,b\n", "enc-batch", func(job batchJob) batchJob {
+		job.object, job.err = sealRecord(job.plain, keys)
+		return job
+	})
+	err = os.WriteFile(filepath.Join(dir, "batch.csv"), []byte(encrypted), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shredTenant("acme", dir)
+
+	content, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shredded := shredReport{}
+	err = json.Unmarshal(content, &shredded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, obj := range shredded.Objects {
+		found = append(found, obj.ID+" "+filepath.Base(obj.Source))
+	}
+	sort.Strings(found)
+	want := []string{
+		"cbor-object cbor-object-encrypted.cbor",
+		"csv-object batch.csv:3",
+		"json-object json-object-encrypted.json",
+		"jsonl-object batch.jsonl:2",
+	}
+	if strings.Join(found, "\n") != strings.Join(want, "\n") {
+		t.Errorf("shredded objects\n%s\nwant\n%s", strings.Join(found, "\n"), strings.Join(want, "\n"))
+	}
+
+	store := &fileStore{dir: dir}
+	for _, id := range []string{"json-object", "cbor-object", "json-object-beta", "cbor-object-beta"} {
+		obj, err := store.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if indexed := len(obj.FieldOneIndex) > 0; indexed != (obj.Tenant == "beta") {
+			t.Errorf("object %s of %s has blind indexes %v", id, obj.Tenant, obj.FieldOneIndex)
+		}
+	}
+}
+
+// TestShredReachesCachedKEKs shreds a tenant from another process, by
+// replacing the keystore, after this one cached the KEK of the tenant.
+func TestShredReachesCachedKEKs(t *testing.T) {
+	useLocalKeys(t)
+	createKEK("acme")
+	obj, err := sealRecord(plainRecord{ID: "1", Tenant: "acme", Text1: "a"}, newDataKeyPolicy("record", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openRecord(obj, &dataKeyCache{keys: map[string]*cachedDataKey{}}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keystore, err := readKeystore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(keystore.Tenants, "acme")
+	err = writeKeystore(keystore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = openRecord(obj, &dataKeyCache{keys: map[string]*cachedDataKey{}}, "", nil)
+	if !errors.Is(err, errUnknownTenant) {
+		t.Errorf("opened an object of a shredded tenant: %v", err)
+	}
+	_, _, err = currentKEK("acme")
+	if !errors.Is(err, errUnknownTenant) {
+		t.Errorf("encrypting for a shredded tenant: %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+	"keyprovider"
+)
+
+// newVaultKeys uses the transit secrets engine of Vault, USER-MASTER-KEY
+// being the name of a transit key. The token is VAULT.TOKEN or the
+// VAULT_TOKEN environment variable.
+//
+//	KEY-PROVIDER: vault
+//	USER-MASTER-KEY: user-master-key
+//	VAULT:
+//	  ADDRESS: http://127.0.0.1:8200
+//	  MOUNT: transit
+func newVaultKeys() *keyprovider.VaultKeys {
+	v := keyprovider.NewVaultKeys(viper.GetString("VAULT.ADDRESS"), viper.GetString("VAULT.MOUNT"),
+		viper.GetString("VAULT.TOKEN"), viper.GetString("VAULT.NAMESPACE"))
+	v.MasterKey = viper.GetString("USER-MASTER-KEY")
+	return v
+}
@@ -0,0 +1,5 @@
+module keyprovider
+
+go 1.16
+
+require github.com/miekg/pkcs11 v1.1.1
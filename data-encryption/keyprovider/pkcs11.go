@@ -0,0 +1,249 @@
+// Package keyprovider keeps the master keys of envelope encryption outside
+// of KMS: in an HSM through PKCS#11 or in Vault transit. Both generate data
+// keys and hand them out wrapped by the master key, which never leaves the
+// HSM or Vault.
+package keyprovider
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS11Keys keeps the master keys in an HSM, MasterKey being the label of
+// the AES key in the token new data keys are wrapped with. Data keys are
+// generated in the token and wrapped there with AES key wrap (RFC 3394).
+// With SoftHSMv2:
+//
+//	softhsm2-util --init-token --free --label envelope --pin 1234 --so-pin 5678
+//	keys, err := keyprovider.NewPKCS11Keys("/usr/lib/softhsm/libsofthsm2.so", "envelope", "1234")
+//	keys.MasterKey = "user-master-key"
+//	err = keys.CreateKey(keys.MasterKey)
+type PKCS11Keys struct {
+	MasterKey string
+
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	keys    map[string]pkcs11.ObjectHandle
+}
+
+// pkcs11WrappedKey marks a data key wrapped in the HSM, followed by the
+// length and label of the master key and the wrapped key.
+const pkcs11WrappedKey = 'P'
+
+// NewPKCS11Keys loads the PKCS#11 module and logs into the token with a
+// label.
+func NewPKCS11Keys(module, tokenLabel, pin string) (p *PKCS11Keys, err error) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("can't load PKCS#11 module %q", module)
+	}
+	err = ctx.Initialize()
+	if err != nil {
+		return
+	}
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return
+	}
+	for _, slot := range slots {
+		token, errToken := ctx.GetTokenInfo(slot)
+		if errToken != nil {
+			return nil, errToken
+		}
+		if strings.TrimSpace(token.Label) != tokenLabel {
+			continue
+		}
+		session, errSession := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if errSession != nil {
+			return nil, errSession
+		}
+		err = ctx.Login(session, pkcs11.CKU_USER, pin)
+		if err != nil {
+			return
+		}
+		return &PKCS11Keys{ctx: ctx, session: session, keys: map[string]pkcs11.ObjectHandle{}}, nil
+	}
+	return nil, fmt.Errorf("no PKCS#11 token labelled %q", tokenLabel)
+}
+
+// Close logs out of the token and unloads the module.
+func (p *PKCS11Keys) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ctx.Logout(p.session)
+	p.ctx.CloseSession(p.session)
+	err := p.ctx.Finalize()
+	p.ctx.Destroy()
+	return err
+}
+
+// masterKey finds the AES key with a label in the token.
+func (p *PKCS11Keys) masterKey(label string) (key pkcs11.ObjectHandle, err error) {
+	if key, ok := p.keys[label]; ok {
+		return key, nil
+	}
+	err = p.ctx.FindObjectsInit(p.session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	})
+	if err != nil {
+		return
+	}
+	found, _, err := p.ctx.FindObjects(p.session, 1)
+	errFinal := p.ctx.FindObjectsFinal(p.session)
+	if err == nil {
+		err = errFinal
+	}
+	if err != nil {
+		return
+	}
+	if len(found) == 0 {
+		return 0, fmt.Errorf("no PKCS#11 key labelled %q", label)
+	}
+	p.keys[label] = found[0]
+	return found[0], nil
+}
+
+// dataKeyTemplate makes session keys the token can hand out, they are
+// destroyed once their value is read.
+func dataKeyTemplate() []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+	}
+}
+
+func (p *PKCS11Keys) keyValue(key pkcs11.ObjectHandle) (value []byte, err error) {
+	attributes, err := p.ctx.GetAttributeValue(p.session, key, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil {
+		return
+	}
+	return attributes[0].Value, nil
+}
+
+// wrap wraps a key of the token with the master key labelled label.
+func (p *PKCS11Keys) wrap(label string, key pkcs11.ObjectHandle) (wrapped []byte, err error) {
+	// the label length is stored in a single byte
+	if len(label) > 255 {
+		return nil, errors.New("key label too long")
+	}
+	master, err := p.masterKey(label)
+	if err != nil {
+		return
+	}
+	blob, err := p.ctx.WrapKey(p.session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP, nil)}, master, key)
+	if err != nil {
+		return
+	}
+	wrapped = append([]byte{pkcs11WrappedKey, byte(len(label))}, label...)
+	return append(wrapped, blob...), nil
+}
+
+func (p *PKCS11Keys) GenerateDataKey() (plaintext, wrapped []byte, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	template := append(dataKeyTemplate(), pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 32))
+	key, err := p.ctx.GenerateKey(p.session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)}, template)
+	if err != nil {
+		return
+	}
+	defer p.ctx.DestroyObject(p.session, key)
+
+	wrapped, err = p.wrap(p.MasterKey, key)
+	if err != nil {
+		return
+	}
+	plaintext, err = p.keyValue(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+func (p *PKCS11Keys) DecryptDataKey(wrapped []byte) (plaintext []byte, err error) {
+	if len(wrapped) < 2 || wrapped[0] != pkcs11WrappedKey || len(wrapped) < 2+int(wrapped[1]) {
+		return nil, errors.New("not a PKCS#11 wrapped key")
+	}
+	label := string(wrapped[2 : 2+int(wrapped[1])])
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	master, err := p.masterKey(label)
+	if err != nil {
+		return
+	}
+	key, err := p.ctx.UnwrapKey(p.session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP, nil)},
+		master, wrapped[2+len(label):], dataKeyTemplate())
+	if err != nil {
+		return
+	}
+	defer p.ctx.DestroyObject(p.session, key)
+	return p.keyValue(key)
+}
+
+// RewrapDataKey wraps a data key with MasterKey, after a rotation to a new
+// master key.
+func (p *PKCS11Keys) RewrapDataKey(wrapped []byte) (rewrapped []byte, err error) {
+	plaintext, err := p.DecryptDataKey(wrapped)
+	if err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, err := p.ctx.CreateObject(p.session, append(dataKeyTemplate(),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, plaintext)))
+	wipe(plaintext)
+	if err != nil {
+		return
+	}
+	defer p.ctx.DestroyObject(p.session, key)
+	return p.wrap(p.MasterKey, key)
+}
+
+// CreateKey generates a master key in the token that can wrap and unwrap
+// but never be read.
+func (p *PKCS11Keys) CreateKey(label string) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err = p.masterKey(label); err == nil {
+		return fmt.Errorf("token already has a key labelled %s", label)
+	}
+	_, err = p.ctx.GenerateKey(p.session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 32),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+			pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+			pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		})
+	return
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,176 @@
+package keyprovider
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	testTokenLabel = "keyprovider-test"
+	testPIN        = "1234"
+	testSOPIN      = "5678"
+)
+
+// newTestPKCS11Keys initializes a token in a SoftHSMv2 token directory of
+// its own. The tests need SOFTHSM2_MODULE, the path of libsofthsm2.so:
+//
+//	SOFTHSM2_MODULE=/usr/lib/softhsm/libsofthsm2.so go test ./...
+func newTestPKCS11Keys(t *testing.T) *PKCS11Keys {
+	t.Helper()
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		t.Skip("SOFTHSM2_MODULE is not set")
+	}
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+	err := os.WriteFile(conf, []byte("directories.tokendir = "+dir+"\nobjectstore.backend = file\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SOFTHSM2_CONF", conf)
+	initTestToken(t, module)
+
+	keys, err := NewPKCS11Keys(module, testTokenLabel, testPIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { keys.Close() })
+	return keys
+}
+
+// initTestToken does what softhsm2-util --init-token --free does.
+func initTestToken(t *testing.T, module string) {
+	t.Helper()
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		t.Fatalf("can't load PKCS#11 module %q", module)
+	}
+	defer ctx.Destroy()
+	err := ctx.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("no free SoftHSM slot: %v", err)
+	}
+	slot := slots[len(slots)-1]
+	err = ctx.InitToken(slot, testSOPIN, testTokenLabel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the initialized token may be moved to another slot id
+	slots, err = ctx.GetSlotList(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, slot := range slots {
+		token, err := ctx.GetTokenInfo(slot)
+		if err != nil || token.Flags&pkcs11.CKF_TOKEN_INITIALIZED == 0 {
+			continue
+		}
+		session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ctx.CloseSession(session)
+		err = ctx.Login(session, pkcs11.CKU_SO, testSOPIN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ctx.Logout(session)
+		err = ctx.InitPIN(session, testPIN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	t.Fatal("initialized token not found")
+}
+
+func TestPKCS11WrapUnwrap(t *testing.T) {
+	keys := newTestPKCS11Keys(t)
+	keys.MasterKey = "user-master-key"
+	err := keys.CreateKey(keys.MasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.CreateKey(keys.MasterKey) == nil {
+		t.Error("a second key with the same label was created")
+	}
+
+	plaintext, wrapped, err := keys.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plaintext) != 32 {
+		t.Fatalf("data key has %d bytes, want 32", len(plaintext))
+	}
+	if bytes.Contains(wrapped, plaintext) {
+		t.Fatal("wrapped data key contains the plaintext")
+	}
+	unwrapped, err := keys.DecryptDataKey(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, plaintext) {
+		t.Fatal("unwrapped data key differs from the generated one")
+	}
+
+	wrapped[len(wrapped)-1] ^= 1
+	if _, err = keys.DecryptDataKey(wrapped); err == nil {
+		t.Error("a tampered data key was unwrapped")
+	}
+	if _, err = keys.DecryptDataKey([]byte("not wrapped")); err == nil {
+		t.Error("a data key of another provider was unwrapped")
+	}
+}
+
+func TestPKCS11Rotation(t *testing.T) {
+	keys := newTestPKCS11Keys(t)
+	for _, label := range []string{"master-1", "master-2"} {
+		err := keys.CreateKey(label)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys.MasterKey = "master-1"
+	plaintext, wrapped, err := keys.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys.MasterKey = "master-2"
+	rewrapped, err := keys.RewrapDataKey(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(rewrapped, append([]byte{pkcs11WrappedKey, byte(len("master-2"))}, "master-2"...)) {
+		t.Fatal("rewrapped data key doesn't name the new master key")
+	}
+	for _, w := range [][]byte{wrapped, rewrapped} {
+		unwrapped, err := keys.DecryptDataKey(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(unwrapped, plaintext) {
+			t.Fatal("data key changed across the rotation")
+		}
+	}
+}
+
+// TestPKCS11LabelTooLong needs no token, the label is checked before the
+// master key is looked up.
+func TestPKCS11LabelTooLong(t *testing.T) {
+	_, err := (&PKCS11Keys{}).wrap(strings.Repeat("k", 256), 0)
+	if err == nil || err.Error() != "key label too long" {
+		t.Errorf("expected a label too long error, got %v", err)
+	}
+}
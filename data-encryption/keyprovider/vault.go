@@ -0,0 +1,156 @@
+package keyprovider
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// VaultKeys uses the transit secrets engine of Vault, MasterKey being the
+// name of the transit key new data keys are wrapped with.
+//
+//	keys := keyprovider.NewVaultKeys("http://127.0.0.1:8200", "transit", "", "")
+//	keys.MasterKey = "user-master-key"
+type VaultKeys struct {
+	MasterKey string
+
+	address   string
+	mount     string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+// vaultWrappedKey marks a data key wrapped by Vault, followed by the length
+// and name of the transit key and the vault:v<n>: ciphertext.
+const vaultWrappedKey = 'V'
+
+type vaultResponse struct {
+	Data struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// NewVaultKeys uses the transit engine mounted at mount, "transit" by
+// default. The token defaults to the VAULT_TOKEN environment variable.
+func NewVaultKeys(address, mount, token, namespace string) *VaultKeys {
+	if mount == "" {
+		mount = "transit"
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	return &VaultKeys{
+		address:   strings.TrimSuffix(address, "/"),
+		mount:     strings.Trim(mount, "/"),
+		token:     token,
+		namespace: namespace,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (v *VaultKeys) call(operation, name string, body map[string]interface{}) (result vaultResponse, err error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	endpoint := fmt.Sprintf("%s/v1/%s/%s/%s", v.address, v.mount, operation, url.PathEscape(name))
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("vault %s %s: %s %s", operation, name, resp.Status, strings.Join(result.Errors, ", "))
+	}
+	return
+}
+
+func vaultWrap(name, ciphertext string) []byte {
+	wrapped := append([]byte{vaultWrappedKey, byte(len(name))}, name...)
+	return append(wrapped, ciphertext...)
+}
+
+func vaultUnwrap(wrapped []byte) (name, ciphertext string, err error) {
+	if len(wrapped) < 2 || wrapped[0] != vaultWrappedKey || len(wrapped) < 2+int(wrapped[1]) {
+		return "", "", errors.New("not a vault wrapped key")
+	}
+	return string(wrapped[2 : 2+int(wrapped[1])]), string(wrapped[2+int(wrapped[1]):]), nil
+}
+
+func (v *VaultKeys) GenerateDataKey() (plaintext, wrapped []byte, err error) {
+	name := v.MasterKey
+	if len(name) > 255 {
+		return nil, nil, errors.New("key name too long")
+	}
+	result, err := v.call("datakey/plaintext", name, map[string]interface{}{"bits": 256})
+	if err != nil {
+		return
+	}
+	plaintext, err = base64.StdEncoding.DecodeString(result.Data.Plaintext)
+	if err != nil {
+		return
+	}
+	return plaintext, vaultWrap(name, result.Data.Ciphertext), nil
+}
+
+func (v *VaultKeys) DecryptDataKey(wrapped []byte) (plaintext []byte, err error) {
+	name, ciphertext, err := vaultUnwrap(wrapped)
+	if err != nil {
+		return
+	}
+	result, err := v.call("decrypt", name, map[string]interface{}{"ciphertext": ciphertext})
+	if err != nil {
+		return
+	}
+	return base64.StdEncoding.DecodeString(result.Data.Plaintext)
+}
+
+// RewrapDataKey wraps a data key under the latest version of its transit
+// key inside Vault. Moving to another key than MasterKey goes through
+// decrypt, transit has no rewrap between keys.
+func (v *VaultKeys) RewrapDataKey(wrapped []byte) (rewrapped []byte, err error) {
+	name, ciphertext, err := vaultUnwrap(wrapped)
+	if err != nil {
+		return
+	}
+	if name != v.MasterKey {
+		plaintext, errDecrypt := v.DecryptDataKey(wrapped)
+		if errDecrypt != nil {
+			return nil, errDecrypt
+		}
+		result, errEncrypt := v.call("encrypt", v.MasterKey, map[string]interface{}{
+			"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+		})
+		wipe(plaintext)
+		if errEncrypt != nil {
+			return nil, errEncrypt
+		}
+		return vaultWrap(v.MasterKey, result.Data.Ciphertext), nil
+	}
+	result, err := v.call("rewrap", name, map[string]interface{}{"ciphertext": ciphertext})
+	if err != nil {
+		return
+	}
+	return vaultWrap(name, result.Data.Ciphertext), nil
+}
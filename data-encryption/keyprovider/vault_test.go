@@ -0,0 +1,245 @@
+package keyprovider
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testVaultToken = "test-token"
+
+// transit is a stand-in for the transit secrets engine mounted at
+// /v1/transit, keys are created on first use like with a policy allowing
+// it. Ciphertexts are vault:v<version>:<base64 nonce and sealed text>.
+type transit struct {
+	mu   sync.Mutex
+	keys map[string][][]byte
+}
+
+func newTransit(t *testing.T) (*transit, *httptest.Server) {
+	tr := &transit{keys: map[string][][]byte{}}
+	server := httptest.NewServer(tr)
+	t.Cleanup(server.Close)
+	return tr, server
+}
+
+// rotate adds a key version, like POST /v1/transit/keys/<name>/rotate.
+func (tr *transit) rotate(name string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.addVersion(name)
+}
+
+func (tr *transit) addVersion(name string) {
+	key := make([]byte, 32)
+	io.ReadFull(rand.Reader, key)
+	tr.keys[name] = append(tr.keys[name], key)
+}
+
+func (tr *transit) versions(name string) [][]byte {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if len(tr.keys[name]) == 0 {
+		tr.addVersion(name)
+	}
+	return tr.keys[name]
+}
+
+func (tr *transit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != testVaultToken {
+		transitError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1/transit/")
+	i := strings.LastIndex(path, "/")
+	if r.Method != http.MethodPost || i < 0 {
+		transitError(w, http.StatusNotFound, "unsupported path")
+		return
+	}
+	operation, name := path[:i], path[i+1:]
+	var input struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+		Bits       int    `json:"bits"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		transitError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	versions := tr.versions(name)
+
+	output := map[string]string{}
+	switch operation {
+	case "datakey/plaintext":
+		plaintext := make([]byte, input.Bits/8)
+		io.ReadFull(rand.Reader, plaintext)
+		output["plaintext"] = base64.StdEncoding.EncodeToString(plaintext)
+		output["ciphertext"], err = transitSeal(versions, output["plaintext"])
+	case "encrypt":
+		output["ciphertext"], err = transitSeal(versions, input.Plaintext)
+	case "decrypt":
+		output["plaintext"], err = transitOpen(versions, input.Ciphertext)
+	case "rewrap":
+		var plaintext string
+		plaintext, err = transitOpen(versions, input.Ciphertext)
+		if err == nil {
+			output["ciphertext"], err = transitSeal(versions, plaintext)
+		}
+	default:
+		transitError(w, http.StatusNotFound, "unsupported path")
+		return
+	}
+	if err != nil {
+		transitError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": output})
+}
+
+func transitError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": {message}})
+}
+
+func transitSeal(versions [][]byte, plaintext string) (ciphertext string, err error) {
+	gcm, err := transitGCM(versions[len(versions)-1])
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	io.ReadFull(rand.Reader, nonce)
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return fmt.Sprintf("vault:v%d:%s", len(versions), base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+func transitOpen(versions [][]byte, ciphertext string) (plaintext string, err error) {
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return "", fmt.Errorf("invalid ciphertext")
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(parts[1], "v"))
+	if err != nil || version < 1 || version > len(versions) {
+		return "", fmt.Errorf("invalid key version")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return
+	}
+	gcm, err := transitGCM(versions[version-1])
+	if err != nil {
+		return
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("invalid ciphertext")
+	}
+	opened, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	return string(opened), err
+}
+
+func transitGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyVersion is the transit key version a wrapped data key was sealed by.
+func keyVersion(t *testing.T, wrapped []byte) string {
+	t.Helper()
+	_, ciphertext, err := vaultUnwrap(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitN(ciphertext, ":", 3)[1]
+}
+
+func TestVaultWrapUnwrap(t *testing.T) {
+	_, server := newTransit(t)
+	keys := NewVaultKeys(server.URL, "", testVaultToken, "")
+	keys.MasterKey = "user-master-key"
+
+	plaintext, wrapped, err := keys.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plaintext) != 32 {
+		t.Fatalf("data key has %d bytes, want 32", len(plaintext))
+	}
+	name, _, err := vaultUnwrap(wrapped)
+	if err != nil || name != keys.MasterKey {
+		t.Fatalf("wrapped data key names key %q: %v", name, err)
+	}
+	unwrapped, err := keys.DecryptDataKey(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, plaintext) {
+		t.Fatal("unwrapped data key differs from the generated one")
+	}
+
+	if _, err = keys.DecryptDataKey([]byte("not wrapped")); err == nil {
+		t.Error("a data key of another provider was unwrapped")
+	}
+	denied := NewVaultKeys(server.URL, "transit", "wrong-token", "")
+	if _, err = denied.DecryptDataKey(wrapped); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("expected a permission denied error, got %v", err)
+	}
+}
+
+func TestVaultKeyVersionRotation(t *testing.T) {
+	tr, server := newTransit(t)
+	keys := NewVaultKeys(server.URL, "transit", testVaultToken, "")
+	keys.MasterKey = "user-master-key"
+
+	plaintext, wrapped, err := keys.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.rotate(keys.MasterKey)
+
+	rewrapped, err := keys.RewrapDataKey(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before, after := keyVersion(t, wrapped), keyVersion(t, rewrapped); before != "v1" || after != "v2" {
+		t.Fatalf("rewrap moved the data key from %s to %s, want v1 to v2", before, after)
+	}
+	for _, w := range [][]byte{wrapped, rewrapped} {
+		unwrapped, err := keys.DecryptDataKey(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(unwrapped, plaintext) {
+			t.Fatal("data key changed across the rotation")
+		}
+	}
+
+	keys.MasterKey = "next-master-key"
+	moved, err := keys.RewrapDataKey(rewrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _, _ := vaultUnwrap(moved); name != keys.MasterKey {
+		t.Fatalf("data key moved to key %q, want %q", name, keys.MasterKey)
+	}
+	unwrapped, err := keys.DecryptDataKey(moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, plaintext) {
+		t.Fatal("data key changed moving to another transit key")
+	}
+}
@@ -69,6 +69,21 @@ func main() {
 }
 
 func generateDataKey() *kms.GenerateDataKeyOutput {
+	if viper.GetString("KEY-PROVIDER") == "pkcs11" {
+		plaintext, wrapped, err := hsmKeys().GenerateDataKey()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return &kms.GenerateDataKeyOutput{Plaintext: plaintext, CiphertextBlob: wrapped}
+	}
+	if viper.GetString("KEY-PROVIDER") == "vault" {
+		plaintext, wrapped, err := newVaultKeys().GenerateDataKey()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return &kms.GenerateDataKeyOutput{Plaintext: plaintext, CiphertextBlob: wrapped}
+	}
+
 	region := viper.GetString("REGION")
 	svc := kms.New(session.New(),
 		aws.NewConfig().WithRegion(region))
@@ -89,6 +104,21 @@ func generateDataKey() *kms.GenerateDataKeyOutput {
 }
 
 func decryptDataKey(datakey []byte) (dataKeyPlain []byte) {
+	if viper.GetString("KEY-PROVIDER") == "pkcs11" {
+		dataKeyPlain, err := hsmKeys().DecryptDataKey(datakey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return dataKeyPlain
+	}
+	if viper.GetString("KEY-PROVIDER") == "vault" {
+		dataKeyPlain, err := newVaultKeys().DecryptDataKey(datakey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return dataKeyPlain
+	}
+
 	region := viper.GetString("REGION")
 	svc := kms.New(session.New(),
 		aws.NewConfig().WithRegion(region))
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"keyprovider"
+)
+
+// The master key is the AES key labelled USER-MASTER-KEY in the token, with
+// SoftHSMv2:
+//
+//	softhsm2-util --init-token --free --label envelope --pin 1234 --so-pin 5678
+//	pkcs11-tool --module /usr/lib/softhsm/libsofthsm2.so --login --pin 1234 \
+//	  --token-label envelope --keygen --key-type AES:32 --label user-master-key \
+//	  --sensitive --extractable=false --usage-wrap
+
+var (
+	hsmOnce sync.Once
+	hsm     *keyprovider.PKCS11Keys
+)
+
+// hsmKeys opens the token once, for KEY-PROVIDER pkcs11.
+func hsmKeys() *keyprovider.PKCS11Keys {
+	hsmOnce.Do(func() {
+		var err error
+		hsm, err = keyprovider.NewPKCS11Keys(viper.GetString("PKCS11.MODULE"),
+			viper.GetString("PKCS11.TOKEN-LABEL"), viper.GetString("PKCS11.PIN"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		hsm.MasterKey = viper.GetString("USER-MASTER-KEY")
+	})
+	return hsm
+}
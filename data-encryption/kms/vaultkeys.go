@@ -0,0 +1,15 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+	"keyprovider"
+)
+
+// newVaultKeys wraps data keys with the transit key USER-MASTER-KEY, for
+// KEY-PROVIDER vault. The token is VAULT.TOKEN or VAULT_TOKEN.
+func newVaultKeys() *keyprovider.VaultKeys {
+	v := keyprovider.NewVaultKeys(viper.GetString("VAULT.ADDRESS"), viper.GetString("VAULT.MOUNT"),
+		viper.GetString("VAULT.TOKEN"), viper.GetString("VAULT.NAMESPACE"))
+	v.MasterKey = viper.GetString("USER-MASTER-KEY")
+	return v
+}
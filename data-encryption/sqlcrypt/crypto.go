@@ -0,0 +1,261 @@
+package sqlcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// KeyProvider generates and unwraps data keys.
+type KeyProvider interface {
+	GenerateDataKey() (plaintext, wrapped []byte, err error)
+	DecryptDataKey(wrapped []byte) (plaintext []byte, err error)
+}
+
+// KMSKeys wraps data keys with a KMS key.
+type KMSKeys struct {
+	svc   *kms.KMS
+	keyID string
+}
+
+func NewKMSKeys(region, keyID string) *KMSKeys {
+	return &KMSKeys{
+		svc: kms.New(session.New(),
+			aws.NewConfig().WithRegion(region)),
+		keyID: keyID,
+	}
+}
+
+func (k *KMSKeys) GenerateDataKey() (plaintext, wrapped []byte, err error) {
+	result, err := k.svc.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(k.keyID),
+		KeySpec: aws.String("AES_256"),
+	})
+	if err != nil {
+		return
+	}
+	return result.Plaintext, result.CiphertextBlob, nil
+}
+
+func (k *KMSKeys) DecryptDataKey(wrapped []byte) (plaintext []byte, err error) {
+	result, err := k.svc.Decrypt(&kms.DecryptInput{
+		CiphertextBlob: wrapped,
+		KeyId:          aws.String(k.keyID),
+	})
+	if err != nil {
+		return
+	}
+	return result.Plaintext, nil
+}
+
+// ciphertextPrefix starts every encrypted value, followed by the base64 of
+// the length of the column (1 byte), the table.column the value was written
+// to, the wrapped data key length (2 bytes), the wrapped data key, the nonce
+// and the AES-GCM ciphertext. The column is the additional data of the
+// ciphertext, a value copied to another column doesn't decrypt there.
+const ciphertextPrefix = "sqlcrypt:v2:"
+
+const maxCachedKeys = 1000
+
+// IsEncrypted reports whether a value read without the driver is a
+// sqlcrypt ciphertext.
+func IsEncrypted(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(ciphertextPrefix))
+}
+
+type crypter struct {
+	columns      map[string]map[string]bool
+	keys         KeyProvider
+	valuesPerKey int
+
+	mu      sync.Mutex
+	current *dataKey
+	cache   map[string][]byte
+}
+
+type dataKey struct {
+	plaintext []byte
+	wrapped   []byte
+	uses      int
+}
+
+func newCrypter(cfg Config) *crypter {
+	c := &crypter{
+		columns:      map[string]map[string]bool{},
+		keys:         cfg.Keys,
+		valuesPerKey: cfg.ValuesPerKey,
+		cache:        map[string][]byte{},
+	}
+	if c.valuesPerKey <= 0 {
+		c.valuesPerKey = 1000
+	}
+	for table, columns := range cfg.Columns {
+		c.columns[strings.ToLower(table)] = map[string]bool{}
+		for _, column := range columns {
+			c.columns[strings.ToLower(table)][strings.ToLower(column)] = true
+		}
+	}
+	return c
+}
+
+func (c *crypter) hasEncryptedColumns(table string) bool {
+	return len(c.columns[strings.ToLower(table)]) > 0
+}
+
+// encryptedColumn returns table.column when the column is encrypted, the
+// additional data its values are bound to.
+func (c *crypter) encryptedColumn(table, column string) string {
+	table, column = strings.ToLower(table), strings.ToLower(column)
+	if !c.columns[table][column] {
+		return ""
+	}
+	return table + "." + column
+}
+
+func (c *crypter) dataKey() (key *dataKey, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current == nil || c.current.uses >= c.valuesPerKey {
+		plaintext, wrapped, errGenerate := c.keys.GenerateDataKey()
+		if errGenerate != nil {
+			return nil, errGenerate
+		}
+		c.current = &dataKey{plaintext: plaintext, wrapped: wrapped}
+	}
+	c.current.uses++
+	return c.current, nil
+}
+
+func (c *crypter) unwrap(wrapped []byte) (plaintext []byte, err error) {
+	c.mu.Lock()
+	plaintext, ok := c.cache[string(wrapped)]
+	c.mu.Unlock()
+	if ok {
+		return
+	}
+
+	plaintext, err = c.keys.DecryptDataKey(wrapped)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	if len(c.cache) >= maxCachedKeys {
+		c.cache = map[string][]byte{}
+	}
+	c.cache[string(wrapped)] = plaintext
+	c.mu.Unlock()
+	return
+}
+
+func (c *crypter) encrypt(value driver.Value, column string) (ciphertext string, err error) {
+	plaintext, err := valueText(value)
+	if err != nil {
+		return
+	}
+	key, err := c.dataKey()
+	if err != nil {
+		return
+	}
+	gcm, err := newGCM(key.plaintext)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return
+	}
+
+	if len(column) > 255 {
+		return "", fmt.Errorf("sqlcrypt: column name %s is too long", column)
+	}
+	blob := make([]byte, 0, 3+len(column)+len(key.wrapped)+len(nonce)+len(plaintext)+gcm.Overhead())
+	blob = append(blob, byte(len(column)))
+	blob = append(blob, column...)
+	blob = append(blob, byte(len(key.wrapped)>>8), byte(len(key.wrapped)))
+	blob = append(blob, key.wrapped...)
+	blob = append(blob, nonce...)
+	blob = gcm.Seal(blob, nonce, plaintext, []byte(column))
+	return ciphertextPrefix + base64.StdEncoding.EncodeToString(blob), nil
+}
+
+// decrypt returns the plaintext of a ciphertext and the table.column it
+// was written to.
+func (c *crypter) decrypt(value []byte) (column string, plaintext []byte, err error) {
+	blob, err := base64.StdEncoding.DecodeString(string(value[len(ciphertextPrefix):]))
+	if err != nil {
+		return
+	}
+	if len(blob) < 1 || len(blob) < 3+int(blob[0]) {
+		return "", nil, errors.New("sqlcrypt: ciphertext too short")
+	}
+	column, blob = string(blob[1:1+blob[0]]), blob[1+blob[0]:]
+	size := int(binary.BigEndian.Uint16(blob))
+	if len(blob) < 2+size {
+		return "", nil, errors.New("sqlcrypt: ciphertext too short")
+	}
+	wrapped, rest := blob[2:2+size], blob[2+size:]
+
+	key, err := c.unwrap(wrapped)
+	if err != nil {
+		return
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return
+	}
+	if len(rest) < gcm.NonceSize() {
+		return "", nil, errors.New("sqlcrypt: ciphertext too short")
+	}
+	// a non-nil dst keeps an empty value from scanning as NULL
+	plaintext, err = gcm.Open([]byte{}, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], []byte(column))
+	return
+}
+
+// valueText turns a parameter into the text MySQL would have stored, so the
+// decrypted value scans into the same Go types as before.
+func valueText(value driver.Value) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case int64:
+		return []byte(strconv.FormatInt(v, 10)), nil
+	case uint64:
+		return []byte(strconv.FormatUint(v, 10)), nil
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'g', -1, 64)), nil
+	case bool:
+		if v {
+			return []byte("1"), nil
+		}
+		return []byte("0"), nil
+	case time.Time:
+		return []byte(v.Format("2006-01-02 15:04:05.999999")), nil
+	}
+	return nil, fmt.Errorf("sqlcrypt: can't encrypt %T", value)
+}
+
+func newGCM(key []byte) (gcm cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,146 @@
+package sqlcrypt
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+)
+
+// staticKeys hands out one data key, "wrapped" as itself.
+type staticKeys struct{}
+
+func (staticKeys) GenerateDataKey() (plaintext, wrapped []byte, err error) {
+	key := bytes.Repeat([]byte{7}, 32)
+	return key, key, nil
+}
+
+func (staticKeys) DecryptDataKey(wrapped []byte) (plaintext []byte, err error) {
+	return wrapped, nil
+}
+
+func newTestCrypter() *crypter {
+	return newCrypter(Config{
+		Columns: map[string][]string{"weather": {"temp", "humidity"}},
+		Keys:    staticKeys{},
+	})
+}
+
+func TestCiphertextIsBoundToColumn(t *testing.T) {
+	c := newTestCrypter()
+	ciphertext, err := c.encrypt(21.5, "weather.temp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	column, plaintext, err := c.decrypt([]byte(ciphertext))
+	if err != nil || column != "weather.temp" || string(plaintext) != "21.5" {
+		t.Fatalf("decrypted %s %q, %v", column, plaintext, err)
+	}
+
+	// rename the column stored in the ciphertext
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, ciphertextPrefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(blob[1:], "weather.tmep")
+	forged := ciphertextPrefix + base64.StdEncoding.EncodeToString(blob)
+	if _, _, err = c.decrypt([]byte(forged)); err == nil {
+		t.Error("decrypted a ciphertext with another column")
+	}
+}
+
+// fakeRows returns one row of values under the given column names.
+type fakeRows struct {
+	columns []string
+	values  []driver.Value
+	done    bool
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+	return nil
+}
+
+func TestRowsCheckColumn(t *testing.T) {
+	c := newTestCrypter()
+	temp, err := c.encrypt("21.5", "weather.temp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	humidity, err := c.encrypt("80", "weather.humidity")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := make([]driver.Value, 3)
+	r := &rows{Rows: &fakeRows{columns: []string{"id", "TEMP", "humidity"}, values: []driver.Value{int64(1), []byte(temp), humidity}}, crypt: c, tables: []string{"weather"}}
+	err = r.Next(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dest[1].([]byte)) != "21.5" || string(dest[2].([]byte)) != "80" {
+		t.Errorf("read %q %q", dest[1], dest[2])
+	}
+
+	// humidity copied into the temp column
+	r = &rows{Rows: &fakeRows{columns: []string{"temp"}, values: []driver.Value{[]byte(humidity)}}, crypt: c, tables: []string{"weather"}}
+	if err = r.Next(dest[:1]); err == nil || !strings.Contains(err.Error(), "weather.humidity read as column temp") {
+		t.Errorf("got %v reading humidity as temp", err)
+	}
+}
+
+func TestRowsCheckTable(t *testing.T) {
+	c := newCrypter(Config{
+		Columns: map[string][]string{"weather": {"temp"}, "archive": {"temp"}},
+		Keys:    staticKeys{},
+	})
+	archived, err := c.encrypt("21.5", "archive.temp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(query string) error {
+		r := &rows{Rows: &fakeRows{columns: []string{"temp"}, values: []driver.Value{[]byte(archived)}}, crypt: c, tables: readTables(query)}
+		return r.Next(make([]driver.Value, 1))
+	}
+	err = read("SELECT temp FROM archive WHERE id = ?")
+	if err != nil {
+		t.Errorf("reading archive.temp from archive: %v", err)
+	}
+	// the archived value copied into weather.temp
+	err = read("SELECT temp FROM weather WHERE id = ?")
+	if err == nil || !strings.Contains(err.Error(), "archive.temp read as column temp from weather") {
+		t.Errorf("got %v reading archive.temp from weather", err)
+	}
+	err = read("SELECT 'x' AS temp")
+	if err == nil {
+		t.Error("read archive.temp from no table")
+	}
+}
+
+func TestDriverDecryptChecksColumn(t *testing.T) {
+	d := NewDriver(Config{Keys: staticKeys{}})
+	ciphertext, err := d.Encrypt([]byte("21.5"), "Weather", "Temp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := d.Decrypt([]byte(ciphertext), "weather", "temp")
+	if err != nil || string(plaintext) != "21.5" {
+		t.Fatalf("decrypted %q, %v", plaintext, err)
+	}
+	if _, err = d.Decrypt([]byte(ciphertext), "weather", "temp_encrypted"); err == nil {
+		t.Error("decrypted weather.temp as weather.temp_encrypted")
+	}
+	if _, err = d.Decrypt([]byte("21.5"), "weather", "temp"); err == nil {
+		t.Error("decrypted a plaintext")
+	}
+}
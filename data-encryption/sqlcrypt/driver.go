@@ -0,0 +1,355 @@
+// Package sqlcrypt is a database/sql driver wrapping go-sql-driver/mysql
+// that encrypts configured columns in INSERT, REPLACE and UPDATE parameters
+// and decrypts them again on Scan, using the envelope data key scheme: every
+// value carries the wrapped data key it was encrypted with.
+//
+//	sqlcrypt.Register("mysql-encrypted", sqlcrypt.Config{
+//		Columns: map[string][]string{"weather": {"temp", "humidity"}},
+//		Keys:    sqlcrypt.NewKMSKeys("ap-southeast-1", "alias/user-master-key"),
+//	})
+//	db, err := sql.Open("mysql-encrypted", dsn)
+//
+// Only values bound with ? placeholders are encrypted, values written as
+// SQL literals are sent as they are. A write the driver can't map every
+// placeholder of to its column fails instead, such as an INSERT without a
+// column list. Encrypted columns must be able to hold the longer ciphertext
+// (VARCHAR, TEXT or BLOB) and can't be compared in a WHERE clause since
+// every value is encrypted with a random nonce.
+//
+// Every ciphertext is bound to the table.column it was written to, and
+// only decrypts when read as a column of that name by a query on that table
+// (following FROM or JOIN): a value copied to another column or another
+// table fails to read, so does an encrypted column selected under an alias.
+// A join of two tables encrypting a column of the same name can't tell
+// their values apart. Renaming an encrypted column or its table means
+// encrypting it again.
+package sqlcrypt
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/spf13/viper"
+)
+
+// Config selects the encrypted columns per table and the key provider
+// wrapping the data keys.
+type Config struct {
+	Columns map[string][]string
+	Keys    KeyProvider
+
+	// ValuesPerKey is the number of values encrypted under one data key
+	// before a new one is generated, 1000 when zero.
+	ValuesPerKey int
+}
+
+// Driver wraps the mysql driver.
+type Driver struct {
+	mysql mysql.MySQLDriver
+	crypt *crypter
+}
+
+// Register makes the driver available to sql.Open under name.
+func Register(name string, cfg Config) {
+	sql.Register(name, NewDriver(cfg))
+}
+
+func NewDriver(cfg Config) *Driver {
+	return &Driver{crypt: newCrypter(cfg)}
+}
+
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.mysql.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: c, crypt: d.crypt}, nil
+}
+
+func (d *Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	c, err := d.mysql.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return d.Connector(c), nil
+}
+
+// Connector encrypts the connections of another mysql connector, such as
+// one following a rotated credential:
+//
+//	db := sql.OpenDB(sqlcrypt.NewDriver(cfg).Connector(rotating))
+func (d *Driver) Connector(c driver.Connector) driver.Connector {
+	return &connector{Connector: c, driver: d}
+}
+
+// ConnectorFromViper encrypts the connections of connector with the
+// ENCRYPTED-COLUMNS of each table in v, data keys wrapped by the KMS key
+// USER-MASTER-KEY in region. The connector is returned as it is when no
+// column is encrypted.
+//
+//	ENCRYPTED-COLUMNS:
+//	  weather: [temp, humidity]
+//	USER-MASTER-KEY: alias/user-master-key
+func ConnectorFromViper(v *viper.Viper, region string, connector driver.Connector) driver.Connector {
+	columns := v.GetStringMapStringSlice("ENCRYPTED-COLUMNS")
+	if len(columns) == 0 {
+		return connector
+	}
+	return NewDriver(Config{
+		Columns: columns,
+		Keys:    NewKMSKeys(region, v.GetString("USER-MASTER-KEY")),
+	}).Connector(connector)
+}
+
+// Encrypt returns the ciphertext the driver writes for value to
+// table.column, for tools storing it under another name first, like
+// column-migration filling the column that replaces table.column.
+func (d *Driver) Encrypt(value driver.Value, table, column string) (string, error) {
+	return d.crypt.encrypt(value, strings.ToLower(table+"."+column))
+}
+
+// Decrypt returns the plaintext of a ciphertext written to table.column.
+func (d *Driver) Decrypt(ciphertext []byte, table, column string) (plaintext []byte, err error) {
+	if !IsEncrypted(ciphertext) {
+		return nil, errors.New("sqlcrypt: not a ciphertext")
+	}
+	bound, plaintext, err := d.crypt.decrypt(ciphertext)
+	if err != nil {
+		return
+	}
+	if want := strings.ToLower(table + "." + column); bound != want {
+		return nil, fmt.Errorf("sqlcrypt: value of %s read as %s", bound, want)
+	}
+	return
+}
+
+type connector struct {
+	driver.Connector
+	driver *Driver
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	inner, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: inner, crypt: c.driver.crypt}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// conn implements no Execer or Queryer, so database/sql prepares every
+// statement and the parameters always pass through stmt.
+type conn struct {
+	driver.Conn
+	crypt *crypter
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (s driver.Stmt, err error) {
+	encrypted, err := c.crypt.encryptedPlaceholders(query)
+	if err != nil {
+		return
+	}
+	if prep, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		s, err = prep.PrepareContext(ctx, query)
+	} else {
+		s, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return
+	}
+	return &stmt{Stmt: s, crypt: c.crypt, encrypted: encrypted, tables: readTables(query)}, nil
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if begin, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return begin.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *conn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *conn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type stmt struct {
+	driver.Stmt
+	crypt     *crypter
+	encrypted map[int]string // table.column of encrypted placeholders by 1-based ordinal
+	tables    []string       // tables the query reads
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	args, err := s.encryptArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if exec, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return exec.ExecContext(ctx, args)
+	}
+	return s.Stmt.Exec(namedToValues(args))
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (r driver.Rows, err error) {
+	args, err = s.encryptArgs(args)
+	if err != nil {
+		return
+	}
+	if query, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		r, err = query.QueryContext(ctx, args)
+	} else {
+		r, err = s.Stmt.Query(namedToValues(args))
+	}
+	if err != nil {
+		return
+	}
+	return &rows{Rows: r, crypt: s.crypt, tables: s.tables}, nil
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), valuesToNamed(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), valuesToNamed(args))
+}
+
+func (s *stmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (s *stmt) encryptArgs(args []driver.NamedValue) ([]driver.NamedValue, error) {
+	if len(s.encrypted) == 0 {
+		return args, nil
+	}
+	encrypted := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		encrypted[i] = arg
+		column, ok := s.encrypted[arg.Ordinal]
+		if !ok || isNull(arg.Value) {
+			continue
+		}
+		value, err := s.crypt.encrypt(arg.Value, column)
+		if err != nil {
+			return nil, err
+		}
+		encrypted[i].Value = value
+	}
+	return encrypted, nil
+}
+
+// rows decrypts every value carrying the ciphertext prefix, checking it is
+// read as the column it was written to, from one of the tables of the query.
+type rows struct {
+	driver.Rows
+	crypt   *crypter
+	tables  []string
+	columns []string
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err != nil {
+		return err
+	}
+	if r.columns == nil {
+		r.columns = r.Rows.Columns()
+	}
+	for i, value := range dest {
+		var raw []byte
+		switch v := value.(type) {
+		case []byte:
+			raw = v
+		case string:
+			raw = []byte(v)
+		default:
+			continue
+		}
+		if !IsEncrypted(raw) {
+			continue
+		}
+		column, plaintext, err := r.crypt.decrypt(raw)
+		if err != nil {
+			return err
+		}
+		dot := strings.LastIndex(column, ".")
+		if dot < 0 || !strings.EqualFold(column[dot+1:], r.columns[i]) || !r.reads(column[:dot]) {
+			return fmt.Errorf("sqlcrypt: value of %s read as column %s from %s",
+				column, r.columns[i], strings.Join(r.tables, ", "))
+		}
+		dest[i] = plaintext
+	}
+	return nil
+}
+
+func (r *rows) reads(table string) bool {
+	for _, t := range r.tables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// isNull reports whether mysql sends the value as NULL, a nil []byte
+// included.
+func isNull(value driver.Value) bool {
+	if b, ok := value.([]byte); ok {
+		return b == nil
+	}
+	return value == nil
+}
+
+func namedToValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+func valuesToNamed(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
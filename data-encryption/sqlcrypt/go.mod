@@ -0,0 +1,9 @@
+module sqlcrypt
+
+go 1.16
+
+require (
+	github.com/aws/aws-sdk-go v1.42.48
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/spf13/viper v1.9.0
+)
@@ -0,0 +1,320 @@
+package sqlcrypt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// token is a piece of a query, ordinal is set for ? placeholders.
+type token struct {
+	text    string
+	ordinal int
+}
+
+func (t token) is(keyword string) bool {
+	return strings.EqualFold(t.text, keyword)
+}
+
+// tokenize splits a query into identifiers, keywords, literals and single
+// punctuation characters, dropping whitespace and comments. Backquoted
+// identifiers are unquoted, string literals are kept whole so a ? inside
+// them is not taken as a placeholder, nor is one in a comment.
+func tokenize(query string) (tokens []token) {
+	ordinal := 0
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#' || strings.HasPrefix(query[i:], "--") && (i+2 == len(query) || query[i+2] <= ' '):
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return
+			}
+			i += end + 4
+		case c == '\'' || c == '"' || c == '`':
+			// a quote is escaped by doubling it, or by a backslash in
+			// string literals
+			j := i + 1
+			for j < len(query) && (query[j] != c || j+1 < len(query) && query[j+1] == c) {
+				if query[j] == c || query[j] == '\\' && c != '`' {
+					j++
+				}
+				j++
+			}
+			if c == '`' {
+				name := query[i+1 : min(j, len(query))]
+				tokens = append(tokens, token{text: strings.ReplaceAll(name, "``", "`")})
+			} else {
+				tokens = append(tokens, token{text: query[i:min(j+1, len(query))]})
+			}
+			i = j + 1
+		case c == '?':
+			ordinal++
+			tokens = append(tokens, token{text: "?", ordinal: ordinal})
+			i++
+		case isWordChar(c):
+			j := i
+			for j < len(query) && isWordChar(query[j]) {
+				j++
+			}
+			tokens = append(tokens, token{text: query[i:j]})
+			i = j
+		default:
+			tokens = append(tokens, token{text: string(c)})
+			i++
+		}
+	}
+	return
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' ||
+		c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// encryptedPlaceholders maps the ordinals of the placeholders bound to an
+// encrypted column to its table.column, in
+//
+//	INSERT|REPLACE [INTO] table (col, ...) VALUES (?, ...), ... [ON DUPLICATE KEY UPDATE col = ?, ...]
+//	INSERT|REPLACE [INTO] table SET col = ?, ...
+//	UPDATE table SET col = ?, ... [WHERE ...]
+//
+// Only a placeholder making up a whole value is encrypted. Any other write
+// to a table with encrypted columns would send them in plaintext and fails:
+// an INSERT without a column list, INSERT ... SELECT, a multi-table UPDATE
+// or a placeholder inside an expression like CONCAT(?, 'x') assigned to an
+// encrypted column.
+func (c *crypter) encryptedPlaceholders(query string) (encrypted map[int]string, err error) {
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return
+	}
+	encrypted = map[int]string{}
+	switch {
+	case tokens[0].is("INSERT") || tokens[0].is("REPLACE"):
+		err = c.insertPlaceholders(tokens[1:], encrypted)
+	case tokens[0].is("UPDATE"):
+		err = c.updatePlaceholders(tokens[1:], encrypted)
+	}
+	if err != nil || len(encrypted) == 0 {
+		return nil, err
+	}
+	return
+}
+
+func (c *crypter) insertPlaceholders(tokens []token, encrypted map[int]string) error {
+	tokens = skipKeywords(tokens, "LOW_PRIORITY", "DELAYED", "HIGH_PRIORITY", "IGNORE", "INTO")
+	table, tokens := tableName(tokens)
+	if !c.hasEncryptedColumns(table) {
+		return nil
+	}
+	if len(tokens) > 0 && tokens[0].is("SET") {
+		return c.assignmentPlaceholders(table, tokens[1:], encrypted)
+	}
+	if len(tokens) < 2 || tokens[0].text != "(" || tokens[1].is("SELECT") {
+		return fmt.Errorf("sqlcrypt: insert into %s without a column list can't encrypt its columns", table)
+	}
+
+	var columns []string
+	i := 1
+	for ; i < len(tokens) && tokens[i].text != ")"; i++ {
+		if tokens[i].text != "," {
+			columns = append(columns, tokens[i].text)
+		}
+	}
+	i++
+	if i >= len(tokens) || !(tokens[i].is("VALUES") || tokens[i].is("VALUE")) {
+		return fmt.Errorf("sqlcrypt: insert into %s without VALUES can't encrypt its columns", table)
+	}
+	i++
+
+	// every row of values, items are split on commas at depth 1
+	for i < len(tokens) && tokens[i].text == "(" {
+		column, start, depth := 0, i+1, 1
+		for i++; i < len(tokens) && depth > 0; i++ {
+			switch tokens[i].text {
+			case "(":
+				depth++
+				continue
+			case ")":
+				depth--
+			case ",":
+			default:
+				continue
+			}
+			if depth > 1 || depth == 1 && tokens[i].text != "," || i == start && column == 0 {
+				continue
+			}
+			if column >= len(columns) {
+				return fmt.Errorf("sqlcrypt: insert into %s has more values than columns", table)
+			}
+			err := c.valuePlaceholder(table, columns[column], tokens[start:i], encrypted)
+			if err != nil {
+				return err
+			}
+			column++
+			start = i + 1
+		}
+		if i < len(tokens) && tokens[i].text == "," {
+			i++
+		}
+	}
+
+	for ; i+3 < len(tokens); i++ {
+		if tokens[i].is("ON") && tokens[i+1].is("DUPLICATE") && tokens[i+2].is("KEY") && tokens[i+3].is("UPDATE") {
+			return c.assignmentPlaceholders(table, tokens[i+4:], encrypted)
+		}
+	}
+	return nil
+}
+
+func (c *crypter) updatePlaceholders(tokens []token, encrypted map[int]string) error {
+	tokens = skipKeywords(tokens, "LOW_PRIORITY", "IGNORE")
+	set := len(tokens)
+	multiTable := false
+	for i, t := range tokens {
+		if t.is("SET") {
+			set = i
+			break
+		}
+		multiTable = multiTable || t.text == "," || t.is("JOIN")
+	}
+	if multiTable {
+		// any of the tables may be updated, fail if one is encrypted
+		for _, t := range tokens[:set] {
+			if c.hasEncryptedColumns(t.text) {
+				return fmt.Errorf("sqlcrypt: multi-table update of %s can't encrypt its columns", t.text)
+			}
+		}
+		return nil
+	}
+	if set == len(tokens) {
+		return nil
+	}
+	table, _ := tableName(tokens)
+	return c.assignmentPlaceholders(table, tokens[set+1:], encrypted)
+}
+
+// assignmentPlaceholders reads col = value, ... until the end of the
+// assignment list.
+func (c *crypter) assignmentPlaceholders(table string, tokens []token, encrypted map[int]string) error {
+	for i := 0; i+2 < len(tokens); {
+		column := tokens[i].text
+		if tokens[i+1].text == "." {
+			column = tokens[i+2].text
+			i += 2
+		}
+		if i+1 >= len(tokens) || tokens[i+1].text != "=" {
+			return nil
+		}
+		start, depth := i+2, 0
+		end := start
+		for ; end < len(tokens); end++ {
+			t := tokens[end]
+			if t.text == "(" {
+				depth++
+			} else if t.text == ")" {
+				depth--
+			} else if depth == 0 && (t.text == "," || t.is("WHERE") || t.is("ORDER") ||
+				t.is("LIMIT") || t.is("ON") || t.text == ";") {
+				break
+			}
+		}
+		err := c.valuePlaceholder(table, column, tokens[start:end], encrypted)
+		if err != nil {
+			return err
+		}
+		if end >= len(tokens) || tokens[end].text != "," {
+			return nil
+		}
+		i = end + 1
+	}
+	return nil
+}
+
+// valuePlaceholder records the placeholder making up the value of an
+// encrypted column, and fails on placeholders inside an expression.
+func (c *crypter) valuePlaceholder(table, column string, value []token, encrypted map[int]string) error {
+	name := c.encryptedColumn(table, column)
+	if name == "" {
+		return nil
+	}
+	if len(value) == 1 && value[0].ordinal > 0 {
+		encrypted[value[0].ordinal] = name
+		return nil
+	}
+	for _, t := range value {
+		if t.ordinal > 0 {
+			return fmt.Errorf("sqlcrypt: can't encrypt a placeholder inside an expression for %s", name)
+		}
+	}
+	return nil
+}
+
+// readTables returns the tables following FROM and JOIN in a query, lower
+// cased, those its encrypted values may be read from.
+func readTables(query string) (tables []string) {
+	tokens := tokenize(query)
+	for i, t := range tokens {
+		if !t.is("FROM") && !t.is("JOIN") {
+			continue
+		}
+		// table [[AS] alias], ...
+		rest := tokens[i+1:]
+		for len(rest) > 0 && rest[0].text != "(" {
+			var table string
+			table, rest = tableName(rest)
+			tables = append(tables, strings.ToLower(table))
+			rest = skipKeywords(rest, "AS")
+			if len(rest) > 1 && rest[0].text != "," && rest[1].text == "," {
+				rest = rest[1:]
+			}
+			if len(rest) == 0 || rest[0].text != "," {
+				break
+			}
+			rest = rest[1:]
+		}
+	}
+	return
+}
+
+func skipKeywords(tokens []token, keywords ...string) []token {
+	for len(tokens) > 0 {
+		found := false
+		for _, keyword := range keywords {
+			if tokens[0].is(keyword) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	return tokens
+}
+
+// tableName reads table or schema.table.
+func tableName(tokens []token) (table string, rest []token) {
+	if len(tokens) == 0 {
+		return "", tokens
+	}
+	table, rest = tokens[0].text, tokens[1:]
+	if len(rest) > 1 && rest[0].text == "." {
+		table, rest = rest[1].text, rest[2:]
+	}
+	return
+}
@@ -0,0 +1,174 @@
+package sqlcrypt
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{`SELECT 'a?b', "c?", ?`, []string{"SELECT", "'a?b'", ",", `"c?"`, ",", "?1"}},
+		{`'it\'s ?' ?`, []string{`'it\'s ?'`, "?1"}},
+		{`'it''s ?' ?`, []string{`'it''s ?'`, "?1"}},
+		{`"say ""?""" ?`, []string{`"say ""?"""`, "?1"}},
+		{"`odd ? name` ?", []string{"odd ? name", "?1"}},
+		{"`a``b` ?", []string{"a`b", "?1"}},
+		{"# ?\n?", []string{"?1"}},
+		{"-- ?\n?", []string{"?1"}},
+		{"--\t?\n?", []string{"?1"}},
+		{"1--? ?", []string{"1", "-", "-", "?1", "?2"}},
+		{"/* ? */ ? /* ?", []string{"?1"}},
+		{"'not closed ?", []string{"'not closed ?"}},
+		{"temp=?,humidity=?", []string{"temp", "=", "?1", ",", "humidity", "=", "?2"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, tok := range tokenize(test.query) {
+			if tok.ordinal > 0 {
+				got = append(got, "?"+strconv.Itoa(tok.ordinal))
+			} else {
+				got = append(got, tok.text)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestEncryptedPlaceholders(t *testing.T) {
+	c := newCrypter(Config{Columns: map[string][]string{"weather": {"temp", "Humidity"}}})
+	tests := []struct {
+		query string
+		want  map[int]string
+	}{
+		{
+			"INSERT INTO weather(time, temp, humidity) VALUES (?, ?, ?)",
+			map[int]string{2: "weather.temp", 3: "weather.humidity"},
+		},
+		{
+			"INSERT INTO weather (temp, time) VALUES (?, NOW()), (?, ?)",
+			map[int]string{1: "weather.temp", 2: "weather.temp"},
+		},
+		{
+			"insert into `WEATHER` (`Temp`) values (?)",
+			map[int]string{1: "weather.temp"},
+		},
+		{
+			"INSERT INTO weather (note, temp) VALUES ('what?', ?)",
+			map[int]string{1: "weather.temp"},
+		},
+		{
+			"INSERT INTO weather (note, temp) VALUES ('it''s ?', ?)",
+			map[int]string{1: "weather.temp"},
+		},
+		{
+			"INSERT INTO weather (temp /* , humidity */, note) VALUES (?, ?) -- ?",
+			map[int]string{1: "weather.temp"},
+		},
+		{
+			"INSERT INTO weather (note, temp) VALUES (CONCAT(?, 'x'), ?)",
+			map[int]string{2: "weather.temp"},
+		},
+		{
+			"INSERT INTO weather () VALUES ()",
+			nil,
+		},
+		{
+			"INSERT weather SET time = NOW(), temp = ?",
+			map[int]string{1: "weather.temp"},
+		},
+		{
+			"INSERT INTO weather (id, temp) VALUES (?, ?) ON DUPLICATE KEY UPDATE temp = ?",
+			map[int]string{2: "weather.temp", 3: "weather.temp"},
+		},
+		{
+			"UPDATE weather SET humidity = ?, time = ? WHERE temp = ?",
+			map[int]string{1: "weather.humidity"},
+		},
+		{
+			"UPDATE app.weather w SET w.temp = ? WHERE id = ?",
+			map[int]string{1: "weather.temp"},
+		},
+		{
+			"UPDATE weather SET note = '?', temp = ? # humidity = ?",
+			map[int]string{1: "weather.temp"},
+		},
+		{
+			"INSERT INTO station (temp) VALUES (?)",
+			nil,
+		},
+		{
+			"INSERT INTO station SELECT * FROM weather WHERE id = ?",
+			nil,
+		},
+		{
+			"UPDATE station s JOIN city c ON s.city = c.id SET s.name = ?",
+			nil,
+		},
+		{
+			"SELECT temp FROM weather WHERE temp = ?",
+			nil,
+		},
+	}
+	for _, test := range tests {
+		got, err := c.encryptedPlaceholders(test.query)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("encryptedPlaceholders(%q) = %v, %v, want %v", test.query, got, err, test.want)
+		}
+	}
+}
+
+// TestUnmappedWritesFail covers the writes to an encrypted table the
+// driver can't map every placeholder of, which would send plaintext.
+func TestUnmappedWritesFail(t *testing.T) {
+	c := newCrypter(Config{Columns: map[string][]string{"weather": {"temp"}}})
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"INSERT INTO weather VALUES (?, ?, ?)", "without a column list"},
+		{"REPLACE weather VALUE (?)", "without a column list"},
+		{"INSERT INTO weather (SELECT * FROM station WHERE id = ?)", "without a column list"},
+		{"INSERT INTO weather (time, temp) SELECT NOW(), ?", "without VALUES"},
+		{"INSERT INTO weather SELECT * FROM archive", "without a column list"},
+		{"INSERT INTO weather (time, temp) VALUES (?, ?, ?)", "more values than columns"},
+		{"INSERT INTO weather (temp) VALUES (CONCAT(?, 'x'))", "inside an expression for weather.temp"},
+		{"INSERT INTO weather (temp) VALUES ((SELECT ?))", "inside an expression for weather.temp"},
+		{"INSERT weather SET temp = ? + 1", "inside an expression for weather.temp"},
+		{"INSERT INTO weather (id, temp) VALUES (?, ?) ON DUPLICATE KEY UPDATE temp = IFNULL(?, temp)", "inside an expression for weather.temp"},
+		{"UPDATE weather SET temp = LOWER(?) WHERE id = ?", "inside an expression for weather.temp"},
+		{"UPDATE weather w JOIN station s ON w.station = s.id SET w.temp = ?", "multi-table update of weather"},
+		{"UPDATE station, weather SET weather.temp = ?", "multi-table update of weather"},
+	}
+	for _, test := range tests {
+		got, err := c.encryptedPlaceholders(test.query)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("encryptedPlaceholders(%q) = %v, %v, want error %q", test.query, got, err, test.err)
+		}
+	}
+}
+
+func TestReadTables(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT temp FROM weather WHERE id = ?", []string{"weather"}},
+		{"select * from `App`.`Weather` w", []string{"weather"}},
+		{"SELECT * FROM weather AS w, station s, city WHERE 1", []string{"weather", "station", "city"}},
+		{"SELECT * FROM weather w LEFT JOIN archive a ON a.id = w.id", []string{"weather", "archive"}},
+		{"SELECT t.temp FROM (SELECT temp FROM weather) t", []string{"weather"}},
+		{"SELECT 1", nil},
+	}
+	for _, test := range tests {
+		if got := readTables(test.query); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("readTables(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
@@ -8,9 +8,15 @@ require (
 	github.com/aws/aws-sdk-go-v2/feature/rds/auth v1.1.7
 	github.com/coreos/etcd v3.3.10+incompatible // indirect
 	github.com/coreos/go-etcd v2.0.0+incompatible // indirect
-	github.com/go-sql-driver/mysql v1.6.0 // indirect
+	github.com/go-sql-driver/mysql v1.6.0
 	github.com/sirupsen/logrus v1.8.1
-	github.com/spf13/viper v1.9.0 // indirect
+	github.com/spf13/viper v1.9.0
 	github.com/ugorji/go/codec v0.0.0-20181204163529-d75b2dcb6bc8 // indirect
 	github.com/xordataexchange/crypt v0.0.3-0.20170626215501-b2862e3d0a77 // indirect
+	secretprovider v0.0.0
+	sqlcrypt v0.0.0
 )
+
+replace secretprovider => ../credential-manager/secretprovider
+
+replace sqlcrypt => ../data-encryption/sqlcrypt
@@ -10,6 +10,8 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"secretprovider"
+	"sqlcrypt"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
@@ -30,11 +32,13 @@ func init() {
 	if errConfig != nil {
 		log.Fatalln(errConfig)
 	}
+	secretprovider.InstallRedactor(viper.GetViper())
 	log.WithField("status", "success").Debug("initialize")
 }
 
 func main() {
 	authToken := getRDSToken()
+	secretprovider.DefaultRedactor.Add(authToken)
 	db := connectRDS(authToken)
 	testQuery(db)
 }
@@ -71,10 +75,11 @@ func connectRDS(authToken string) (db *sql.DB) {
 
 	tlsConfig := registerRDSMysqlCerts()
 	mysql.RegisterTLSConfig("rds", &tlsConfig)
-	db, err := sql.Open("mysql", dsn)
+	connector, err := mysql.MySQLDriver{}.OpenConnector(dsn)
 	if err != nil {
 		panic(err)
 	}
+	db = sql.OpenDB(sqlcrypt.ConnectorFromViper(viper.GetViper(), viper.GetString("AWSREGION"), connector))
 	err = db.Ping()
 	if err != nil {
 		panic(err)
@@ -110,7 +115,7 @@ func testQuery(db *sql.DB) {
 		Rating int
 	}
 
-	rows, err := db.Query("select * from movie")
+	rows, err := db.Query("select id, title, genre, rating from movie")
 	if err != nil {
 		log.Fatalln(err)
 	}